@@ -5,6 +5,7 @@ package bchan
 
 import (
 	"log"
+	"sync"
 	"sync/atomic"
 )
 
@@ -21,6 +22,7 @@ type Bchan interface {
 
 type bchan struct {
 	prod chan interface{}
+	mu   sync.Mutex
 	cons map[*bchanCons]struct{}
 }
 
@@ -40,7 +42,9 @@ func (b *bchan) NewConsumer() BchanConsumer {
 	ch := &bchanCons{
 		ch: make(chan interface{}, 1),
 	}
+	b.mu.Lock()
 	b.cons[ch] = struct{}{}
+	b.mu.Unlock()
 	return ch
 }
 func (b *bchan) Close() {
@@ -54,6 +58,7 @@ func (b *bchan) run() {
 			break
 		}
 		//log.Printf("produced %#v", val)
+		b.mu.Lock()
 		for cons := range b.cons {
 			//log.Printf("consider consumer %#v", cons)
 			if atomic.LoadInt32(&cons.closed) != 0 {
@@ -67,7 +72,10 @@ func (b *bchan) run() {
 			default:
 			}
 		}
+		b.mu.Unlock()
 	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	for cons := range b.cons {
 		close(cons.ch)
 		delete(b.cons, cons)
@@ -0,0 +1,71 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package cmd
+
+import (
+	"log"
+	"time"
+
+	"github.com/ikravets/errs"
+	"github.com/jessevdk/go-flags"
+
+	"my/ev/packet/bats"
+)
+
+type cmdBatsRecovery struct {
+	FeedAddr                string        `long:"feed" required:"y" value-name:"IPADDR" description:"PITCH feed address, mcast or unicast"`
+	GapAddr                 string        `long:"gap" value-name:"IPADDR" description:"gap response mcast address"`
+	Interface               string        `long:"interface" value-name:"IFACE" description:"interface to join mcast on"`
+	GrpAddr                 string        `long:"grp" value-name:"IPADDR" description:"gap request proxy address"`
+	SpinAddr                string        `long:"spin" value-name:"IPADDR" description:"spin server address; start from live feed if not set"`
+	Unit                    int           `long:"unit" default:"1" value-name:"NUM" description:"unit number"`
+	SessionSubId            string        `long:"session-sub-id" value-name:"ID" description:"GRP and spin login session sub id"`
+	Username                string        `long:"username" value-name:"NAME" description:"GRP and spin login username"`
+	Password                string        `long:"password" value-name:"PASSWORD" description:"GRP and spin login password"`
+	MaxMessages             int           `long:"max-messages" value-name:"NUM" description:"messages per gap request"`
+	Timeout                 time.Duration `long:"timeout" value-name:"DURATION" description:"gap response and spin retry timeout"`
+	Retries                 int           `long:"retries" value-name:"NUM" description:"retries of gap requests and spins"`
+	Duration                time.Duration `long:"duration" value-name:"DURATION" description:"stop after duration"`
+	OutputFileNameSimOrders string        `long:"output-sim-orders" value-name:"FILE" description:"output file for hw simulator"`
+	OutputFileNameEfhOrders string        `long:"output-efh-orders" value-name:"FILE" description:"output file for EFH order messages"`
+	shouldExecute           bool
+}
+
+func (c *cmdBatsRecovery) Execute(args []string) error {
+	c.shouldExecute = true
+	return nil
+}
+
+func (c *cmdBatsRecovery) ConfigParser(parser *flags.Parser) {
+	_, err := parser.AddCommand("bats_recovery", "receive PITCH unit recovering by spin and GRP", "", c)
+	errs.CheckE(err)
+}
+
+func (c *cmdBatsRecovery) ParsingFinished() (err error) {
+	if !c.shouldExecute {
+		return
+	}
+	rc := bats.NewRecoveryClient(bats.RecoveryConfig{
+		FeedAddr:     c.FeedAddr,
+		GapAddr:      c.GapAddr,
+		Interface:    c.Interface,
+		GrpAddr:      c.GrpAddr,
+		SpinAddr:     c.SpinAddr,
+		Unit:         c.Unit,
+		SessionSubId: c.SessionSubId,
+		Username:     c.Username,
+		Password:     c.Password,
+		MaxMessages:  c.MaxMessages,
+		Timeout:      c.Timeout,
+		Retries:      c.Retries,
+	})
+	errs.CheckE(runRecoveryClient(rc, c.Duration, c.OutputFileNameSimOrders, c.OutputFileNameEfhOrders))
+	log.Printf("%#v\n", rc.Stats())
+	return
+}
+
+func init() {
+	var c cmdBatsRecovery
+	Registry.Register(&c)
+}
@@ -6,6 +6,7 @@ package cmd
 import (
 	"io/ioutil"
 	"log"
+	"time"
 
 	"github.com/ikravets/errs"
 	"github.com/jessevdk/go-flags"
@@ -14,14 +15,25 @@ import (
 	"my/ev/efh"
 	"my/ev/inspect"
 	"my/ev/inspect/device"
+	"my/ev/packet"
+	"my/ev/rec"
 )
 
 type cmdEfhReplay struct {
-	InputFileName   string `long:"replay-dump" required:"y" value-name:"PCAP_FILE" description:"input pcap file to read"`
-	OutputInterface string `long:"replay-iface" required:"y" value-name:"IFACE" description:"output interface name"`
-	Pps             int    `long:"replay-pps"   short:"p" value-name:"NUM" description:"packets per second"`
-	Limit           int    `long:"replay-limit" short:"L" value-name:"NUM" description:"stop after NUM packets"`
-	Loop            int    `long:"replay-loop"  short:"l" value-name:"NUM" description:"loop NUM times"`
+	InputFileName   string        `long:"replay-dump" required:"y" value-name:"PCAP_FILE" description:"input pcap file to read"`
+	OutputInterface string        `long:"replay-iface" value-name:"IFACE" description:"output interface name, required unless --replay-socket"`
+	Pps             int           `long:"replay-pps"   short:"p" value-name:"NUM" description:"packets per second"`
+	Limit           int           `long:"replay-limit" short:"L" value-name:"NUM" description:"stop after NUM packets"`
+	Loop            int           `long:"replay-loop"  short:"l" value-name:"NUM" description:"loop NUM times"`
+	Socket          bool          `long:"replay-socket" description:"send UDP payloads through sockets, no raw interface access needed"`
+	Remap           []string      `long:"replay-remap" value-name:"FROM=TO" description:"socket: send to TO instead of FROM; ip:port, ip or * (any)"`
+	Speed           float64       `long:"replay-speed" value-name:"FACTOR" description:"follow capture timestamps FACTOR times faster; --replay-pps then caps rate"`
+	Burst           int           `long:"replay-burst" value-name:"NUM" description:"speed: packets allowed back to back by --replay-pps cap"`
+	CompressIdle    time.Duration `long:"replay-compress-idle" value-name:"DURATION" description:"speed: shorten capture gaps longer than DURATION to DURATION"`
+	Rewrite         []string      `long:"replay-rewrite" value-name:"RULE" description:"rewrite headers, e.g. channel=233.54.12.1:18001,dst-ip=239.1.1.1,dst-mac=01:00:5e:01:01:01,vlan=pop"`
+	Keep            []string      `long:"replay-keep" value-name:"CHANNEL" description:"replay only CHANNEL (ip:port or ip), drop others"`
+	Control         bool          `long:"replay-control" description:"control replay (pause, step, seek, speed) from terminal; seeking needs classic pcap input"`
+	ControlSocket   string        `long:"replay-control-socket" value-name:"PATH" description:"control replay through unix socket"`
 
 	EfhLoglevel  int      `long:"efh-loglevel" default:"6"`
 	EfhIgnoreGap bool     `long:"efh-ignore-gap"`
@@ -32,6 +44,9 @@ type cmdEfhReplay struct {
 
 	Inspect string `long:"inspect" short:"c" value-name:"YML_FILE" description:"input register config file to read"`
 
+	DiffIgnore []string `long:"diff-ignore" value-name:"FIELD" description:"ignore EFH message field in dump diff report, e.g. HDR.TS"`
+	DiffMax    int      `long:"diff-max" value-name:"NUM" default:"10" description:"report first NUM differing messages"`
+
 	TestEfh string `long:"test-efh" default:"/usr/libexec/test_efh"`
 	Local   bool   `long:"local"`
 
@@ -53,6 +68,16 @@ func (c *cmdEfhReplay) ParsingFinished() (err error) {
 	if !c.shouldExecute {
 		return
 	}
+	errs.Check(c.Socket || c.OutputInterface != "", "replay interface is required")
+	errs.Check(c.Speed >= 0, "bad replay speed", c.Speed)
+	remap, err := parseRemap(c.Remap)
+	errs.CheckE(err)
+	var rewrite []packet.RewriteRule
+	for _, s := range c.Rewrite {
+		rr, err := packet.ParseRewriteRule(s)
+		errs.CheckE(err)
+		rewrite = append(rewrite, rr)
+	}
 	cc := channels.NewConfig()
 	for _, s := range c.EfhChannel {
 		errs.CheckE(cc.LoadFromStr(s))
@@ -73,6 +98,15 @@ func (c *cmdEfhReplay) ParsingFinished() (err error) {
 		Pps:             c.Pps,
 		Limit:           c.Limit,
 		Loop:            c.Loop,
+		Socket:          c.Socket,
+		Remap:           remap,
+		Speed:           c.Speed,
+		Burst:           c.Burst,
+		CompressIdle:    c.CompressIdle,
+		Rewrite:         rewrite,
+		Keep:            c.Keep,
+		ControlTerminal: c.Control,
+		ControlSocket:   c.ControlSocket,
 		EfhLoglevel:     c.EfhLoglevel,
 		EfhIgnoreGap:    c.EfhIgnoreGap,
 		EfhDump:         c.EfhDump,
@@ -80,8 +114,12 @@ func (c *cmdEfhReplay) ParsingFinished() (err error) {
 		EfhChannel:      cc,
 		EfhProf:         c.EfhProf,
 		RegConfig:       c.regConfig,
-		TestEfh:         c.TestEfh,
-		Local:           c.Local,
+		DiffConfig: rec.EfhDiffConfig{
+			IgnoreFields: c.DiffIgnore,
+			MaxReports:   c.DiffMax,
+		},
+		TestEfh: c.TestEfh,
+		Local:   c.Local,
 	}
 	er := efh.NewEfhReplay(conf)
 	err = er.Run()
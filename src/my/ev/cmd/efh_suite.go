@@ -4,7 +4,9 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -19,6 +21,7 @@ import (
 	"my/ev/efh"
 	"my/ev/inspect"
 	"my/ev/inspect/device"
+	"my/ev/rec"
 )
 
 type cmdEfhSuite struct {
@@ -32,12 +35,20 @@ type cmdEfhSuite struct {
 	EfhLoglevel int      `long:"efh-loglevel" default:"6"`
 	EfhProf     bool     `long:"efh-prof"`
 	Inspect     string   `long:"inspect" short:"c" value-name:"YML_FILE" description:"input register config file to read"`
+	DiffIgnore  []string `long:"diff-ignore" value-name:"FIELD" description:"ignore EFH message field in failure reports, e.g. HDR.TS"`
+	DiffMax     int      `long:"diff-max" value-name:"NUM" default:"10" description:"report first NUM differing messages"`
+	Dut         string   `long:"dut" value-name:"DUT" default:"hw" description:"device under test: hw (test_efh, dump replayed on eth1), sim (built-in efhsim) or exec (--dut-exec)"`
+	DutExec     string   `long:"dut-exec" value-name:"CMD" description:"command reading {input} pcap and writing {output} EFH dump; implies --dut=exec"`
+	Regenerate  bool     `long:"regenerate" description:"write expected outputs (expout-efh-orders*) by running efhsim instead of running tests"`
+	DryRun      bool     `long:"dry-run" description:"regenerate: only show differences from current expected outputs"`
+	OutputJSON  string   `long:"output-json" value-name:"FILE" description:"also write JSON results to FILE (always written to results.json in output dir)"`
+	OutputJUnit string   `long:"output-junit" value-name:"FILE" description:"also write JUnit XML results to FILE (always written to junit.xml in output dir)"`
 
 	shouldExecute bool
 	topOutDirName string
 	regConfig     *inspect.Config
-	testRunsTotal int
-	testRunsOk    int
+	results       efh.SuiteResults
+	regenStats    struct{ same, changed, added int }
 }
 
 func (c *cmdEfhSuite) Execute(args []string) error {
@@ -56,7 +67,15 @@ func (c *cmdEfhSuite) ParsingFinished() (err error) {
 	if !c.shouldExecute {
 		return
 	}
-	c.topOutDirName = time.Now().Format("efh_regression.2006-01-02-15:04:05")
+	if c.DutExec != "" {
+		c.Dut = efh.DutExec
+	}
+	errs.Check(c.Dut == efh.DutHardware || c.Dut == efh.DutSim || c.Dut == efh.DutExec, "unknown device under test", c.Dut)
+	errs.Check(c.Inspect == "" || c.Dut == efh.DutHardware, "register inspection requires hw device under test")
+	errs.Check(c.Regenerate || !c.DryRun, "dry run is only supported with regenerate")
+	c.results.Start = time.Now()
+	c.results.Dut = c.Dut
+	c.topOutDirName = c.results.Start.Format("efh_regression.2006-01-02-15:04:05")
 	suitesDirName := fmt.Sprintf("/local/dumps/%s/regression", c.Exchange)
 
 	if len(c.Suites) == 0 || c.Suites[0] == "?" {
@@ -109,12 +128,16 @@ func (c *cmdEfhSuite) ParsingFinished() (err error) {
 			continue
 		}
 
+		run := c.RunTest
+		if c.Regenerate {
+			run = c.RegenerateTest
+		}
 		for _, testName := range tests {
 			testDirName := filepath.Join(suiteDirName, testName)
 			subscriptionFileNames, err := filepath.Glob(filepath.Join(testDirName, "subscription*"))
 			errs.CheckE(err)
 			if len(subscriptionFileNames) == 0 {
-				c.RunTest(testDirName, nil)
+				run(testDirName, nil)
 			} else {
 				for _, sfn := range subscriptionFileNames {
 					a := strings.SplitAfter(sfn, "/subscription")
@@ -122,30 +145,100 @@ func (c *cmdEfhSuite) ParsingFinished() (err error) {
 					if len(a) > 0 {
 						suf = a[len(a)-1]
 					}
-					c.RunTest(testDirName, &suf)
+					run(testDirName, &suf)
 				}
 			}
 		}
 	}
-	log.Printf("Tests OK/Total: %d/%d\n", c.testRunsOk, c.testRunsTotal)
-	fmt.Printf("Tests OK/Total: %d/%d\n", c.testRunsOk, c.testRunsTotal)
+	if c.Regenerate {
+		note := ""
+		if c.DryRun {
+			note = " (dry run, not written)"
+		}
+		fmt.Printf("Expected outputs unchanged: %d, changed: %d, new: %d%s\n", c.regenStats.same, c.regenStats.changed, c.regenStats.added, note)
+		return
+	}
+	if len(c.results.Tests) == 0 {
+		return
+	}
+	c.results.Duration = time.Since(c.results.Start).Seconds()
+	errs.CheckE(c.writeResults(filepath.Join(c.topOutDirName, "results.json"), c.results.WriteJSON))
+	errs.CheckE(c.writeResults(filepath.Join(c.topOutDirName, "junit.xml"), c.results.WriteJUnit))
+	if c.OutputJSON != "" {
+		errs.CheckE(c.writeResults(c.OutputJSON, c.results.WriteJSON))
+	}
+	if c.OutputJUnit != "" {
+		errs.CheckE(c.writeResults(c.OutputJUnit, c.results.WriteJUnit))
+	}
+	log.Printf("Tests OK/Total: %d/%d\n", c.results.OkNum(), len(c.results.Tests))
+	fmt.Printf("Tests OK/Total: %d/%d\n", c.results.OkNum(), len(c.results.Tests))
+	return
+}
+
+func (c *cmdEfhSuite) writeResults(fileName string, write func(io.Writer) error) (err error) {
+	defer errs.PassE(&err)
+	file, err := os.Create(fileName)
+	errs.CheckE(err)
+	defer func() {
+		if e := file.Close(); err == nil {
+			err = e
+		}
+	}()
+	errs.CheckE(write(file))
 	return
 }
+
+// output files linked from results, if present
+var efhSuiteArtifacts = []string{
+	efh.DiffReportFileName,
+	"registers",
+	"test_efh.log",
+	"test_efh.out",
+	"test_efh.dump",
+	"dut.out",
+	"dut.dump",
+}
+
 func (c *cmdEfhSuite) RunTest(testDirName string, suffix *string) (err error) {
-	defer errs.Catch(func(ce errs.CheckerError) {
-		log.Printf("caught %s\n", ce)
-		err = ce
-	})
-	c.testRunsTotal++
-	testRunName := time.Now().Format("2006-01-02-15:04:05.")
 	tdnDir, tdnFile := filepath.Split(testDirName)
 	tdnDir = filepath.Base(tdnDir)
-	testRunName += tdnDir + "-" + tdnFile
+	res := efh.SuiteTestResult{
+		Suite: tdnDir,
+		Test:  tdnFile,
+		Start: time.Now(),
+	}
+	if suffix != nil {
+		res.Variant = "subscription" + *suffix
+	}
+	testRunName := res.Start.Format("2006-01-02-15:04:05.") + tdnDir + "-" + tdnFile
 	if suffix != nil {
 		testRunName += *suffix
 	}
 	fmt.Printf("run %s\n", testRunName)
 	outDirName := filepath.Join(c.topOutDirName, testRunName)
+	var dut efh.Dut
+	defer func() {
+		res.Duration = time.Since(res.Start).Seconds()
+		res.Ok = err == nil
+		if err != nil {
+			res.Failure = err.Error()
+		}
+		if dut != nil {
+			dr := dut.Result()
+			res.DiffSummary, res.BadRegisters, res.ExitStatus = dr.DiffSummary, dr.BadRegisters, dr.ExitStatus
+		}
+		res.RunDir, _ = filepath.Abs(outDirName)
+		for _, a := range efhSuiteArtifacts {
+			if _, err := os.Stat(filepath.Join(res.RunDir, a)); err == nil {
+				res.Artifacts = append(res.Artifacts, filepath.Join(res.RunDir, a))
+			}
+		}
+		c.results.Tests = append(c.results.Tests, res)
+	}()
+	defer errs.Catch(func(ce errs.CheckerError) {
+		log.Printf("caught %s\n", ce)
+		err = ce
+	})
 	expoutName := filepath.Join(testDirName, "expout-efh-orders")
 	if suffix != nil {
 		expoutName += *suffix
@@ -173,26 +266,98 @@ func (c *cmdEfhSuite) RunTest(testDirName string, suffix *string) (err error) {
 		EfhChannel:      c.genEfhChannels(testDirName),
 		EfhProf:         c.EfhProf,
 		RegConfig:       c.regConfig,
-		TestEfh:         c.TestEfh,
-		Local:           c.Local,
+		DiffConfig: rec.EfhDiffConfig{
+			IgnoreFields: c.DiffIgnore,
+			MaxReports:   c.DiffMax,
+		},
+		TestEfh: c.TestEfh,
+		Local:   c.Local,
+		Dut:     c.Dut,
+		DutExec: c.DutExec,
 	}
 	if suffix != nil {
 		subscr := "subscription" + *suffix
 		errs.CheckE(os.Symlink(filepath.Join(testDirName, subscr), filepath.Join(outDirName, subscr)))
 		conf.EfhSubscribe = []string{subscr}
 	}
+	dut, err = efh.NewDut(conf)
+	errs.CheckE(err)
 	origWd, err := os.Getwd()
 	errs.CheckE(err)
 	errs.CheckE(os.Chdir(outDirName))
-	er := efh.NewEfhReplay(conf)
-	efhReplayErr := er.Run()
+	efhReplayErr := dut.Run()
 	errs.CheckE(os.Chdir(origWd))
+	if efhReplayErr == efh.DumpsDifferError {
+		fmt.Printf("dumps differ, see %s\n", filepath.Join(outDirName, efh.DiffReportFileName))
+	}
 	errs.CheckE(efhReplayErr)
 	errs.CheckE(ioutil.WriteFile(filepath.Join(outDirName, "ok"), nil, 0666))
 	errs.CheckE(os.Remove(filepath.Join(outDirName, "fail")))
-	c.testRunsOk++
 	return
 }
+
+// runs efhsim on the test dump and updates expected output, reporting differences from the previous one
+func (c *cmdEfhSuite) RegenerateTest(testDirName string, suffix *string) (err error) {
+	defer errs.Catch(func(ce errs.CheckerError) {
+		log.Printf("caught %s\n", ce)
+		err = ce
+	})
+	expoutName := filepath.Join(testDirName, "expout-efh-orders")
+	conf := efh.ReplayConfig{
+		InputFileName: filepath.Join(testDirName, "dump.pcap"),
+		Limit:         c.Limit,
+		EfhChannel:    c.genEfhChannels(testDirName),
+	}
+	if suffix != nil {
+		expoutName += *suffix
+		conf.EfhSubscribe = []string{filepath.Join(testDirName, "subscription"+*suffix)}
+	}
+	tmpFile, err := ioutil.TempFile("", "expout-efh-orders")
+	errs.CheckE(err)
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+	errs.CheckE(efh.SimulateDump(conf, tmpFile.Name()))
+
+	if _, err = os.Stat(expoutName); os.IsNotExist(err) {
+		fmt.Printf("new %s\n", expoutName)
+		c.regenStats.added++
+	} else {
+		errs.CheckE(err)
+		var same bool
+		same, err = efh.CompareDumps(expoutName, tmpFile.Name())
+		errs.CheckE(err)
+		if same {
+			c.regenStats.same++
+			return
+		}
+		// report only; --diff-ignore does not prevent the update
+		var buf bytes.Buffer
+		same, err = efh.DiffDumps(expoutName, tmpFile.Name(), rec.EfhDiffConfig{
+			IgnoreFields: c.DiffIgnore,
+			MaxReports:   c.DiffMax,
+		}, &buf)
+		errs.CheckE(err)
+		fmt.Printf("changed %s\n%s", expoutName, buf.String())
+		if same {
+			fmt.Printf("(differs in ignored fields or format only)\n")
+		}
+		fmt.Println()
+		c.regenStats.changed++
+	}
+	if c.DryRun {
+		return
+	}
+	in, err := os.Open(tmpFile.Name())
+	errs.CheckE(err)
+	defer in.Close()
+	out, err := os.Create(expoutName)
+	errs.CheckE(err)
+	_, err = io.Copy(out, in)
+	errs.CheckE(err)
+	errs.CheckE(out.Close())
+	return
+}
+
 func (c *cmdEfhSuite) genEfhChannels(testDirName string) (cc channels.Config) {
 	cc = channels.NewConfig()
 	if file, err := os.Open(filepath.Join(testDirName, "channels")); err == nil {
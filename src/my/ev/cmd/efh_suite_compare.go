@@ -0,0 +1,57 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package cmd
+
+import (
+	"errors"
+	"os"
+
+	"github.com/ikravets/errs"
+	"github.com/jessevdk/go-flags"
+
+	"my/ev/efh"
+)
+
+type cmdEfhSuiteCompare struct {
+	OldFileName   string `long:"old" required:"y" value-name:"JSON_FILE" description:"baseline efh_suite results"`
+	NewFileName   string `long:"new" required:"y" value-name:"JSON_FILE" description:"efh_suite results to check"`
+	shouldExecute bool
+}
+
+func (c *cmdEfhSuiteCompare) Execute(args []string) error {
+	c.shouldExecute = true
+	return nil
+}
+
+func (c *cmdEfhSuiteCompare) ConfigParser(parser *flags.Parser) {
+	parser.AddCommand("efh_suite_compare", "compare efh_suite results, report new failures and fixes", "", c)
+}
+
+var errNewFailures = errors.New("new failures")
+
+func (c *cmdEfhSuiteCompare) ParsingFinished() (err error) {
+	if !c.shouldExecute {
+		return
+	}
+	defer errs.PassE(&err)
+	read := func(fileName string) *efh.SuiteResults {
+		file, err := os.Open(fileName)
+		errs.CheckE(err)
+		defer file.Close()
+		res, err := efh.ReadSuiteResults(file)
+		errs.CheckE(err)
+		return res
+	}
+	comp := efh.CompareSuiteResults(read(c.OldFileName), read(c.NewFileName))
+	errs.CheckE(comp.Report(os.Stdout))
+	if len(comp.NewFailures) != 0 {
+		return errNewFailures
+	}
+	return
+}
+
+func init() {
+	var c cmdEfhSuiteCompare
+	Registry.Register(&c)
+}
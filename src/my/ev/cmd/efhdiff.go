@@ -0,0 +1,56 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/ikravets/errs"
+	"github.com/jessevdk/go-flags"
+
+	"my/ev/efh"
+	"my/ev/rec"
+)
+
+type cmdEfhDiff struct {
+	ExpFileName   string   `long:"exp" short:"e" required:"y" value-name:"FILE" description:"expected EFH dump (binary or text)"`
+	ActFileName   string   `long:"act" short:"a" required:"y" value-name:"FILE" description:"actual EFH dump (binary or text)"`
+	IgnoreFields  []string `long:"ignore" short:"I" value-name:"FIELD" description:"ignore field, e.g. HDR.TS or SN"`
+	MaxReports    int      `long:"max-diffs" short:"n" value-name:"NUM" default:"10" description:"report first NUM differing messages"`
+	Window        int      `long:"window" value-name:"NUM" default:"64" description:"lookahead to resync after missing messages"`
+	shouldExecute bool
+}
+
+func (c *cmdEfhDiff) Execute(args []string) error {
+	c.shouldExecute = true
+	return nil
+}
+
+func (c *cmdEfhDiff) ConfigParser(parser *flags.Parser) {
+	_, err := parser.AddCommand("efhdiff", "compare EFH dumps", "", c)
+	errs.CheckE(err)
+}
+
+func (c *cmdEfhDiff) ParsingFinished() (err error) {
+	if !c.shouldExecute {
+		return
+	}
+	defer errs.PassE(&err)
+	conf := rec.EfhDiffConfig{
+		IgnoreFields: c.IgnoreFields,
+		MaxReports:   c.MaxReports,
+		Window:       c.Window,
+	}
+	same, err := efh.DiffDumps(c.ExpFileName, c.ActFileName, conf, os.Stdout)
+	errs.CheckE(err)
+	if !same {
+		err = efh.DumpsDifferError
+	}
+	return
+}
+
+func init() {
+	var c cmdEfhDiff
+	Registry.Register(&c)
+}
@@ -12,33 +12,46 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/google/gopacket"
 	"github.com/ikravets/errs"
 	"github.com/jessevdk/go-flags"
 
 	"my/ev/anal"
 	"my/ev/channels"
 	"my/ev/efhsim"
+	"my/ev/packet"
 	"my/ev/rec"
 )
 
 type cmdEfhsim struct {
-	InputFileName           string   `long:"input" short:"i" required:"y" value-name:"PCAP_FILE" description:"input pcap file to read"`
-	TobBook                 bool     `long:"tob" short:"t" description:"use 1-level-deep book (for exchange disseminating ToB only)"`
-	SubscriptionFileName    string   `long:"subscribe" short:"s" value-name:"SUBSCRIPTION_FILE" description:"read subscriptions from file"`
-	Channels                []string `long:"channel"`
-	OutputFileNameSimOrders string   `long:"output-sim-orders" value-name:"FILE" description:"output file for hw simulator"`
-	OutputFileNameSimQuotes string   `long:"output-sim-quotes" value-name:"FILE" description:"output file for hw simulator"`
-	OutputFileNameEfhOrders string   `long:"output-efh-orders" value-name:"FILE" description:"output file for EFH order messages"`
-	OutputFileNameEfhQuotes string   `long:"output-efh-quotes" value-name:"FILE" description:"output file for EFH quote messages"`
-	OutputFileNameAvt       string   `long:"output-avt" value-name:"FILE" description:"output file for AVT CSV"`
-	InputFileNameAvtDict    string   `long:"avt-dict" value-name:"DICT" description:"read dictionary for AVT CSV output"`
-	OutputDirStats          string   `long:"output-stats" value-name:"DIR" description:"output dir for stats"`
-	PacketNumLimit          int      `long:"count" short:"c" value-name:"NUM" description:"limit number of input packets"`
-	NoHwLim                 bool     `long:"no-hw-lim" description:"do not enforce HW limits"`
-	Md5sum                  bool     `long:"md5sum" description:"compute md5sum on output file(s)"`
+	InputFileName           string        `long:"input" short:"i" value-name:"PCAP_FILE" description:"input pcap file to read"`
+	Live                    bool          `long:"live" description:"receive channels from network instead of reading pcap, until interrupted"`
+	Interface               string        `long:"interface" value-name:"IFACE" description:"live: interface to join mcast on"`
+	Rotate                  time.Duration `long:"rotate" value-name:"DURATION" description:"live: rotate output files periodically and on SIGHUP, adding .N suffix"`
+	TobBook                 bool          `long:"tob" short:"t" description:"use 1-level-deep book (for exchange disseminating ToB only)"`
+	SubscriptionFileName    string        `long:"subscribe" short:"s" value-name:"SUBSCRIPTION_FILE" description:"read subscriptions from file"`
+	Channels                []string      `long:"channel"`
+	OutputFileNameSimOrders string        `long:"output-sim-orders" value-name:"FILE" description:"output file for hw simulator"`
+	OutputFileNameSimQuotes string        `long:"output-sim-quotes" value-name:"FILE" description:"output file for hw simulator"`
+	OutputFileNameEfhOrders string        `long:"output-efh-orders" value-name:"FILE" description:"output file for EFH order messages"`
+	OutputFileNameEfhQuotes string        `long:"output-efh-quotes" value-name:"FILE" description:"output file for EFH quote messages"`
+	OutputFileNameEfhBinary string        `long:"output-efh-binary" value-name:"FILE" description:"output file for EFH order messages in test_efh dump format"`
+	OutputFileNameAvt       string        `long:"output-avt" value-name:"FILE" description:"output file for AVT CSV"`
+	InputFileNameAvtDict    string        `long:"avt-dict" value-name:"DICT" description:"read dictionary for AVT CSV output"`
+	OutputDirStats          string        `long:"output-stats" value-name:"DIR" description:"output dir for stats"`
+	PacketNumLimit          int           `long:"count" short:"c" value-name:"NUM" description:"limit number of input packets"`
+	NoHwLim                 bool          `long:"no-hw-lim" description:"do not enforce HW limits"`
+	HwLimProfile            string        `long:"hw-lim-profile" value-name:"YML_FILE" description:"read HW limit profile, see examples/hwlim_profile.yml"`
+	HwLimReport             string        `long:"hw-lim-report" value-name:"FILE" description:"output file for HW limit violations and peak utilization"`
+	HwLimReportOnly         bool          `long:"hw-lim-report-only" description:"record HW limit violations instead of failing on the first one"`
+	Md5sum                  bool          `long:"md5sum" description:"compute md5sum on output file(s)"`
 	shouldExecute           bool
 	closers                 []io.Closer
+	rotatingOuts            []*rotatingOut
 }
 
 func (c *cmdEfhsim) Execute(args []string) error {
@@ -55,10 +68,13 @@ func (c *cmdEfhsim) ParsingFinished() (err error) {
 	if !c.shouldExecute {
 		return
 	}
+	errs.Check(c.Live != (c.InputFileName != ""), "either input pcap or live mode is required")
+	errs.Check(c.Live || c.Rotate == 0, "rotation is supported in live mode only")
+	errs.Check(!c.Live || len(c.Channels) > 0, "live mode requires channels")
 	efh := efhsim.NewEfhSim(c.TobBook)
 	efh.SetInput(c.InputFileName, c.PacketNumLimit)
+	cc := channels.NewConfig()
 	if len(c.Channels) > 0 {
-		cc := channels.NewConfig()
 		for _, s := range c.Channels {
 			errs.CheckE(cc.LoadFromStr(s))
 		}
@@ -70,15 +86,7 @@ func (c *cmdEfhsim) ParsingFinished() (err error) {
 		errs.CheckE(efh.SubscribeFromReader(file))
 		errs.CheckE(file.Close())
 	}
-	if !c.NoHwLim {
-		if efh.SubscriptionsNum() == 0 {
-			log.Println("running in auto-subscription mode, not enforcing hw limit")
-		} else if efh.SubscriptionsNum() > rec.HwMaxSubscriptions {
-			log.Println("too many subscriptions, not enforcing hw limit")
-		} else {
-			efh.AddLogger(rec.NewHwLimChecker())
-		}
-	}
+	hwLimChecker := c.addHwLimChecker(efh)
 	efhLoggerConfig := rec.EfhLoggerConfig{}
 	simLoggerConfig := rec.SimLoggerConfig{}
 	if c.TobBook {
@@ -110,6 +118,12 @@ func (c *cmdEfhsim) ParsingFinished() (err error) {
 		lc.Mode = rec.EfhLoggerOutputQuotes
 		return efh.AddLogger(rec.NewEfhLogger(lc))
 	})
+	c.addOut(c.OutputFileNameEfhBinary, func(w io.Writer) error {
+		lc := efhLoggerConfig
+		lc.Printer = rec.NewBinaryPrinter(w)
+		lc.Mode = rec.EfhLoggerOutputOrders
+		return efh.AddLogger(rec.NewEfhLogger(lc))
+	})
 	c.addOut(c.OutputFileNameAvt, func(w io.Writer) (err error) {
 		defer errs.PassE(&err)
 		var dict io.ReadCloser
@@ -123,7 +137,11 @@ func (c *cmdEfhsim) ParsingFinished() (err error) {
 	reporter := c.addAnalyzer(efh)
 
 	// run efhsim
-	errs.CheckE(efh.AnalyzeInput())
+	if c.Live {
+		errs.CheckE(c.runLive(efh, cc))
+	} else {
+		errs.CheckE(efh.AnalyzeInput())
+	}
 
 	for _, cl := range c.closers {
 		errs.CheckE(cl.Close())
@@ -131,24 +149,69 @@ func (c *cmdEfhsim) ParsingFinished() (err error) {
 	if reporter != nil {
 		reporter.SaveAll()
 	}
+	if hwLimChecker != nil && c.HwLimReport != "" {
+		file, err := os.Create(c.HwLimReport)
+		errs.CheckE(err)
+		defer file.Close()
+		errs.CheckE(hwLimChecker.Report(file))
+	}
+	if hwLimChecker != nil && hwLimChecker.ViolationsNum() != 0 {
+		log.Printf("%d HW limit violations\n", hwLimChecker.ViolationsNum())
+	}
 	return
 }
 
+func (c *cmdEfhsim) addHwLimChecker(efh *efhsim.EfhSim) *rec.HwLimChecker {
+	if c.NoHwLim {
+		return nil
+	}
+	profile := rec.HwLimProfileDefault
+	if c.HwLimProfile != "" {
+		file, err := os.Open(c.HwLimProfile)
+		errs.CheckE(err)
+		profile, err = rec.LoadHwLimProfile(file)
+		errs.CheckE(err)
+		errs.CheckE(file.Close())
+	}
+	mode := rec.HwLimModeFailFast
+	if c.HwLimReportOnly {
+		mode = rec.HwLimModeReportOnly
+	} else if efh.SubscriptionsNum() == 0 {
+		log.Println("running in auto-subscription mode, not enforcing hw limit")
+		return nil
+	} else if profile.Subscriptions != 0 && efh.SubscriptionsNum() > profile.Subscriptions {
+		log.Println("too many subscriptions, not enforcing hw limit")
+		return nil
+	}
+	hlc := rec.NewHwLimChecker(profile, mode)
+	efh.AddLogger(hlc)
+	return hlc
+}
+
 func (c *cmdEfhsim) addOut(fileName string, setOut func(io.Writer) error) {
 	if fileName == "" {
 		return
 	}
 	var err error
 	var o io.WriteCloser
-	if c.Md5sum {
-		o, err = NewHashedOut(fileName)
+	if c.Rotate != 0 {
+		ro, err := newRotatingOut(fileName, c.create)
+		errs.CheckE(err)
+		c.rotatingOuts = append(c.rotatingOuts, ro)
+		o = ro
 	} else {
-		o, err = os.Create(fileName)
+		o, err = c.create(fileName)
+		errs.CheckE(err)
 	}
-	errs.CheckE(err)
 	errs.CheckE(setOut(o))
 	c.closers = append(c.closers, o)
 }
+func (c *cmdEfhsim) create(fileName string) (io.WriteCloser, error) {
+	if c.Md5sum {
+		return NewHashedOut(fileName)
+	}
+	return os.Create(fileName)
+}
 func (c *cmdEfhsim) addAnalyzer(efh *efhsim.EfhSim) *anal.Reporter {
 	if c.OutputDirStats == "" {
 		return nil
@@ -172,6 +235,67 @@ func (c *cmdEfhsim) addAnalyzer(efh *efhsim.EfhSim) *anal.Reporter {
 	return reporter
 }
 
+func (c *cmdEfhsim) runLive(efh *efhsim.EfhSim, cc channels.Config) (err error) {
+	defer errs.PassE(&err)
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, ch := range cc.Addrs() {
+		a, _, err := channels.ParseChannel(ch)
+		errs.CheckE(err)
+		if !seen[a.String()] {
+			seen[a.String()] = true
+			addrs = append(addrs, a.String())
+		}
+	}
+	obtainer, err := packet.NewUdpObtainer(addrs, c.Interface)
+	errs.CheckE(err)
+	defer obtainer.Close()
+	log.Printf("receiving %d channels\n", len(addrs))
+
+	rotate := make(chan struct{}, 1)
+	requestRotate := func() {
+		select {
+		case rotate <- struct{}{}:
+		default:
+		}
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sig)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var tick <-chan time.Time
+		if c.Rotate != 0 {
+			ticker := time.NewTicker(c.Rotate)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick:
+				requestRotate()
+			case s := <-sig:
+				if s == syscall.SIGHUP {
+					requestRotate()
+					continue
+				}
+				log.Printf("got %s, stopping\n", s)
+				obtainer.Close()
+				return
+			}
+		}
+	}()
+	errs.CheckE(efh.AnalyzeObtainer(&rotatingObtainer{
+		Obtainer: obtainer,
+		rotate:   rotate,
+		outs:     c.rotatingOuts,
+	}))
+	return
+}
+
 func init() {
 	var c cmdEfhsim
 	Registry.Register(&c)
@@ -215,3 +339,63 @@ func (o *hashedOut) Close() (err error) {
 	}
 	return
 }
+
+// output file switching to the next .N suffixed file on Rotate
+type rotatingOut struct {
+	baseName string
+	create   func(string) (io.WriteCloser, error)
+	num      int
+	out      io.WriteCloser
+}
+
+func newRotatingOut(baseName string, create func(string) (io.WriteCloser, error)) (o *rotatingOut, err error) {
+	o = &rotatingOut{
+		baseName: baseName,
+		create:   create,
+	}
+	err = o.Rotate()
+	return
+}
+func (o *rotatingOut) Rotate() (err error) {
+	defer errs.PassE(&err)
+	if o.out != nil {
+		errs.CheckE(o.out.Close())
+	}
+	o.out, err = o.create(fmt.Sprintf("%s.%d", o.baseName, o.num))
+	errs.CheckE(err)
+	o.num++
+	return
+}
+func (o *rotatingOut) Write(b []byte) (int, error) {
+	return o.out.Write(b)
+}
+func (o *rotatingOut) Close() error {
+	return o.out.Close()
+}
+
+// rotates outputs between packets, so that output of a packet is never split
+type rotatingObtainer struct {
+	packet.Obtainer
+	rotate <-chan struct{}
+	outs   []*rotatingOut
+}
+
+func (o *rotatingObtainer) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	data, ci, err = o.Obtainer.ReadPacketData()
+	o.checkRotate()
+	return
+}
+func (o *rotatingObtainer) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	data, ci, err = o.Obtainer.ZeroCopyReadPacketData()
+	o.checkRotate()
+	return
+}
+func (o *rotatingObtainer) checkRotate() {
+	select {
+	case <-o.rotate:
+		for _, out := range o.outs {
+			errs.CheckE(out.Rotate())
+		}
+	default:
+	}
+}
@@ -4,6 +4,12 @@
 package cmd
 
 import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/ikravets/errs"
 	"github.com/jessevdk/go-flags"
 
@@ -11,15 +17,24 @@ import (
 )
 
 type cmdExch struct {
-	Type          string `long:"type" short:"t" value-name:"EXCH" default:"nasdaq" description:"exchange type: nasdaq, bats"`
-	Laddr         string `long:"local-addr" value-name:"IPADDR" default:"10.2.0.5:0" description:"local address"`
-	RTMCaddr      string `long:"feed-multicast" value-name:"IPADDR" default:"224.0.131.0:30101" description:"feed server mcast address"`
-	GRMCaddr      string `long:"gap-multicast" value-name:"IPADDR" default:"233.130.124.0:30101" description:"gap server mcast address"`
-	Speed         int    `long:"speed" value-name:"NUM" default:"1" description:"speed message per second"`
-	PartNumLimit  int    `long:"count" short:"c" value-name:"NUM" default:"1" description:"limit number of partitions"`
-	Interactive   bool   `long:"interactive" short:"i" description:"run interactively"`
-	GapPeriod     uint64 `long:"gap-period" short:"g" value-name:"NUM" default:"0xFFFFFFFFFFFFFF" description:"period simulate gap"`
-	GapSize       uint64 `long:"gap-limit" short:"s" value-name:"NUM" default:"0" description:"limit number of gap messages"`
+	Type          string   `long:"type" short:"t" value-name:"EXCH" default:"nasdaq" description:"exchange type: nasdaq, bats"`
+	Laddr         string   `long:"local-addr" value-name:"IPADDR" default:"10.2.0.5:0" description:"local address"`
+	RTMCaddr      string   `long:"feed-multicast" value-name:"IPADDR" description:"feed server mcast address of the first partition (default: nasdaq channels 233.54.12.1:18001.., others 224.0.131.0:30101)"`
+	GRMCaddr      string   `long:"gap-multicast" value-name:"IPADDR" default:"233.130.124.0:30101" description:"gap server mcast address"`
+	Speed         int      `long:"speed" value-name:"NUM" default:"1" description:"speed message per second"`
+	PartNumLimit  int      `long:"count" short:"c" value-name:"NUM" default:"1" description:"limit number of partitions (nasdaq: sessions)"`
+	Interactive   bool     `long:"interactive" short:"i" description:"run interactively"`
+	GapPeriod     uint64   `long:"gap-period" short:"g" value-name:"NUM" default:"0xFFFFFFFFFFFFFF" description:"period simulate gap"`
+	GapSize       uint64   `long:"gap-limit" short:"s" value-name:"NUM" default:"0" description:"limit number of gap messages"`
+	Input         string   `long:"input" value-name:"FILE" description:"nasdaq: publish messages from pcap or soupbintcp stream file"`
+	InputDst      string   `long:"input-dst" value-name:"IPADDR" description:"nasdaq: take messages sent to this mcast address from input pcap"`
+	Pacing        bool     `long:"original-pacing" description:"nasdaq: publish input pcap messages at original pace instead of --speed"`
+	Scenario      string   `long:"scenario" value-name:"YAML_FILE" description:"nasdaq: publish messages compiled from scenario (not supported by bats and miax simulators, replay output of scenario command instead)"`
+	Faults        []string `long:"fault" value-name:"SPEC" description:"inject mcast faults, e.g. channel=0,seed=1,loss=0.001,burst=0.0001:20,dup=0.001,reorder=0.01:4,delay=0.001:20ms,truncate=0.001,reset=0.00001,b=IPADDR,diverge=0.01"`
+	FaultLog      string   `long:"fault-log" value-name:"FILE" description:"log injected faults to file"`
+	Match         bool     `long:"match" description:"nasdaq: publish orders entered by OUCH on port 15001+session to matching engine"`
+	Sessions      string   `long:"nasdaq-sessions" value-name:"YAML_FILE" description:"nasdaq: per-session feed, glimpse and rerequest addresses, speed and input"`
+	Control       string   `long:"control" value-name:"IPADDR" description:"serve HTTP/JSON status, pause, resume, rate and stop, e.g. localhost:18000"`
 	shouldExecute bool
 }
 
@@ -36,6 +51,9 @@ func (c *cmdExch) ParsingFinished() (err error) {
 	if !c.shouldExecute {
 		return
 	}
+	if c.RTMCaddr == "" && c.Type != "nasdaq" {
+		c.RTMCaddr = "224.0.131.0:30101"
+	}
 	conf := exch.Config{
 		Protocol:     c.Type,
 		LocalAddr:    c.Laddr,
@@ -46,10 +64,57 @@ func (c *cmdExch) ParsingFinished() (err error) {
 		GapPeriod:    c.GapPeriod,
 		GapSize:      c.GapSize,
 		PartNumLimit: c.PartNumLimit,
+
+		InputFileName:  c.Input,
+		InputDstAddr:   c.InputDst,
+		OriginalPacing: c.Pacing,
+
+		ScenarioFileName: c.Scenario,
+		Match:            c.Match,
+	}
+	for _, f := range c.Faults {
+		fc, err := exch.ParseFaultConfig(f)
+		errs.CheckE(err)
+		conf.Faults = append(conf.Faults, fc)
+	}
+	if c.Sessions != "" {
+		file, err := os.Open(c.Sessions)
+		errs.CheckE(err)
+		conf.NasdaqSessions, err = exch.LoadNasdaqSessions(file)
+		file.Close()
+		errs.CheckE(err)
+	}
+	if c.FaultLog != "" {
+		file, err := os.Create(c.FaultLog)
+		errs.CheckE(err)
+		defer file.Close()
+		conf.FaultLog = log.New(file, "", log.LstdFlags|log.Lmicroseconds)
 	}
 	es, err := exch.NewExchangeSimulator(conf)
 	errs.CheckE(err)
-	es.Run()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case s := <-sig:
+			log.Printf("got %s, stopping\n", s)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if c.Control != "" {
+		go func() {
+			if err := exch.RunControlServer(ctx, c.Control, exch.NewControlHandler(es, cancel)); err != nil {
+				log.Printf("control server: %s\n", err)
+				cancel()
+			}
+		}()
+	}
+	errs.CheckE(es.Run(ctx))
 	return
 }
 
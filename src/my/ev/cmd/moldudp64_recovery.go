@@ -0,0 +1,61 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package cmd
+
+import (
+	"log"
+	"time"
+
+	"github.com/ikravets/errs"
+	"github.com/jessevdk/go-flags"
+
+	"my/ev/packet/nasdaq"
+)
+
+type cmdMoldudp64Recovery struct {
+	FeedAddr                string        `long:"feed" required:"y" value-name:"IPADDR" description:"MoldUDP64 feed address, mcast or unicast"`
+	Interface               string        `long:"interface" value-name:"IFACE" description:"interface to join mcast on"`
+	RerequestAddr           string        `long:"rerequest" required:"y" value-name:"IPADDR" description:"rerequest server address"`
+	StartSequence           uint64        `long:"sequence" value-name:"SEQ" description:"first sequence number to deliver; start from live feed if not set"`
+	MaxMessages             int           `long:"max-messages" value-name:"NUM" description:"messages per rerequest"`
+	Timeout                 time.Duration `long:"timeout" value-name:"DURATION" description:"rerequest response timeout"`
+	Retries                 int           `long:"retries" value-name:"NUM" description:"retries of unanswered rerequests"`
+	Duration                time.Duration `long:"duration" value-name:"DURATION" description:"stop after duration"`
+	OutputFileNameSimOrders string        `long:"output-sim-orders" value-name:"FILE" description:"output file for hw simulator"`
+	OutputFileNameEfhOrders string        `long:"output-efh-orders" value-name:"FILE" description:"output file for EFH order messages"`
+	shouldExecute           bool
+}
+
+func (c *cmdMoldudp64Recovery) Execute(args []string) error {
+	c.shouldExecute = true
+	return nil
+}
+
+func (c *cmdMoldudp64Recovery) ConfigParser(parser *flags.Parser) {
+	_, err := parser.AddCommand("moldudp64_recovery", "receive MoldUDP64 ITTO feed recovering gaps by rerequests", "", c)
+	errs.CheckE(err)
+}
+
+func (c *cmdMoldudp64Recovery) ParsingFinished() (err error) {
+	if !c.shouldExecute {
+		return
+	}
+	rc := nasdaq.NewRecoveryClient(nasdaq.RecoveryConfig{
+		FeedAddr:      c.FeedAddr,
+		Interface:     c.Interface,
+		RerequestAddr: c.RerequestAddr,
+		StartSequence: c.StartSequence,
+		MaxMessages:   c.MaxMessages,
+		Timeout:       c.Timeout,
+		Retries:       c.Retries,
+	})
+	errs.CheckE(runRecoveryClient(rc, c.Duration, c.OutputFileNameSimOrders, c.OutputFileNameEfhOrders))
+	log.Printf("%#v\n", rc.Stats())
+	return
+}
+
+func init() {
+	var c cmdMoldudp64Recovery
+	Registry.Register(&c)
+}
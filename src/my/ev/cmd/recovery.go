@@ -0,0 +1,77 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package cmd
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ikravets/errs"
+
+	"my/ev/efhsim"
+	"my/ev/packet"
+	"my/ev/rec"
+	"my/ev/sim"
+)
+
+// feed client delivering recovered messages in sequence order, e.g. nasdaq.RecoveryClient
+type recoveryClient interface {
+	SetHandler(handler packet.Handler)
+	Run(ctx context.Context) error
+}
+
+// runs rc feeding efhsim order outputs until interrupted or duration elapses
+func runRecoveryClient(rc recoveryClient, duration time.Duration, simOrdersFileName, efhOrdersFileName string) (err error) {
+	defer errs.PassE(&err)
+	efh := efhsim.NewEfhSim(false)
+	var closers []io.Closer
+	defer func() {
+		for _, cl := range closers {
+			if e := cl.Close(); err == nil {
+				err = e
+			}
+		}
+	}()
+	addOut := func(fileName string, newLogger func(rec.EfhLoggerConfig) sim.Observer) {
+		if fileName == "" {
+			return
+		}
+		file, err := os.Create(fileName)
+		errs.CheckE(err)
+		closers = append(closers, file)
+		errs.CheckE(efh.AddLogger(newLogger(rec.EfhLoggerConfig{Writer: file, Mode: rec.EfhLoggerOutputOrders})))
+	}
+	addOut(simOrdersFileName, func(lc rec.EfhLoggerConfig) sim.Observer {
+		return rec.NewSimLogger(rec.SimLoggerConfig{EfhLoggerConfig: lc})
+	})
+	addOut(efhOrdersFileName, func(lc rec.EfhLoggerConfig) sim.Observer {
+		return rec.NewEfhLogger(lc)
+	})
+	rc.SetHandler(efh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if duration != 0 {
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case s := <-sig:
+			log.Printf("got %s, stopping\n", s)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	errs.CheckE(rc.Run(ctx))
+	return
+}
@@ -4,6 +4,9 @@
 package cmd
 
 import (
+	"strings"
+	"time"
+
 	"github.com/ikravets/errs"
 	"github.com/jessevdk/go-flags"
 
@@ -11,11 +14,18 @@ import (
 )
 
 type cmdReplay struct {
-	InputFileName   string `long:"input" short:"i" required:"y" value-name:"PCAP_FILE" description:"input pcap file to read"`
-	OutputInterface string `long:"iface" required:"y" value-name:"IFACE" description:"output interface name"`
-	Pps             int    `long:"pps"   short:"p" value-name:"NUM" description:"packets per second"`
-	Limit           int    `long:"limit" short:"L" value-name:"NUM" description:"stop after NUM packets"`
-	Loop            int    `long:"loop"  short:"l" value-name:"NUM" description:"loop NUM times"`
+	InputFileName   string        `long:"input" short:"i" required:"y" value-name:"PCAP_FILE" description:"input pcap file to read"`
+	OutputInterface string        `long:"iface" value-name:"IFACE" description:"output interface name, required unless --socket"`
+	Pps             int           `long:"pps"   short:"p" value-name:"NUM" description:"packets per second"`
+	Limit           int           `long:"limit" short:"L" value-name:"NUM" description:"stop after NUM packets"`
+	Loop            int           `long:"loop"  short:"l" value-name:"NUM" description:"loop NUM times"`
+	Socket          bool          `long:"socket" description:"send UDP payloads through sockets, no raw interface access needed"`
+	Remap           []string      `long:"remap" value-name:"FROM=TO" description:"socket: send to TO instead of FROM; ip:port, ip or * (any)"`
+	Speed           float64       `long:"speed" value-name:"FACTOR" description:"follow capture timestamps FACTOR times faster; --pps then caps rate"`
+	Burst           int           `long:"burst" value-name:"NUM" description:"speed: packets allowed back to back by --pps cap"`
+	CompressIdle    time.Duration `long:"compress-idle" value-name:"DURATION" description:"speed: shorten capture gaps longer than DURATION to DURATION"`
+	Rewrite         []string      `long:"rewrite" value-name:"RULE" description:"rewrite headers, e.g. channel=233.54.12.1:18001,dst-ip=239.1.1.1,dst-mac=01:00:5e:01:01:01,vlan=pop"`
+	Keep            []string      `long:"keep" value-name:"CHANNEL" description:"replay only CHANNEL (ip:port or ip), drop others"`
 	shouldExecute   bool
 }
 
@@ -32,18 +42,49 @@ func (c *cmdReplay) ParsingFinished() (err error) {
 	if !c.shouldExecute {
 		return
 	}
+	errs.Check(c.Socket || c.OutputInterface != "", "output interface is required")
+	errs.Check(c.Speed >= 0, "bad speed", c.Speed)
+	remap, err := parseRemap(c.Remap)
+	errs.CheckE(err)
+	var rewrite []packet.RewriteRule
+	for _, s := range c.Rewrite {
+		rr, err := packet.ParseRewriteRule(s)
+		errs.CheckE(err)
+		rewrite = append(rewrite, rr)
+	}
 	conf := packet.ReplayConfig{
-		IfaceName: c.OutputInterface,
-		DumpName:  c.InputFileName,
-		Limit:     c.Limit,
-		Pps:       c.Pps,
-		Loop:      c.Loop,
+		IfaceName:    c.OutputInterface,
+		DumpName:     c.InputFileName,
+		Limit:        c.Limit,
+		Pps:          c.Pps,
+		Loop:         c.Loop,
+		Socket:       c.Socket,
+		Remap:        remap,
+		Speed:        c.Speed,
+		Burst:        c.Burst,
+		CompressIdle: c.CompressIdle,
+		Rewrite:      rewrite,
+		Keep:         c.Keep,
 	}
 	r := packet.NewReplay(&conf)
 	errs.CheckE(r.Run())
 	return
 }
 
+func parseRemap(specs []string) (remap map[string]string, err error) {
+	defer errs.PassE(&err)
+	if len(specs) == 0 {
+		return
+	}
+	remap = make(map[string]string)
+	for _, spec := range specs {
+		fields := strings.Split(spec, "=")
+		errs.Check(len(fields) == 2 && fields[0] != "" && fields[1] != "", "bad remap", spec)
+		remap[fields[0]] = fields[1]
+	}
+	return
+}
+
 func init() {
 	var c cmdReplay
 	Registry.Register(&c)
@@ -0,0 +1,88 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ikravets/errs"
+	"github.com/jessevdk/go-flags"
+
+	"my/ev/channels"
+	"my/ev/efh"
+	"my/ev/exch/scenario"
+)
+
+func init() {
+	var c cmdScenario
+	Registry.Register(&c)
+}
+
+type cmdScenario struct {
+	InputFileName  string `long:"input" short:"i" required:"y" value-name:"YAML_FILE" description:"scenario file"`
+	Protocol       string `long:"protocol" short:"p" default:"nasdaq" value-name:"EXCH" description:"feed protocol: nasdaq, bats, miax"`
+	OutputFileName string `long:"output-pcap" short:"o" value-name:"PCAP_FILE" description:"output pcap file"`
+	TestDir        string `long:"test-dir" value-name:"DIR" description:"create efh_suite test directory with dump.pcap, channels and expected output simulated by efhsim and checked against expect (nasdaq and bats only)"`
+	shouldExecute  bool
+}
+
+func (c *cmdScenario) Execute(args []string) error {
+	c.shouldExecute = true
+	return nil
+}
+
+func (c *cmdScenario) ConfigParser(parser *flags.Parser) {
+	parser.AddCommand("scenario", "compile exchange scenario to pcap", "", c)
+}
+
+func (c *cmdScenario) ParsingFinished() (err error) {
+	if !c.shouldExecute {
+		return
+	}
+	defer errs.PassE(&err)
+	in, err := os.Open(c.InputFileName)
+	errs.CheckE(err)
+	s, err := scenario.Load(in)
+	in.Close()
+	errs.CheckE(err)
+	feed, err := scenario.Compile(s, c.Protocol)
+	errs.CheckE(err)
+	log.Printf("compiled %d events to %d packets\n", len(s.Events), len(feed.Packets))
+
+	writePcap := func(fileName string) {
+		out, err := os.OpenFile(fileName, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+		errs.CheckE(err)
+		defer out.Close()
+		errs.CheckE(scenario.WritePcap(out, feed))
+	}
+	if c.OutputFileName != "" {
+		writePcap(c.OutputFileName)
+	}
+	if c.TestDir != "" {
+		// efhsim produces EFH order messages, MIAX ToM feed is simulated in quotes mode only
+		errs.Check(c.Protocol != "miax", "test directory is not supported for miax")
+		errs.CheckE(os.MkdirAll(c.TestDir, 0755))
+		writePcap(filepath.Join(c.TestDir, "dump.pcap"))
+		errs.CheckE(ioutil.WriteFile(filepath.Join(c.TestDir, "channels"), []byte(feed.Channel()+"\n"), 0644))
+		// efh_suite compares test_efh output with the expected dump byte by byte, so it is produced by efhsim
+		cc := channels.NewConfig()
+		errs.CheckE(cc.LoadFromStr(feed.Channel()))
+		conf := efh.ReplayConfig{
+			InputFileName: filepath.Join(c.TestDir, "dump.pcap"),
+			EfhChannel:    cc,
+		}
+		expoutName := filepath.Join(c.TestDir, "expout-efh-orders")
+		errs.CheckE(efh.SimulateDump(conf, expoutName))
+		if len(s.Expect) != 0 {
+			dump, err := os.Open(expoutName)
+			errs.CheckE(err)
+			defer dump.Close()
+			errs.CheckE(s.CheckExpected(dump))
+		}
+	}
+	return
+}
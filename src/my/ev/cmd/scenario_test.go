@@ -0,0 +1,59 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"my/ev/efh"
+)
+
+const testScenario = `
+session: "0000000001"
+options:
+  - {id: 1, underlying: AAPL, expiration: "20161216", strike: 100, type: C}
+events:
+  - seconds: 34200
+  - add: {order: 1, option: 1, side: B, price: 1.25, size: 10}
+  - add: {order: 2, option: 1, side: S, price: 1.5, size: 3}
+  - delete: {order: 1}
+`
+
+var testScenarioExpect = map[string]string{
+	"nasdaq": `
+expect:
+  - "HDR{T:4, SId:0000000000000001} DEF_NOM{SP:1000000, PC:1}"
+  - "HDR{T:3} ORD{OS:+1, P:12500, S:10}"
+  - "HDR{T:3} ORD{OS:-1, P:15000, S:3}"
+  - "HDR{T:3} ORD{OS:+1, S:0}"
+`,
+	"bats": "",
+}
+
+// test directory created by scenario passes efh_suite with simulated device
+func TestScenarioTestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scenario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for protocol, expect := range testScenarioExpect {
+		yml := filepath.Join(dir, protocol+".yml")
+		if err := ioutil.WriteFile(yml, []byte(testScenario+expect), 0644); err != nil {
+			t.Fatal(err)
+		}
+		testDir := filepath.Join(dir, "suite", protocol)
+		sc := cmdScenario{InputFileName: yml, Protocol: protocol, TestDir: testDir, shouldExecute: true}
+		if err := sc.ParsingFinished(); err != nil {
+			t.Fatalf("%s: %s", protocol, err)
+		}
+		es := cmdEfhSuite{Dut: efh.DutSim, topOutDirName: filepath.Join(dir, "out")}
+		if err := es.RunTest(testDir, nil); err != nil {
+			t.Errorf("%s: %s", protocol, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/ikravets/errs"
+	"github.com/jessevdk/go-flags"
+
+	"my/ev/exch/miax"
+	"my/ev/exch/scenario"
+	pmiax "my/ev/packet/miax"
+)
+
+type cmdSesm struct {
+	Addr           string        `long:"addr" required:"y" value-name:"IPADDR" description:"SesM server address"`
+	Username       string        `long:"username" value-name:"NAME" description:"login username"`
+	ComputerID     string        `long:"computer-id" value-name:"ID" description:"login computer id"`
+	Session        int           `long:"session" value-name:"NUM" description:"session to log into, 0 for active"`
+	Timeout        time.Duration `long:"timeout" value-name:"DURATION" description:"connect and response timeout"`
+	Start          uint64        `long:"start" value-name:"SEQ" description:"retransmit from sequence number"`
+	End            uint64        `long:"end" value-name:"SEQ" description:"retransmit up to sequence number, highest at login by default"`
+	Refresh        string        `long:"refresh" value-name:"TYPE" choice:"tom" choice:"series" description:"download refresh instead of retransmission"`
+	OutputFileName string        `long:"output" short:"o" value-name:"FILE" default:"/dev/stdout" default-mask:"stdout" description:"output message file"`
+	OutputPcap     string        `long:"output-pcap" value-name:"PCAP_FILE" description:"output pcap file"`
+	shouldExecute  bool
+}
+
+func (c *cmdSesm) Execute(args []string) error {
+	c.shouldExecute = true
+	return nil
+}
+
+func (c *cmdSesm) ConfigParser(parser *flags.Parser) {
+	parser.AddCommand("sesm", "download MIAX retransmission or refresh by SesM", "", c)
+}
+
+func (c *cmdSesm) ParsingFinished() (err error) {
+	if !c.shouldExecute {
+		return
+	}
+	errs.Check(c.Refresh != "" || c.Start != 0, "retransmission start or refresh is required")
+	client, err := miax.Dial(miax.ClientConfig{
+		Addr:       c.Addr,
+		Username:   c.Username,
+		ComputerID: c.ComputerID,
+		Session:    c.Session,
+		Timeout:    c.Timeout,
+	})
+	errs.CheckE(err)
+	defer client.Close()
+
+	outFile, err := os.OpenFile(c.OutputFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	errs.CheckE(err)
+	defer func() { errs.CheckE(outFile.Close()) }()
+	w := bufio.NewWriter(outFile)
+	feed := &scenario.Feed{Protocol: "miax"}
+	handle := func(seq uint64, m []byte) error {
+		feed.Packets = append(feed.Packets, scenario.Packet{
+			Time:     time.Now(),
+			Seq:      int(seq),
+			Messages: [][]byte{append([]byte(nil), m...)},
+		})
+		if len(m) == 0 {
+			return nil
+		}
+		layer := pmiax.TomMessageTypeMetadata[m[0]].CreateLayer()
+		if err := layer.DecodeFromBytes(m, gopacket.NilDecodeFeedback); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w, "%d %s\n", seq, gopacket.LayerString(layer))
+		return err
+	}
+	switch c.Refresh {
+	case "tom":
+		errs.CheckE(client.Refresh(miax.SesMRefreshToM, handle))
+	case "series":
+		errs.CheckE(client.Refresh(miax.SesMRefreshSeriesUpdate, handle))
+	default:
+		end := c.End
+		if end == 0 {
+			end = client.HighestSequence()
+		}
+		errs.CheckE(client.Retransmit(c.Start, end, handle))
+	}
+	errs.CheckE(w.Flush())
+	log.Printf("sesm: %d messages\n", len(feed.Packets))
+
+	if c.OutputPcap != "" {
+		file, err := os.Create(c.OutputPcap)
+		errs.CheckE(err)
+		defer file.Close()
+		errs.CheckE(scenario.WritePcap(file, feed))
+	}
+	return
+}
+
+func init() {
+	var c cmdSesm
+	Registry.Register(&c)
+}
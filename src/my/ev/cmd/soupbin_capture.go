@@ -0,0 +1,138 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ikravets/errs"
+	"github.com/jessevdk/go-flags"
+
+	"my/ev/exch/sbtcp"
+	"my/ev/exch/scenario"
+)
+
+type cmdSoupbinCapture struct {
+	Addr          string        `long:"addr" required:"y" value-name:"IPADDR" description:"SoupBinTCP server address"`
+	Username      string        `long:"username" value-name:"NAME" description:"login username"`
+	Password      string        `long:"password" value-name:"PASSWORD" description:"login password"`
+	Session       string        `long:"session" value-name:"SESSION" description:"session to log into, blank for active"`
+	Sequence      int           `long:"sequence" default:"1" value-name:"SEQ" description:"first sequence number to receive, 0 for new messages only"`
+	Timeout       time.Duration `long:"timeout" value-name:"DURATION" description:"connect, login and server heartbeat timeout"`
+	Duration      time.Duration `long:"duration" value-name:"DURATION" description:"stop after duration"`
+	Limit         int           `long:"count" short:"c" value-name:"NUM" description:"stop after number of sequenced messages"`
+	OutputFile    string        `long:"output" short:"o" value-name:"FILE" description:"output soupbintcp data stream"`
+	OutputPcap    string        `long:"output-pcap" value-name:"PCAP_FILE" description:"output MoldUDP64 pcap file"`
+	shouldExecute bool
+}
+
+func (c *cmdSoupbinCapture) Execute(args []string) error {
+	c.shouldExecute = true
+	return nil
+}
+
+func (c *cmdSoupbinCapture) ConfigParser(parser *flags.Parser) {
+	parser.AddCommand("soupbin_capture", "log into SoupBinTCP server and capture sequenced data", "", c)
+}
+
+var errCaptureLimit = errors.New("capture limit reached")
+
+func (c *cmdSoupbinCapture) ParsingFinished() (err error) {
+	if !c.shouldExecute {
+		return
+	}
+	errs.Check(c.OutputFile != "" || c.OutputPcap != "", "output file or pcap is required")
+	client, err := sbtcp.Dial(sbtcp.ClientConfig{
+		Addr:     c.Addr,
+		Username: c.Username,
+		Password: c.Password,
+		Session:  c.Session,
+		Sequence: c.Sequence,
+		Timeout:  c.Timeout,
+	})
+	errs.CheckE(err)
+	defer client.Close()
+
+	var w *bufio.Writer
+	if c.OutputFile != "" {
+		outFile, err := os.Create(c.OutputFile)
+		errs.CheckE(err)
+		defer func() { errs.CheckE(outFile.Close()) }()
+		w = bufio.NewWriter(outFile)
+		// exch reads session and first sequence number from login accepted
+		errs.CheckE(sbtcp.WriteMessage(w, &sbtcp.MessageLoginAccepted{
+			Session:        client.Session(),
+			SequenceNumber: client.Sequence(),
+		}))
+	}
+	feed := &scenario.Feed{Protocol: "nasdaq", Session: client.Session()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if c.Duration != 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.Duration)
+		defer cancel()
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case s := <-sig:
+			log.Printf("got %s, stopping\n", s)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var count int
+	err = client.Run(ctx, func(seq int, data []byte) error {
+		if w != nil {
+			m := &sbtcp.MessageSequencedData{}
+			m.SetPayload(data)
+			if err := sbtcp.WriteMessage(w, m); err != nil {
+				return err
+			}
+		}
+		if c.OutputPcap != "" {
+			feed.Packets = append(feed.Packets, scenario.Packet{
+				Time:     time.Now(),
+				Seq:      seq,
+				Messages: [][]byte{data},
+			})
+		}
+		count++
+		if count == c.Limit {
+			return errCaptureLimit
+		}
+		return nil
+	})
+	if err != errCaptureLimit {
+		errs.CheckE(err)
+	}
+	log.Printf("soupbin_capture: %d messages, next seq %d\n", count, client.Sequence())
+	if w != nil {
+		errs.CheckE(w.Flush())
+	}
+
+	if c.OutputPcap != "" {
+		file, err := os.Create(c.OutputPcap)
+		errs.CheckE(err)
+		defer file.Close()
+		errs.CheckE(scenario.WritePcap(file, feed))
+	}
+	return
+}
+
+func init() {
+	var c cmdSoupbinCapture
+	Registry.Register(&c)
+}
@@ -0,0 +1,142 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package efh
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/ikravets/errs"
+
+	"my/ev/efhsim"
+	"my/ev/rec"
+)
+
+// device under test: processes ReplayConfig.InputFileName and compares its output with EfhDump
+type Dut interface {
+	Run() (err error)
+	Result() DutResult
+}
+
+// details of the last Run, for failure reports
+type DutResult struct {
+	DiffSummary  string   // set if dumps differ
+	BadRegisters []string // of register probe
+	ExitStatus   string   // of test_efh or external command, if failed
+}
+
+const (
+	DutHardware = "hw"   // test_efh with the dump replayed to OutputInterface
+	DutSim      = "sim"  // built-in efhsim
+	DutExec     = "exec" // external command, see ReplayConfig.DutExec
+)
+
+func NewDut(conf ReplayConfig) (d Dut, err error) {
+	defer errs.PassE(&err)
+	switch conf.Dut {
+	case "", DutHardware:
+		d = &efhReplay{ReplayConfig: conf}
+	case DutSim:
+		d = &softDut{ReplayConfig: conf}
+	case DutExec:
+		errs.Check(conf.DutExec != "", "exec device under test requires command")
+		d = &softDut{ReplayConfig: conf}
+	default:
+		errs.Check(false, "unknown device under test", conf.Dut)
+	}
+	return
+}
+
+const dutDumpFileName = "dut.dump"
+
+// runs offline on the dump, no hardware or network needed
+type softDut struct {
+	ReplayConfig
+	result DutResult
+}
+
+func (d *softDut) Result() DutResult {
+	return d.result
+}
+
+func (d *softDut) Run() (err error) {
+	defer errs.PassE(&err)
+	if d.Dut == DutExec {
+		errs.CheckE(d.runExec())
+	} else {
+		errs.CheckE(SimulateDump(d.ReplayConfig, dutDumpFileName))
+	}
+	if d.EfhDump == "" {
+		return
+	}
+	same, summary, err := diffAppDump(d.EfhDump, dutDumpFileName, d.DiffConfig)
+	d.result.DiffSummary = summary
+	errs.CheckE(err)
+	if !same {
+		log.Printf("dumps differ")
+		err = DumpsDifferError
+	}
+	return
+}
+
+// writes efhsim EFH orders output in test_efh dump (binary) format for InputFileName with EfhChannel and EfhSubscribe, as expected from test_efh
+func SimulateDump(conf ReplayConfig, outFileName string) (err error) {
+	defer errs.PassE(&err)
+	sim := efhsim.NewEfhSim(false)
+	sim.SetInput(conf.InputFileName, conf.Limit)
+	errs.CheckE(sim.RegisterChannels(conf.EfhChannel))
+	for _, s := range conf.EfhSubscribe {
+		file, err := os.Open(s)
+		errs.CheckE(err)
+		err = sim.SubscribeFromReader(file)
+		file.Close()
+		errs.CheckE(err)
+	}
+	out, err := os.Create(outFileName)
+	errs.CheckE(err)
+	defer func() {
+		if e := out.Close(); err == nil {
+			err = e
+		}
+	}()
+	w := bufio.NewWriter(out)
+	errs.CheckE(sim.AddLogger(rec.NewEfhLogger(rec.EfhLoggerConfig{
+		Printer: rec.NewBinaryPrinter(w),
+		Mode:    rec.EfhLoggerOutputOrders,
+	})))
+	log.Printf("starting efhsim on %s\n", conf.InputFileName)
+	errs.CheckE(sim.AnalyzeInput())
+	errs.CheckE(w.Flush())
+	return
+}
+
+// {input} and {output} in the command are replaced by the dump and the output file names;
+// channels and subscription files are passed in EFH_CHANNELS and EFH_SUBSCRIBE, space-separated
+func (d *softDut) runExec() (err error) {
+	defer errs.PassE(&err)
+	r := strings.NewReplacer("{input}", d.InputFileName, "{output}", dutDumpFileName)
+	args := strings.Fields(d.DutExec)
+	for i := range args {
+		args[i] = r.Replace(args[i])
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"EFH_CHANNELS="+strings.Join(d.EfhChannel.Addrs(), " "),
+		"EFH_SUBSCRIBE="+strings.Join(d.EfhSubscribe, " "),
+	)
+	out, err := os.Create("dut.out")
+	errs.CheckE(err)
+	defer out.Close()
+	cmd.Stdout = out
+	cmd.Stderr = out
+	log.Printf("starting %s\n", args)
+	if err = cmd.Run(); err != nil {
+		d.result.ExitStatus = err.Error()
+	}
+	errs.CheckE(err)
+	return
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"strconv"
@@ -20,6 +21,8 @@ import (
 	"my/ev/channels"
 	"my/ev/inspect"
 	"my/ev/packet"
+	"my/ev/packet/processor"
+	"my/ev/rec"
 )
 
 type ReplayConfig struct {
@@ -28,6 +31,16 @@ type ReplayConfig struct {
 	Pps             int
 	Limit           int
 	Loop            int
+	Socket          bool
+	Remap           map[string]string
+	Speed           float64
+	Burst           int
+	CompressIdle    time.Duration
+	Rewrite         []packet.RewriteRule
+	Keep            []string
+	// control replay session from terminal and/or unix socket
+	ControlTerminal bool
+	ControlSocket   string
 
 	EfhLoglevel  int
 	EfhIgnoreGap bool
@@ -38,8 +51,14 @@ type ReplayConfig struct {
 
 	RegConfig *inspect.Config
 
+	DiffConfig rec.EfhDiffConfig
+
 	TestEfh string
 	Local   bool
+
+	// device under test: DutHardware (default), DutSim or DutExec
+	Dut     string
+	DutExec string
 }
 
 type EfhReplay interface {
@@ -55,6 +74,8 @@ type efhReplay struct {
 	testEfhDoneCh chan struct{}
 	replay        packet.Replay
 	replayDoneCh  chan struct{}
+	controlSocket net.Listener
+	result        DutResult
 }
 
 func NewEfhReplay(conf ReplayConfig) EfhReplay {
@@ -96,7 +117,8 @@ func (e *efhReplay) Run() (err error) {
 				time.Sleep(100 * time.Millisecond)
 				return
 			case <-ticker.C:
-				if done, ok := e.replay.Progress(); ok {
+				// progress line would mix with terminal control
+				if done, ok := e.replay.Progress(); ok && !e.ControlTerminal {
 					fmt.Printf("\rdone: %.1f%%", done*100)
 				}
 			}
@@ -106,7 +128,7 @@ func (e *efhReplay) Run() (err error) {
 	errs.CheckE(e.stopTestEfh())
 	if e.testEfhDump != "" {
 		var same bool
-		same, err = e.diffAppDump()
+		same, e.result.DiffSummary, err = diffAppDump(e.EfhDump, e.testEfhDump, e.DiffConfig)
 		errs.CheckE(err)
 		if !same {
 			log.Printf("dumps differ")
@@ -117,6 +139,7 @@ func (e *efhReplay) Run() (err error) {
 		errs.CheckE(e.RegConfig.Probe())
 		errs.CheckE(ioutil.WriteFile("registers", []byte(e.RegConfig.Report()), 0666))
 		if e.RegConfig.IsBad() {
+			e.result.BadRegisters = e.RegConfig.BadNames()
 			log.Printf("register probe is bad")
 			if err == nil {
 				err = BadProbeError
@@ -126,6 +149,10 @@ func (e *efhReplay) Run() (err error) {
 	return
 }
 
+func (e *efhReplay) Result() DutResult {
+	return e.result
+}
+
 func (e *efhReplay) startTestEfh() (err error) {
 	defer errs.PassE(&err)
 	e.testEfhArgs = append(e.testEfhArgs,
@@ -187,6 +214,9 @@ func (e *efhReplay) startTestEfh() (err error) {
 				err = errors.New("timeout starting test_efh")
 				return
 			case <-e.testEfhDoneCh:
+				if e.testEfhExit != nil {
+					e.result.ExitStatus = e.testEfhExit.Error()
+				}
 				err = errors.New("test_efh exited too soon")
 				return
 			}
@@ -202,19 +232,42 @@ func (e *efhReplay) stopTestEfh() (err error) {
 	<-e.testEfhDoneCh
 	if e.testEfhExit != nil {
 		log.Printf("test_efh wait: %s\n", e.testEfhExit)
+		e.result.ExitStatus = e.testEfhExit.Error()
 	}
 	return
 }
 
 func (e *efhReplay) startDumpReplay() (err error) {
+	defer errs.PassE(&err)
 	conf := packet.ReplayConfig{
-		IfaceName: e.OutputInterface,
-		DumpName:  e.InputFileName,
-		Limit:     e.Limit,
-		Pps:       e.Pps,
-		Loop:      e.Loop,
+		IfaceName:    e.OutputInterface,
+		DumpName:     e.InputFileName,
+		Limit:        e.Limit,
+		Pps:          e.Pps,
+		Loop:         e.Loop,
+		Socket:       e.Socket,
+		Remap:        e.Remap,
+		Speed:        e.Speed,
+		Burst:        e.Burst,
+		CompressIdle: e.CompressIdle,
+		Rewrite:      e.Rewrite,
+		Keep:         e.Keep,
+	}
+	if e.ControlTerminal || e.ControlSocket != "" {
+		conf.CountMessages = processor.CountMessages
+		session := packet.NewReplaySession(&conf)
+		if e.ControlTerminal {
+			fmt.Println("replay control: type help for commands")
+			go serveReplayControl(session, os.Stdin, os.Stdout)
+		}
+		if e.ControlSocket != "" {
+			e.controlSocket, err = listenReplayControl(session, e.ControlSocket)
+			errs.CheckE(err)
+		}
+		e.replay = session
+	} else {
+		e.replay = packet.NewReplay(&conf)
 	}
-	e.replay = packet.NewReplay(&conf)
 	log.Printf("starting replay %v", e.replay)
 	e.replayDoneCh = make(chan struct{})
 	go func() {
@@ -228,20 +281,40 @@ func (e *efhReplay) stopDumpReplay() (err error) {
 	log.Printf("stopping replay\n")
 	e.replay.Stop()
 	<-e.replayDoneCh
+	if e.controlSocket != nil {
+		e.controlSocket.Close()
+	}
 	return
 }
 
-func (e *efhReplay) diffAppDump() (same bool, err error) {
-	if e.testEfhDump == "" {
+func diffAppDump(expFileName, actFileName string, conf rec.EfhDiffConfig) (same bool, summary string, err error) {
+	log.Printf("compare output dumps [ %s, %s ]\n", expFileName, actFileName)
+	defer errs.PassE(&err)
+	if same, err = CompareDumps(expFileName, actFileName); err != nil || same {
 		return
 	}
-	log.Printf("compare output dumps [ %s, %s ]\n", e.EfhDump, e.testEfhDump)
+	diffFile, err := os.Create(DiffReportFileName)
+	errs.CheckE(err)
+	defer diffFile.Close()
+	d, err := diffDumps(expFileName, actFileName, conf, diffFile)
+	errs.CheckE(err)
+	// the structured diff only explains the failure, ignored fields do not make dumps equal
+	summary = d.Summary()
+	if d.Same() {
+		summary = "dumps differ in ignored fields or format only"
+	}
+	log.Printf("dumps diff report written to %s", DiffReportFileName)
+	return
+}
+
+// byte-wise comparison
+func CompareDumps(expFileName, actFileName string) (same bool, err error) {
 	defer errs.PassE(&err)
 
-	expFile, err := os.Open(e.EfhDump)
+	expFile, err := os.Open(expFileName)
 	errs.CheckE(err)
 	defer expFile.Close()
-	actFile, err := os.Open(e.testEfhDump)
+	actFile, err := os.Open(actFileName)
 	errs.CheckE(err)
 	defer actFile.Close()
 
@@ -279,3 +352,31 @@ func (e *efhReplay) diffAppDump() (same bool, err error) {
 	log.Printf("dumps are the same")
 	return
 }
+
+const DiffReportFileName = "efh.diff"
+
+func DiffDumps(expFileName, actFileName string, conf rec.EfhDiffConfig, w io.Writer) (same bool, err error) {
+	d, err := diffDumps(expFileName, actFileName, conf, w)
+	if err != nil {
+		return
+	}
+	return d.Same(), nil
+}
+
+func diffDumps(expFileName, actFileName string, conf rec.EfhDiffConfig, w io.Writer) (d *rec.EfhDiff, err error) {
+	defer errs.PassE(&err)
+	expFile, err := os.Open(expFileName)
+	errs.CheckE(err)
+	defer expFile.Close()
+	actFile, err := os.Open(actFileName)
+	errs.CheckE(err)
+	defer actFile.Close()
+	expReader, err := rec.NewEfhDumpReader(expFile)
+	errs.CheckE(err)
+	actReader, err := rec.NewEfhDumpReader(actFile)
+	errs.CheckE(err)
+	d = rec.NewEfhDiff(conf)
+	errs.CheckE(d.Run(expReader, actReader))
+	errs.CheckE(d.Report(w))
+	return
+}
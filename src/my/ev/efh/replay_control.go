@@ -0,0 +1,137 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package efh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ikravets/errs"
+
+	"my/ev/packet"
+)
+
+const replayControlHelp = `commands:
+  status          show position
+  pause, resume
+  step [N]        pause and send next N packets
+  stepm [N]       pause and send packets with next N messages
+  seek INDEX      go to packet INDEX
+  seek TIME       go to capture time, RFC3339 or time of day (local) of the first packet day
+  speed FACTOR    follow capture timestamps FACTOR times faster, 0 for as fast as possible`
+
+// executes one control command line
+func ReplayControlCommand(s packet.ReplaySession, line string) (reply string, err error) {
+	defer errs.PassE(&err)
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	count := func() int {
+		if len(fields) < 2 {
+			return 1
+		}
+		n, err := strconv.Atoi(fields[1])
+		errs.CheckE(err)
+		return n
+	}
+	switch fields[0] {
+	case "status":
+	case "pause":
+		errs.CheckE(s.Pause())
+	case "resume":
+		errs.CheckE(s.Resume())
+	case "step":
+		errs.CheckE(s.Step(count()))
+	case "stepm":
+		errs.CheckE(s.StepMessages(count()))
+	case "seek":
+		errs.Check(len(fields) == 2, "seek needs packet index or time")
+		if index, err := strconv.Atoi(fields[1]); err == nil {
+			errs.CheckE(s.SeekPacket(index))
+		} else {
+			t, err := parseReplayTime(fields[1], s.Status().Start)
+			errs.CheckE(err)
+			errs.CheckE(s.SeekTime(t))
+		}
+	case "speed":
+		errs.Check(len(fields) == 2, "speed needs factor")
+		speed, err := strconv.ParseFloat(fields[1], 64)
+		errs.CheckE(err)
+		errs.CheckE(s.SetSpeed(speed))
+	case "help":
+		return replayControlHelp, nil
+	default:
+		errs.Check(false, "unknown command, try help", fields[0])
+	}
+	st := s.Status()
+	state := "running"
+	if st.Paused {
+		state = "paused"
+	}
+	reply = fmt.Sprintf("%s packet %d/%d speed %g last %s", state, st.Packet, st.Packets, st.Speed, st.Timestamp.Format("15:04:05.000000000"))
+	return
+}
+
+func parseReplayTime(s string, start time.Time) (t time.Time, err error) {
+	if t, err = time.Parse(time.RFC3339Nano, s); err == nil {
+		return
+	}
+	tod, err := time.ParseInLocation("15:04:05.999999999", s, time.Local)
+	if err != nil {
+		return
+	}
+	y, m, d := start.In(time.Local).Date()
+	t = time.Date(y, m, d, tod.Hour(), tod.Minute(), tod.Second(), tod.Nanosecond(), time.Local)
+	return
+}
+
+// executes commands read line by line, writing replies
+func serveReplayControl(s packet.ReplaySession, r io.Reader, w io.Writer) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		reply, err := ReplayControlCommand(s, scanner.Text())
+		if err != nil {
+			reply = fmt.Sprintf("error: %s", err)
+		}
+		if reply == "" {
+			continue
+		}
+		if _, err := fmt.Fprintln(w, reply); err != nil {
+			return
+		}
+	}
+}
+
+// serves control commands on local unix socket
+func listenReplayControl(s packet.ReplaySession, path string) (l net.Listener, err error) {
+	defer errs.PassE(&err)
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// left by a previous run
+		errs.CheckE(os.Remove(path))
+	}
+	l, err = net.Listen("unix", path)
+	errs.CheckE(err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serveReplayControl(s, conn, conn)
+			}()
+		}
+	}()
+	log.Printf("replay control socket %s\n", path)
+	return
+}
@@ -0,0 +1,221 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package efh
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ikravets/errs"
+)
+
+type SuiteTestResult struct {
+	Suite        string    `json:"suite"`
+	Test         string    `json:"test"`
+	Variant      string    `json:"variant,omitempty"` // subscription file name
+	Start        time.Time `json:"start"`
+	Duration     float64   `json:"duration"` // seconds
+	Ok           bool      `json:"ok"`
+	Failure      string    `json:"failure,omitempty"`
+	DiffSummary  string    `json:"diff_summary,omitempty"`
+	BadRegisters []string  `json:"bad_registers,omitempty"`
+	ExitStatus   string    `json:"exit_status,omitempty"`
+	RunDir       string    `json:"run_dir"`
+	Artifacts    []string  `json:"artifacts,omitempty"`
+}
+
+// unique within results
+func (r *SuiteTestResult) Key() string {
+	k := r.Suite + "/" + r.Test
+	if r.Variant != "" {
+		k += "/" + r.Variant
+	}
+	return k
+}
+
+func (r *SuiteTestResult) details() string {
+	var lines []string
+	if r.DiffSummary != "" {
+		lines = append(lines, r.DiffSummary)
+	}
+	if len(r.BadRegisters) != 0 {
+		lines = append(lines, "bad registers: "+strings.Join(r.BadRegisters, " "))
+	}
+	if r.ExitStatus != "" {
+		lines = append(lines, "exit status: "+r.ExitStatus)
+	}
+	return strings.Join(lines, "\n")
+}
+
+type SuiteResults struct {
+	Dut      string            `json:"dut"`
+	Start    time.Time         `json:"start"`
+	Duration float64           `json:"duration"` // seconds
+	Tests    []SuiteTestResult `json:"tests"`
+}
+
+func (r *SuiteResults) OkNum() (n int) {
+	for _, t := range r.Tests {
+		if t.Ok {
+			n++
+		}
+	}
+	return
+}
+
+func (r *SuiteResults) WriteJSON(w io.Writer) error {
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(buf, '\n'))
+	return err
+}
+
+func ReadSuiteResults(r io.Reader) (res *SuiteResults, err error) {
+	res = &SuiteResults{}
+	if err = json.NewDecoder(r).Decode(res); err != nil {
+		return nil, err
+	}
+	return
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// one testsuite element per suite, test variants are separate test cases
+func (r *SuiteResults) WriteJUnit(w io.Writer) (err error) {
+	defer errs.PassE(&err)
+	var doc junitTestSuites
+	index := make(map[string]int)
+	for _, t := range r.Tests {
+		i, ok := index[t.Suite]
+		if !ok {
+			i = len(doc.Suites)
+			index[t.Suite] = i
+			doc.Suites = append(doc.Suites, junitTestSuite{
+				Name:      t.Suite,
+				Timestamp: t.Start.Format("2006-01-02T15:04:05"),
+			})
+		}
+		s := &doc.Suites[i]
+		c := junitTestCase{
+			ClassName: "efh_suite." + t.Suite,
+			Name:      t.Test,
+			Time:      t.Duration,
+			SystemOut: strings.Join(append([]string{t.RunDir}, t.Artifacts...), "\n"),
+		}
+		if t.Variant != "" {
+			c.Name += "/" + t.Variant
+		}
+		if !t.Ok {
+			c.Failure = &junitFailure{Message: t.Failure, Text: t.details()}
+			s.Failures++
+		}
+		s.Tests++
+		s.Time += t.Duration
+		s.Cases = append(s.Cases, c)
+	}
+	_, err = io.WriteString(w, xml.Header)
+	errs.CheckE(err)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	errs.CheckE(enc.Encode(doc))
+	_, err = io.WriteString(w, "\n")
+	errs.CheckE(err)
+	return
+}
+
+type SuiteResultsComparison struct {
+	NewFailures  []SuiteTestResult // ok in old results, failed in new
+	Fixes        []SuiteTestResult // failed in old results, ok in new
+	StillFailing []SuiteTestResult
+	Added        []SuiteTestResult // not run in old results
+	Removed      []SuiteTestResult // not run in new results
+}
+
+// results of the same test are matched by Key
+func CompareSuiteResults(old, new *SuiteResults) (c *SuiteResultsComparison) {
+	c = &SuiteResultsComparison{}
+	oldByKey := make(map[string]*SuiteTestResult)
+	for i := range old.Tests {
+		oldByKey[old.Tests[i].Key()] = &old.Tests[i]
+	}
+	seen := make(map[string]bool)
+	for _, t := range new.Tests {
+		seen[t.Key()] = true
+		o, ok := oldByKey[t.Key()]
+		switch {
+		case !ok:
+			c.Added = append(c.Added, t)
+		case o.Ok && !t.Ok:
+			c.NewFailures = append(c.NewFailures, t)
+		case !o.Ok && t.Ok:
+			c.Fixes = append(c.Fixes, t)
+		case !o.Ok && !t.Ok:
+			c.StillFailing = append(c.StillFailing, t)
+		}
+	}
+	for _, t := range old.Tests {
+		if !seen[t.Key()] {
+			c.Removed = append(c.Removed, t)
+		}
+	}
+	return
+}
+
+func (c *SuiteResultsComparison) Report(w io.Writer) (err error) {
+	defer errs.PassE(&err)
+	printf := func(format string, v ...interface{}) {
+		_, err := fmt.Fprintf(w, format, v...)
+		errs.CheckE(err)
+	}
+	section := func(title string, tests []SuiteTestResult, withDetails bool) {
+		printf("%s: %d\n", title, len(tests))
+		for _, t := range tests {
+			status := "ok"
+			if !t.Ok {
+				status = "FAIL " + t.Failure
+			}
+			printf("  %s %s\n", t.Key(), status)
+			if d := t.details(); withDetails && d != "" {
+				printf("    %s\n", strings.Replace(d, "\n", "\n    ", -1))
+			}
+			if withDetails && !t.Ok {
+				printf("    %s\n", t.RunDir)
+			}
+		}
+	}
+	section("new failures", c.NewFailures, true)
+	section("fixes", c.Fixes, false)
+	section("still failing", c.StillFailing, false)
+	section("added", c.Added, true)
+	section("removed", c.Removed, false)
+	return
+}
@@ -68,9 +68,16 @@ func (s *EfhSim) AnalyzeInput() (err error) {
 	handle, err := pcap.OpenOffline(s.inputFileName)
 	errs.CheckE(err)
 	defer handle.Close()
+	errs.CheckE(s.AnalyzeObtainer(handle))
+	return
+}
+
+// processes packets until obtainer returns io.EOF, e.g. live packet.UdpObtainer until it is closed
+func (s *EfhSim) AnalyzeObtainer(o packet.Obtainer) (err error) {
+	defer errs.PassE(&err)
 	pp := processor.NewProcessor()
 	pp.LimitPacketNumber(s.inputPacketLimit)
-	pp.SetObtainer(handle)
+	pp.SetObtainer(o)
 	pp.SetHandler(s)
 	errs.CheckE(pp.ProcessAll())
 	return
@@ -4,9 +4,13 @@
 package exch
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -14,18 +18,20 @@ import (
 
 	"my/ev/bchan"
 	"my/ev/exch/bats"
+	"my/ev/packet"
 )
 
 type MessageSource interface {
 	SetSequence(int)
 	CurrentSequence() int
-	GetMessage(int) bats.Message
-	Run()
+	GetMessage(int) (bats.Message, error)
+	Run(context.Context) error
 	RunInteractive()
 	Stop()
 }
 
 type exchangeBatsRegistry struct {
+	simulatorControl
 	exchangeBatsN      []*exchangeBats
 	batsMessageSourceN []*batsMessageSource
 }
@@ -54,33 +60,39 @@ func (e *exchangeBatsRegistry) NewBatsRegistry(c Config, src *batsMessageSource,
 }
 func InitBatsRegistry(c Config) (es ExchangeSimulator) {
 	esr := &exchangeBatsRegistry{}
+	esr.protocol = c.Protocol
 	for i := 0; i < c.PartNumLimit; i++ {
 		src := NewBatsMessageSource(i, c.Speed)
 		esr.exchangeBatsN = append(esr.exchangeBatsN, esr.NewBatsRegistry(c, src, i))
 		esr.exchangeBatsN[i].num = i
+		esr.channels = append(esr.channels, src.ctl)
 	}
 	es = esr
 	return
 }
-func (e *exchangeBatsRegistry) Run() {
+func (e *exchangeBatsRegistry) Run(ctx context.Context) (err error) {
+	g := newServerGroup(ctx)
 	for _, r := range e.exchangeBatsN {
 		if r.interactive {
 			go r.src.RunInteractive()
 		} else {
-			go r.src.Run()
+			g.run(r.src.Run)
 		}
-		go r.spin.run()
-		errs.CheckE(r.feed_mc.start(r.num))
-		go r.gap.run()
-		errs.CheckE(r.gap_mc.start(r.num))
+		g.run(r.spin.run)
+		g.run(r.feed_mc.run)
+		g.run(r.gap.run)
+		g.run(r.gap_mc.run)
 		log.Println(r.num, "started local", r.feed_mc.laddr.String(), "to feed mcast", r.feed_mc.mcaddr.String())
 		log.Println(r.num, "started local", r.gap_mc.laddr.String(), "to gap mcast", r.gap_mc.mcaddr.String())
 	}
-	select {}
+	err = g.wait()
+	log.Printf("stopped bats simulator: %v\n", err)
+	return
 }
 
 func NewBatsExchangeSimulatorServer(c Config) (es ExchangeSimulator, err error) {
 	errs.Check(c.Protocol == "bats")
+	errs.Check(c.ScenarioFileName == "", "scenario is supported for nasdaq only, replay pcap compiled by scenario command instead")
 	es = InitBatsRegistry(c)
 	return
 }
@@ -104,11 +116,11 @@ type batsGapMcastServer struct {
 	mcaddr *net.UDPAddr
 	src    *batsMessageSource
 
-	cancel chan struct{}
 	gap    chan gapMessage
 	pw     bats.PacketWriter
 	conn   net.Conn
 	num    int
+	config *Config
 }
 
 func newBatsGapMcastServer(c Config, src *batsMessageSource, i int) (gmc *batsGapMcastServer, err error) {
@@ -123,35 +135,41 @@ func newBatsGapMcastServer(c Config, src *batsMessageSource, i int) (gmc *batsGa
 		laddr:  laddr,
 		mcaddr: mcaddr,
 		src:    src,
-		cancel: make(chan struct{}),
 		gap:    make(chan gapMessage),
 		num:    i,
+		config: &c,
 	}
 	return
 }
-func (g *batsGapMcastServer) start(num int) (err error) {
+func (g *batsGapMcastServer) run(ctx context.Context) (err error) {
+	defer errs.PassE(&err)
 	g.conn, err = net.DialUDP("udp", g.laddr, g.mcaddr)
 	errs.CheckE(err)
+	g.conn, err = newFaultConn(g.conn, g.config, g.num)
+	errs.CheckE(err)
+	defer g.conn.Close()
 	bconn := bats.NewConn(g.conn)
 	g.pw = bconn.GetPacketWriterUnsync()
-	go g.run()
-	return
-}
-func (g *batsGapMcastServer) run() {
-	defer g.conn.Close()
 	ch := g.gap
 
 	log.Printf("%d ready gap source chan %v", g.num, ch)
 	for {
 		select {
-		case _, _ = <-g.cancel:
+		case <-ctx.Done():
 			log.Printf("%d cancelled", g.num)
 			return
 		case gap := <-ch:
 			log.Printf("gap send %d .. %d", gap.start, gap.end)
 			for i := gap.start; i < gap.end; i++ {
-				m := g.src.GetMessage(i)
+				m, err := g.src.GetMessage(i)
+				if err != nil {
+					// dropped from the window after the gap request was accepted
+					log.Printf("gap send %d .. %d aborted: %s", gap.start, gap.end, err)
+					break
+				}
 				g.pw.SyncStart()
+				// units are numbered from 1, unit 0 marks unsequenced packets
+				errs.CheckE(g.pw.SetUnit(g.num + 1))
 				errs.CheckE(g.pw.SetSequence(i))
 				errs.CheckE(g.pw.WriteMessage(m))
 				errs.CheckE(g.pw.Flush())
@@ -169,17 +187,22 @@ type gapProxy struct {
 	gmc   *batsGapMcastServer
 }
 
-func (g *gapProxy) run() {
+func (g *gapProxy) run(ctx context.Context) (err error) {
+	defer errs.PassE(&err)
 	l, err := net.Listen("tcp", g.laddr)
 	errs.CheckE(err)
 	defer l.Close()
+	defer closeOnDone(ctx, l)()
 	log.Println(g.src.num, "started gap proxy", g.laddr)
 	for {
 		conn, err := l.Accept()
+		if err != nil && ctx.Err() != nil {
+			return nil
+		}
 		errs.CheckE(err)
 		log.Printf("accepted %s -> %s \n", conn.RemoteAddr(), conn.LocalAddr())
 		c := NewGapProxyConn(conn, g.gmc)
-		go c.run()
+		go c.run(ctx)
 	}
 }
 
@@ -209,11 +232,14 @@ func (gc *gapProxyConn) login() (err error) {
 	log.Printf("login done")
 	return
 }
-func (gc *gapProxyConn) run() {
+func (gc *gapProxyConn) run(ctx context.Context) {
 	defer errs.Catch(func(ce errs.CheckerError) {
 		log.Printf("caught %s\n", ce)
 	})
 	defer gc.conn.Close()
+	defer closeOnDone(ctx, gc.conn)()
+	gc.gmc.src.ctl.addClient(1)
+	defer gc.gmc.src.ctl.addClient(-1)
 	errs.CheckE(gc.login())
 
 	m, err := gc.bconn.ReadMessage()
@@ -226,18 +252,34 @@ func (gc *gapProxyConn) run() {
 		Count:    req.Count,
 		Status:   bats.GapStatusAccepted,
 	}
+	// each gap proxy serves the unit of its feed only
+	if int(req.Unit) != gc.gmc.num+1 {
+		res.Status = bats.GapStatusInvalidUnit
+		errs.CheckE(gc.bconn.WriteMessageSimple(&res))
+		log.Printf("gap unit %d is invalid", req.Unit)
+		return
+	}
+	if !gc.gmc.src.available(int(req.Sequence), int(req.Sequence)+int(req.Count)) {
+		res.Status = bats.GapStatusRange
+		errs.CheckE(gc.bconn.WriteMessageSimple(&res))
+		log.Printf("gap %d .. %d is out of range", req.Sequence, int(req.Sequence)+int(req.Count))
+		return
+	}
 	errs.CheckE(gc.bconn.WriteMessageSimple(&res))
-	gc.noticeGapMultiCast(int(req.Sequence), int(req.Sequence+uint32(req.Count)))
+	gc.noticeGapMultiCast(ctx, int(req.Sequence), int(req.Sequence+uint32(req.Count)))
 	//	gc.noticeGapMultiCast(5, 12)
 
 	log.Println("gap finished")
 }
-func (gc *gapProxyConn) noticeGapMultiCast(start, end int) {
+func (gc *gapProxyConn) noticeGapMultiCast(ctx context.Context, start, end int) {
 	gap := gapMessage{
 		start: start,
 		end:   end,
 	}
-	gc.gmc.gap <- gap
+	select {
+	case gc.gmc.gap <- gap:
+	case <-ctx.Done():
+	}
 }
 
 type spinServer struct {
@@ -245,17 +287,22 @@ type spinServer struct {
 	src   *batsMessageSource
 }
 
-func (s *spinServer) run() {
+func (s *spinServer) run(ctx context.Context) (err error) {
+	defer errs.PassE(&err)
 	l, err := net.Listen("tcp", s.laddr)
 	errs.CheckE(err)
 	defer l.Close()
+	defer closeOnDone(ctx, l)()
 	log.Println(s.src.num, "started tcp", s.laddr)
 	for {
 		conn, err := l.Accept()
+		if err != nil && ctx.Err() != nil {
+			return nil
+		}
 		errs.CheckE(err)
 		log.Printf("accepted %s -> %s \n", conn.RemoteAddr(), conn.LocalAddr())
 		c := NewSpinServerConn(conn, s.src)
-		go c.run()
+		go c.run(ctx)
 	}
 }
 
@@ -263,7 +310,6 @@ type spinServerConn struct {
 	conn            net.Conn
 	bconn           bats.Conn
 	src             *batsMessageSource
-	imageLag        int
 	mcastDuringSpin int
 }
 
@@ -272,16 +318,18 @@ func NewSpinServerConn(conn net.Conn, src *batsMessageSource) *spinServerConn {
 		conn:            conn,
 		bconn:           bats.NewConn(conn),
 		src:             src,
-		imageLag:        10,
 		mcastDuringSpin: 10,
 	}
 }
 
-func (s *spinServerConn) run() {
+func (s *spinServerConn) run(ctx context.Context) {
 	defer errs.Catch(func(ce errs.CheckerError) {
 		log.Printf("caught %s\n", ce)
 	})
 	defer s.conn.Close()
+	defer closeOnDone(ctx, s.conn)()
+	s.src.ctl.addClient(1)
+	defer s.src.ctl.addClient(-1)
 	errs.CheckE(s.login())
 	cancelSendImageAvail := make(chan struct{})
 	defer func() {
@@ -303,16 +351,24 @@ func (s *spinServerConn) run() {
 	errs.Check(ok)
 	close(cancelSendImageAvail)
 
-	seq := s.src.CurrentSequence()
-	errs.Check(int(req.Sequence) <= seq, req.Sequence, seq)
+	img := s.src.findSpinImage(int(req.Sequence))
+	if img == nil {
+		log.Printf("spin image %d is not available", req.Sequence)
+		res := bats.MessageSpinResponse{
+			Sequence: req.Sequence,
+			Status:   bats.SpinStatusRange,
+		}
+		errs.CheckE(s.bconn.WriteMessageSimple(&res))
+		return
+	}
 	res := bats.MessageSpinResponse{
 		Sequence: req.Sequence,
-		Count:    uint32(seq) - req.Sequence + 1,
+		Count:    uint32(len(img.orders)),
 		Status:   bats.SpinStatusAccepted,
 	}
 	errs.CheckE(s.bconn.WriteMessageSimple(&res))
-	errs.CheckE(s.sendAll(int(req.Sequence), seq+1))
-	s.waitForMcast(seq)
+	errs.CheckE(s.sendImage(img))
+	s.waitForMcast(img.seq)
 	res2 := bats.MessageSpinFinished{
 		Sequence: req.Sequence,
 	}
@@ -341,25 +397,37 @@ func (s *spinServerConn) sendImageAvail(cancel <-chan struct{}) {
 			log.Printf("image avail cancelled")
 			return
 		case <-ticker.C:
-			seq := s.src.CurrentSequence() - s.imageLag
-			if seq > 0 {
-				log.Printf("image avail %d", seq)
+			if img := s.src.spinImage(); img != nil {
+				log.Printf("image avail %d", img.seq)
 				sia := bats.MessageSpinImageAvail{
-					Sequence: uint32(seq),
+					Sequence: uint32(img.seq),
 				}
 				errs.CheckE(s.bconn.WriteMessageSimple(&sia))
 			}
 		}
 	}
 }
-func (s *spinServerConn) sendAll(start, end int) (err error) {
+
+const spinMessagesPerPacket = 40
+
+func (s *spinServerConn) sendImage(img *batsSpinImage) (err error) {
 	defer errs.PassE(&err)
-	log.Printf("spin send %d .. %d", start, end)
-	for i := start; i < end; i++ {
-		m := s.src.GetMessage(i)
-		errs.CheckE(s.bconn.WriteMessageSimple(m))
+	log.Printf("spin send image %d: %d orders", img.seq, len(img.orders))
+	pw := s.bconn.GetPacketWriter()
+	for i := 0; i < len(img.orders); i += spinMessagesPerPacket {
+		end := i + spinMessagesPerPacket
+		if end > len(img.orders) {
+			end = len(img.orders)
+		}
+		pw.SyncStart()
+		for _, o := range img.orders[i:end] {
+			// image is shared by spin clients, write a copy
+			m := o
+			errs.CheckE(pw.WriteMessage(&m))
+		}
+		errs.CheckE(pw.Flush())
 	}
-	log.Printf("spin send %d .. %d done", start, end)
+	log.Printf("spin send image %d done", img.seq)
 	return
 }
 func (s *spinServerConn) waitForMcast(startSeq int) {
@@ -368,7 +436,7 @@ func (s *spinServerConn) waitForMcast(startSeq int) {
 	bmsc := s.src.NewClient()
 	defer bmsc.Close()
 	ch := bmsc.Chan()
-	for seq := s.src.CurrentSequence(); seq < waitSeq; seq = <-ch {
+	for seq, ok := s.src.CurrentSequence(), true; ok && seq < waitSeq; seq, ok = <-ch {
 	}
 }
 
@@ -377,11 +445,11 @@ type batsFeedMcastServer struct {
 	mcaddr *net.UDPAddr
 	src    *batsMessageSource
 
-	cancel    chan struct{}
 	bmsc      *batsMessageSourceClient
 	pw        bats.PacketWriter
 	conn      net.Conn
 	num       int
+	config    *Config
 	gap       bool
 	gapSize   int
 	gapPeriod int
@@ -404,8 +472,8 @@ func newBatsFeedMcastServer(c Config, src *batsMessageSource, i int) (fmc *batsF
 		laddr:     laddr,
 		mcaddr:    mcaddr,
 		src:       src,
-		cancel:    make(chan struct{}),
 		num:       i,
+		config:    &c,
 		gap:       0 != c.GapSize,
 		gapSize:   int(c.GapSize),
 		gapPeriod: gapP,
@@ -413,36 +481,44 @@ func newBatsFeedMcastServer(c Config, src *batsMessageSource, i int) (fmc *batsF
 	}
 	return
 }
-func (s *batsFeedMcastServer) start(num int) (err error) {
+func (s *batsFeedMcastServer) run(ctx context.Context) (err error) {
+	defer errs.PassE(&err)
 	s.conn, err = net.DialUDP("udp", s.laddr, s.mcaddr)
 	errs.CheckE(err)
+	s.conn, err = newFaultConn(s.conn, s.config, s.num)
+	errs.CheckE(err)
+	defer s.conn.Close()
 	bconn := bats.NewConn(s.conn)
 	s.pw = bconn.GetPacketWriterUnsync()
 	s.bmsc = s.src.NewClient()
-	go s.run()
-	return
-}
-func (s *batsFeedMcastServer) run() {
-	defer s.conn.Close()
 	defer s.bmsc.Close()
 	ch := s.bmsc.Chan()
 
 	log.Printf("%d ready. source chan %v", s.num, ch)
 	for {
 		select {
-		case _, _ = <-s.cancel:
+		case <-ctx.Done():
 			log.Printf("%d cancelled", s.num)
 			return
-		case seq := <-ch:
+		case seq, ok := <-ch:
+			if !ok {
+				log.Printf("%d source closed", s.num)
+				return
+			}
 			if s.gapCheck(seq) {
 				log.Printf("%d gap !!! mcast seq %d", s.num, seq)
+				s.src.ctl.published(seq, 0)
 			} else {
 				log.Printf("%d mcast seq %d", s.num, seq)
-				m := s.src.GetMessage(seq)
+				m, err := s.src.GetMessage(seq)
+				errs.CheckE(err)
 				s.pw.SyncStart()
+				// units are numbered from 1, unit 0 marks unsequenced packets
+				errs.CheckE(s.pw.SetUnit(s.num + 1))
 				errs.CheckE(s.pw.SetSequence(seq))
 				errs.CheckE(s.pw.WriteMessage(m))
 				errs.CheckE(s.pw.Flush())
+				s.src.ctl.published(seq, 1)
 			}
 		}
 	}
@@ -460,35 +536,72 @@ func (s *batsFeedMcastServer) gapCheck(seq int) (gap bool) {
 	return false
 }
 
+const (
+	batsSymbols         = 16
+	batsBookTargetSize  = 10000
+	batsSpinImages      = 4
+	batsSpinImagePeriod = time.Second
+	// messages kept for gap requests, covers the largest gap request count
+	batsMessageWindow = 1 << 16
+)
+
+type batsLiveOrder struct {
+	orderId uint64
+	size    uint32
+}
+
+type batsSpinImage struct {
+	seq    int
+	taken  time.Time
+	orders []bats.MessageAddOrder
+}
+
 type batsMessageSource struct {
 	curSeq int64
 	cancel chan struct{}
 	bchan  bchan.Bchan
-	mps    int
+	ctl    *channelControl
 	num    int
+
+	mu          sync.Mutex
+	firstSeq    int // first message in the window
+	nextSeq     int
+	messages    []bats.Message // ring buffer indexed by seq % batsMessageWindow
+	book        *pitchBook
+	rnd         *rand.Rand
+	live        []batsLiveOrder
+	liveIndex   map[uint64]int
+	nextOrderId uint64
+	nextExecId  uint64
+	images      []*batsSpinImage
 }
 
 func NewBatsMessageSource(i int, speed int) *batsMessageSource {
 	return &batsMessageSource{
-		cancel: make(chan struct{}),
-		bchan:  bchan.NewBchan(),
-		mps:    speed,
-		curSeq: 1000000,
-		num:    i,
+		cancel:    make(chan struct{}),
+		bchan:     bchan.NewBchan(),
+		ctl:       newChannelControl("", speed),
+		curSeq:    1000000,
+		num:       i,
+		firstSeq:  1000001,
+		nextSeq:   1000001,
+		messages:  make([]bats.Message, batsMessageWindow),
+		book:      newPitchBook(),
+		rnd:       rand.New(rand.NewSource(int64(i))),
+		liveIndex: make(map[uint64]int),
 	}
 }
-func (bms *batsMessageSource) Run() {
-	ticker := time.NewTicker(time.Duration(1000000000/bms.mps) * time.Nanosecond)
-	defer ticker.Stop()
+func (bms *batsMessageSource) Run(ctx context.Context) error {
 	defer bms.bchan.Close()
-	for {
+	for bms.ctl.sleep(ctx, bms.ctl.period()) && bms.ctl.waitResumed(ctx) {
 		select {
 		case _, _ = <-bms.cancel:
-			return
-		case <-ticker.C:
+			return nil
+		default:
 			bms.produceOne()
 		}
 	}
+	return nil
 }
 func (bms *batsMessageSource) RunInteractive() {
 	for {
@@ -508,10 +621,18 @@ func (bms *batsMessageSource) publish(seq int) {
 }
 func (bms *batsMessageSource) produceOne() {
 	seq := int(atomic.AddInt64(&bms.curSeq, int64(1)))
+	bms.generateUpTo(seq)
 	bms.publish(seq)
 }
 func (bms *batsMessageSource) produce(seq int) {
-	bms.SetSequence(seq)
+	bms.generateUpTo(seq)
+	if !bms.available(seq, seq+1) {
+		log.Printf("%d source seq %d is not available", bms.num, seq)
+		return
+	}
+	if seq > bms.CurrentSequence() {
+		bms.SetSequence(seq)
+	}
 	bms.publish(seq)
 }
 func (bms *batsMessageSource) Stop() {
@@ -531,15 +652,147 @@ func (bms *batsMessageSource) NewClient() *batsMessageSourceClient {
 	go c.run()
 	return c
 }
-func (bms *batsMessageSource) GetMessage(seqNum int) bats.Message {
-	m := bats.MessageAddOrder{
-		TimeOffset: uint32(seqNum),
-		OrderId:    uint64(seqNum),
-		Price:      uint64(seqNum),
-		Side:       'B',
-		Quantity:   10,
+func (bms *batsMessageSource) GetMessage(seqNum int) (bats.Message, error) {
+	bms.mu.Lock()
+	defer bms.mu.Unlock()
+	if seqNum < bms.firstSeq || seqNum >= bms.nextSeq {
+		return nil, fmt.Errorf("unit %d: message %d is not available (%d .. %d)", bms.num+1, seqNum, bms.firstSeq, bms.nextSeq-1)
+	}
+	return bms.messages[seqNum%batsMessageWindow], nil
+}
+func (bms *batsMessageSource) available(start, end int) bool {
+	bms.mu.Lock()
+	defer bms.mu.Unlock()
+	return start >= bms.firstSeq && end <= bms.nextSeq
+}
+
+// messages are generated in order and applied to the book, so the book always matches the feed
+func (bms *batsMessageSource) generateUpTo(seq int) {
+	bms.mu.Lock()
+	defer bms.mu.Unlock()
+	for ; bms.nextSeq <= seq; bms.nextSeq++ {
+		m := bms.generate(bms.nextSeq)
+		data, err := bats.EncodeMessage(m)
+		errs.CheckE(err)
+		bms.book.apply(bms.nextSeq, data)
+		bms.messages[bms.nextSeq%batsMessageWindow] = m
+	}
+	if bms.nextSeq-bms.firstSeq > batsMessageWindow {
+		bms.firstSeq = bms.nextSeq - batsMessageWindow
+	}
+}
+func (bms *batsMessageSource) generate(seq int) bats.Message {
+	timeOffset := uint32(seq % 1000000000)
+	r := bms.rnd.Intn(100)
+	addPercent := 40
+	if len(bms.live) < batsBookTargetSize {
+		addPercent = 60
+	}
+	if len(bms.live) == 0 || r < addPercent {
+		bms.nextOrderId++
+		m := &bats.MessageAddOrder{
+			TimeOffset: timeOffset,
+			OrderId:    bms.nextOrderId,
+			Side:       "BS"[bms.rnd.Intn(2)],
+			Quantity:   uint32(bms.rnd.Intn(100) + 1),
+			Symbol:     batsSymbol(bms.num, bms.rnd.Intn(batsSymbols)),
+			Price:      uint64(bms.rnd.Intn(200)+1) * 500,
+		}
+		bms.liveIndex[m.OrderId] = len(bms.live)
+		bms.live = append(bms.live, batsLiveOrder{orderId: m.OrderId, size: m.Quantity})
+		return m
+	}
+	i := bms.rnd.Intn(len(bms.live))
+	lo := &bms.live[i]
+	switch {
+	case r < addPercent+20 && lo.size > 1:
+		q := uint32(bms.rnd.Intn(int(lo.size-1)) + 1)
+		lo.size -= q
+		return &bats.MessageReduceSize{
+			TimeOffset:       timeOffset,
+			OrderId:          lo.orderId,
+			CanceledQuantity: q,
+		}
+	case r < addPercent+40:
+		q := uint32(bms.rnd.Intn(int(lo.size)) + 1)
+		bms.nextExecId++
+		m := &bats.MessageOrderExecuted{
+			TimeOffset:       timeOffset,
+			OrderId:          lo.orderId,
+			ExecutedQuantity: q,
+			ExecutionId:      bms.nextExecId,
+		}
+		if lo.size -= q; lo.size == 0 {
+			bms.removeLive(i)
+		}
+		return m
+	default:
+		m := &bats.MessageDeleteOrder{
+			TimeOffset: timeOffset,
+			OrderId:    lo.orderId,
+		}
+		bms.removeLive(i)
+		return m
+	}
+}
+func (bms *batsMessageSource) removeLive(i int) {
+	delete(bms.liveIndex, bms.live[i].orderId)
+	last := len(bms.live) - 1
+	if i != last {
+		bms.live[i] = bms.live[last]
+		bms.liveIndex[bms.live[i].orderId] = i
+	}
+	bms.live = bms.live[:last]
+}
+
+func batsSymbol(unit, i int) (symbol [6]byte) {
+	copy(symbol[:], fmt.Sprintf("%02d%04d", unit%100, i))
+	return
+}
+
+// returns recent image of live orders, taking a new one if the last is too old
+func (bms *batsMessageSource) spinImage() *batsSpinImage {
+	bms.mu.Lock()
+	defer bms.mu.Unlock()
+	if n := len(bms.images); n > 0 && time.Since(bms.images[n-1].taken) < batsSpinImagePeriod {
+		return bms.images[n-1]
+	}
+	if bms.nextSeq == bms.firstSeq {
+		return nil
+	}
+	img := &batsSpinImage{
+		seq:   bms.nextSeq - 1,
+		taken: time.Now(),
+	}
+	for _, o := range bms.book.orders() {
+		side, err := o.Side.ToByte()
+		errs.CheckE(err)
+		var sym [8]byte
+		binary.LittleEndian.PutUint64(sym[:], o.OptionId.ToUint64())
+		m := bats.MessageAddOrder{
+			OrderId:  o.OrderId.ToUint64(),
+			Side:     side,
+			Quantity: uint32(o.Size),
+			Price:    uint64(packet.PriceTo4Dec(o.Price)),
+		}
+		copy(m.Symbol[:], sym[:])
+		img.orders = append(img.orders, m)
+	}
+	bms.images = append(bms.images, img)
+	if len(bms.images) > batsSpinImages {
+		bms.images = bms.images[1:]
+	}
+	return img
+}
+func (bms *batsMessageSource) findSpinImage(seq int) *batsSpinImage {
+	bms.mu.Lock()
+	defer bms.mu.Unlock()
+	for _, img := range bms.images {
+		if img.seq == seq {
+			return img
+		}
 	}
-	return &m
+	return nil
 }
 
 type batsMessageSourceClient struct {
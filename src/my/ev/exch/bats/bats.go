@@ -32,6 +32,9 @@ const (
 	TypeSpinResponse   MessageType = 0x82
 	TypeSpinFinished   MessageType = 0x83
 	TypeAddOrder       MessageType = 0x21
+	TypeOrderExecuted  MessageType = 0x23
+	TypeReduceSize     MessageType = 0x25
+	TypeDeleteOrder    MessageType = 0x29
 )
 
 var MessageLength = [256]int{
@@ -44,6 +47,9 @@ var MessageLength = [256]int{
 	TypeSpinResponse:   11,
 	TypeSpinFinished:   6,
 	TypeAddOrder:       34,
+	TypeOrderExecuted:  26,
+	TypeReduceSize:     18,
+	TypeDeleteOrder:    14,
 }
 
 var MessageFactory = [256]func() Message{
@@ -56,6 +62,9 @@ var MessageFactory = [256]func() Message{
 	TypeSpinResponse:   func() Message { return &MessageSpinResponse{} },
 	TypeSpinFinished:   func() Message { return &MessageSpinFinished{} },
 	TypeAddOrder:       func() Message { return &MessageAddOrder{} },
+	TypeOrderExecuted:  func() Message { return &MessageOrderExecuted{} },
+	TypeReduceSize:     func() Message { return &MessageReduceSize{} },
+	TypeDeleteOrder:    func() Message { return &MessageDeleteOrder{} },
 }
 
 func (_ *MessageLogin) Type() MessageType          { return TypeLogin }
@@ -67,6 +76,9 @@ func (_ *MessageSpinRequest) Type() MessageType    { return TypeSpinRequest }
 func (_ *MessageSpinResponse) Type() MessageType   { return TypeSpinResponse }
 func (_ *MessageSpinFinished) Type() MessageType   { return TypeSpinFinished }
 func (_ *MessageAddOrder) Type() MessageType       { return TypeAddOrder }
+func (_ *MessageOrderExecuted) Type() MessageType  { return TypeOrderExecuted }
+func (_ *MessageReduceSize) Type() MessageType     { return TypeReduceSize }
+func (_ *MessageDeleteOrder) Type() MessageType    { return TypeDeleteOrder }
 
 type MessageHeader struct {
 	Length uint8
@@ -173,6 +185,36 @@ type MessageAddOrder struct {
 	Flags      byte
 }
 
+type MessageOrderExecuted struct {
+	MessageCommon
+	TimeOffset       uint32
+	OrderId          uint64
+	ExecutedQuantity uint32
+	ExecutionId      uint64
+}
+
+type MessageReduceSize struct {
+	MessageCommon
+	TimeOffset       uint32
+	OrderId          uint64
+	CanceledQuantity uint32
+}
+
+type MessageDeleteOrder struct {
+	MessageCommon
+	TimeOffset uint32
+	OrderId    uint64
+}
+
+func EncodeMessage(m Message) (data []byte, err error) {
+	defer errs.PassE(&err)
+	errs.CheckE(m.getCommon().setHeader(m.Type()))
+	var b bytes.Buffer
+	errs.CheckE(binary.Write(&b, binary.LittleEndian, m))
+	data = b.Bytes()
+	return
+}
+
 type BsuHeader struct {
 	Length   uint16
 	Count    uint8
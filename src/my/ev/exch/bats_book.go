@@ -0,0 +1,32 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"github.com/google/gopacket"
+	"github.com/ikravets/errs"
+
+	"my/ev/packet/bats"
+	"my/ev/sim"
+)
+
+// order book of a BATS unit built by simulator over generated PITCH messages
+type pitchBook struct {
+	simu sim.Sim
+}
+
+func newPitchBook() *pitchBook {
+	return &pitchBook{simu: sim.NewSim(false)}
+}
+
+func (b *pitchBook) apply(seq int, data []byte) {
+	errs.Check(len(data) >= 2)
+	layer := bats.PitchMessageTypeMetadata[data[1]].CreateLayer()
+	errs.CheckE(layer.DecodeFromBytes(data, gopacket.NilDecodeFeedback))
+	applySimMessage(b.simu, &simAppMessage{layer: layer, seq: uint64(seq)})
+}
+
+func (b *pitchBook) orders() []sim.Order {
+	return b.simu.OrderDb().Orders()
+}
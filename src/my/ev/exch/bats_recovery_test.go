@@ -0,0 +1,60 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"my/ev/packet/bats"
+)
+
+func TestBatsRecoveryGap(t *testing.T) {
+	// source starts from 1000001, so gaps are at 1000050 and 1000100
+	const firstSeq, messages = 1000001, 120
+	feedAddr := freeLoopbackAddr(t, "udp")
+	gapAddr := freeLoopbackAddr(t, "udp")
+	// gap mcast is sent from local port + 1000
+	localAddr := freeLoopbackAddr(t, "udp")
+	rc := bats.NewRecoveryClient(bats.RecoveryConfig{
+		FeedAddr: feedAddr,
+		GapAddr:  gapAddr,
+		// simulator gap proxy of the first unit listens on a fixed port
+		GrpAddr: "127.0.0.1:17002",
+		Unit:    1,
+		Timeout: 500 * time.Millisecond,
+	})
+	h := &recoveryHandler{}
+	rc.SetHandler(h)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- rc.Run(ctx) }()
+	// the feed and gap sockets are connected, so their destinations must be bound before the simulator starts
+	time.Sleep(50 * time.Millisecond)
+
+	stop := startSimulator(t, Config{
+		Protocol:     "bats",
+		LocalAddr:    localAddr,
+		FeedAddr:     feedAddr,
+		GapAddr:      gapAddr,
+		PartNumLimit: 1,
+		Speed:        1000,
+		GapPeriod:    50,
+		GapSize:      3,
+	})
+	defer stop()
+	h.check(t, firstSeq, messages)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	st := rc.Stats()
+	if st.Recovered == 0 || st.Requests == 0 {
+		t.Errorf("nothing recovered: %+v", st)
+	}
+	if st.Lost != 0 {
+		t.Errorf("lost messages: %+v", st)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+type ChannelStatus struct {
+	Channel  int    `json:"channel"`
+	Session  string `json:"session,omitempty"`
+	Sequence int    `json:"sequence"` // last sequence number published on the feed
+	// messages actually sent to the feed, without simulated gaps
+	MessagesSent    uint64 `json:"messages_sent"`
+	RecoveryClients int    `json:"recovery_clients"`
+	Paused          bool   `json:"paused"`
+	Rate            int    `json:"rate"` // messages per second
+}
+
+type Status struct {
+	Protocol string          `json:"protocol"`
+	Channels []ChannelStatus `json:"channels"`
+}
+
+var (
+	UnknownChannel = errors.New("Unknown channel")
+	IllegalRate    = errors.New("Illegal rate")
+)
+
+// run-time state of one channel shared by its message source, feed and recovery servers
+type channelControl struct {
+	mu      sync.Mutex
+	session string
+	rate    int
+	resumed chan struct{} // closed unless paused
+	seq     int
+	sent    uint64
+	clients int
+}
+
+func newChannelControl(session string, rate int) *channelControl {
+	if rate <= 0 {
+		rate = 1
+	}
+	c := &channelControl{
+		session: session,
+		rate:    rate,
+		resumed: make(chan struct{}),
+	}
+	close(c.resumed)
+	return c
+}
+
+func (c *channelControl) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.resumed:
+		c.resumed = make(chan struct{})
+	default:
+	}
+}
+func (c *channelControl) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.resumed:
+	default:
+		close(c.resumed)
+	}
+}
+func (c *channelControl) paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.resumed:
+		return false
+	default:
+		return true
+	}
+}
+func (c *channelControl) setRate(rate int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rate = rate
+}
+
+// delay between messages at the current rate
+func (c *channelControl) period() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Second / time.Duration(c.rate)
+}
+
+// blocks while paused; returns false if ctx is done
+func (c *channelControl) waitResumed(ctx context.Context) bool {
+	c.mu.Lock()
+	resumed := c.resumed
+	c.mu.Unlock()
+	select {
+	case <-resumed:
+		return ctx.Err() == nil
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// returns false if ctx is done before d elapses
+func (c *channelControl) sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// records publishing of seq with sent messages
+func (c *channelControl) published(seq int, sent int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq = seq
+	c.sent += uint64(sent)
+}
+func (c *channelControl) addClient(delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clients += delta
+}
+
+func (c *channelControl) status(channel int) ChannelStatus {
+	paused := c.paused()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ChannelStatus{
+		Channel:         channel,
+		Session:         c.session,
+		Sequence:        c.seq,
+		MessagesSent:    c.sent,
+		RecoveryClients: c.clients,
+		Paused:          paused,
+		Rate:            c.rate,
+	}
+}
+
+// Pause, Resume, SetRate and Status of ExchangeSimulator over channel controls;
+// channel -1 means all channels
+type simulatorControl struct {
+	protocol string
+	channels []*channelControl
+}
+
+func (s *simulatorControl) each(channel int, f func(*channelControl)) error {
+	if channel < -1 || channel >= len(s.channels) {
+		return UnknownChannel
+	}
+	for i, c := range s.channels {
+		if channel == -1 || channel == i {
+			f(c)
+		}
+	}
+	return nil
+}
+func (s *simulatorControl) Pause(channel int) error {
+	return s.each(channel, (*channelControl).pause)
+}
+func (s *simulatorControl) Resume(channel int) error {
+	return s.each(channel, (*channelControl).resume)
+}
+func (s *simulatorControl) SetRate(channel int, rate int) error {
+	if rate <= 0 {
+		return IllegalRate
+	}
+	return s.each(channel, func(c *channelControl) { c.setRate(rate) })
+}
+func (s *simulatorControl) Status() Status {
+	st := Status{Protocol: s.protocol}
+	for i, c := range s.channels {
+		st.Channels = append(st.Channels, c.status(i))
+	}
+	return st
+}
+
+// servers running until ctx is done or any of them fails
+type serverGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	once   sync.Once
+	err    error
+}
+
+func newServerGroup(ctx context.Context) *serverGroup {
+	g := &serverGroup{}
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	return g
+}
+func (g *serverGroup) run(f func(ctx context.Context) error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := f(g.ctx); err != nil {
+			g.once.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+// waits for ctx to be done and all servers to stop; returns the first server error
+func (g *serverGroup) wait() error {
+	<-g.ctx.Done()
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
+
+// closes c when ctx is done, e.g. to unblock Accept or Read; call returned function to stop watching
+func closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,93 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/ikravets/errs"
+)
+
+// HTTP/JSON control of running simulator; every request responds with current status
+//
+//	GET  /status
+//	POST /pause?channel=N    (all channels by default)
+//	POST /resume?channel=N
+//	POST /rate?channel=N&rate=MPS
+//	POST /stop
+func NewControlHandler(es ExchangeSimulator, stop func()) http.Handler {
+	mux := http.NewServeMux()
+	handle := func(path string, action func(r *http.Request, channel int) error) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if action != nil && r.Method != "POST" {
+				controlError(w, http.StatusMethodNotAllowed, "POST required")
+				return
+			}
+			channel := -1
+			if v := r.FormValue("channel"); v != "" {
+				var err error
+				if channel, err = strconv.Atoi(v); err != nil {
+					controlError(w, http.StatusBadRequest, "bad channel "+v)
+					return
+				}
+			}
+			if action != nil {
+				if err := action(r, channel); err != nil {
+					controlError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(es.Status()); err != nil {
+				log.Printf("control response: %s\n", err)
+			}
+		})
+	}
+	handle("/status", nil)
+	handle("/pause", func(_ *http.Request, channel int) error {
+		return es.Pause(channel)
+	})
+	handle("/resume", func(_ *http.Request, channel int) error {
+		return es.Resume(channel)
+	})
+	handle("/rate", func(r *http.Request, channel int) error {
+		rate, err := strconv.Atoi(r.FormValue("rate"))
+		if err != nil {
+			return IllegalRate
+		}
+		return es.SetRate(channel, rate)
+	})
+	handle("/stop", func(*http.Request, int) error {
+		stop()
+		return nil
+	})
+	return mux
+}
+
+func controlError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// serves control handler on laddr until ctx is done
+func RunControlServer(ctx context.Context, laddr string, h http.Handler) (err error) {
+	defer errs.PassE(&err)
+	l, err := net.Listen("tcp", laddr)
+	errs.CheckE(err)
+	log.Printf("started control %s\n", l.Addr())
+	srv := &http.Server{Handler: h}
+	defer closeOnDone(ctx, srv)()
+	if err = srv.Serve(l); err == http.ErrServerClosed {
+		err = nil
+	}
+	return
+}
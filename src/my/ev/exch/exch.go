@@ -4,23 +4,45 @@
 package exch
 
 import (
+	"context"
 	"errors"
+	"log"
 )
 
+// channel -1 means all channels
 type ExchangeSimulator interface {
-	Run()
+	// serves until ctx is done or a server fails
+	Run(ctx context.Context) error
+	Pause(channel int) error
+	Resume(channel int) error
+	SetRate(channel int, rate int) error
+	Status() Status
 }
 
 type Config struct {
 	Protocol     string
 	LocalAddr    string
-	FeedAddr     string
+	FeedAddr     string // nasdaq: empty for channels.LoadFromStr("nasdaq") addresses
 	GapAddr      string
 	Interactive  bool
 	GapPeriod    uint64
 	GapSize      uint64
 	PartNumLimit int
 	Speed        int
+
+	InputFileName  string
+	InputDstAddr   string
+	OriginalPacing bool
+
+	ScenarioFileName string
+
+	Faults   []FaultConfig
+	FaultLog *log.Logger
+
+	// NASDAQ feed is published by matching engine
+	Match bool
+	// overrides of default NASDAQ sessions
+	NasdaqSessions []NasdaqSessionConfig
 }
 
 var IllegalProtocol = errors.New("Illegal protocol")
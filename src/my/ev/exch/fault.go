@@ -0,0 +1,346 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ikravets/errs"
+)
+
+// network faults injected into multicast packets of one channel
+type FaultConfig struct {
+	Channel       int // -1 for all channels
+	Seed          int64
+	Loss          float64
+	BurstLoss     float64
+	BurstLength   int
+	Duplicate     float64
+	Reorder       float64
+	ReorderWindow int
+	DelaySpike    float64
+	Delay         time.Duration
+	Truncate      float64
+	SequenceReset float64
+	// packets are also sent to line B; with probability Diverge only to one of the lines
+	LineB   string
+	Diverge float64
+}
+
+// parses comma-separated list of key=value, e.g.
+// "channel=1,seed=7,loss=0.001,burst=0.0001:50,dup=0.001,reorder=0.01:4,delay=0.001:20ms,truncate=0.001,reset=0.00001,b=233.54.12.2:18001,diverge=0.01"
+func ParseFaultConfig(s string) (fc FaultConfig, err error) {
+	defer errs.PassE(&err)
+	fc = FaultConfig{
+		Channel:       -1,
+		Seed:          1,
+		BurstLength:   10,
+		ReorderWindow: 3,
+		Delay:         10 * time.Millisecond,
+	}
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		p := strings.SplitN(kv, "=", 2)
+		errs.Check(len(p) == 2, "bad fault spec", kv)
+		k, v := p[0], p[1]
+		prob := func(dst *float64) string {
+			pp := strings.SplitN(v, ":", 2)
+			*dst, err = strconv.ParseFloat(pp[0], 64)
+			errs.CheckE(err)
+			errs.Check(*dst >= 0 && *dst <= 1, "probability out of range", kv)
+			if len(pp) == 2 {
+				return pp[1]
+			}
+			return ""
+		}
+		atoi := func(s string, dst *int) {
+			if s != "" {
+				*dst, err = strconv.Atoi(s)
+				errs.CheckE(err)
+			}
+		}
+		switch k {
+		case "channel":
+			atoi(v, &fc.Channel)
+		case "seed":
+			fc.Seed, err = strconv.ParseInt(v, 0, 64)
+			errs.CheckE(err)
+		case "loss":
+			prob(&fc.Loss)
+		case "burst":
+			atoi(prob(&fc.BurstLoss), &fc.BurstLength)
+		case "dup":
+			prob(&fc.Duplicate)
+		case "reorder":
+			atoi(prob(&fc.Reorder), &fc.ReorderWindow)
+		case "delay":
+			if d := prob(&fc.DelaySpike); d != "" {
+				fc.Delay, err = time.ParseDuration(d)
+				errs.CheckE(err)
+			}
+		case "truncate":
+			prob(&fc.Truncate)
+		case "reset":
+			prob(&fc.SequenceReset)
+		case "b":
+			fc.LineB = v
+		case "diverge":
+			prob(&fc.Diverge)
+		default:
+			errs.Check(false, "unknown fault", k)
+		}
+	}
+	errs.Check(fc.BurstLength > 0 && fc.ReorderWindow > 0, s)
+	return
+}
+
+// exact channel match is preferred over channel -1
+func (c *Config) faultConfig(channel int) (fc *FaultConfig) {
+	for i := range c.Faults {
+		switch c.Faults[i].Channel {
+		case channel:
+			return &c.Faults[i]
+		case -1:
+			if fc == nil {
+				fc = &c.Faults[i]
+			}
+		}
+	}
+	return
+}
+
+// location of packet sequence number
+type seqField struct {
+	offset int
+	size   int
+	order  binary.ByteOrder
+}
+
+var seqFields = map[string]seqField{
+	"nasdaq": {10, 8, binary.BigEndian},   // MoldUDP64
+	"bats":   {4, 4, binary.LittleEndian}, // sequenced unit header
+	"miax":   {0, 8, binary.LittleEndian}, // MACH
+}
+
+func (f seqField) get(p []byte) uint64 {
+	if len(p) < f.offset+f.size {
+		return 0
+	}
+	if f.size == 4 {
+		return uint64(f.order.Uint32(p[f.offset:]))
+	}
+	return f.order.Uint64(p[f.offset:])
+}
+func (f seqField) set(p []byte, seq uint64) {
+	if len(p) < f.offset+f.size {
+		return
+	}
+	if f.size == 4 {
+		f.order.PutUint32(p[f.offset:], uint32(seq))
+	} else {
+		f.order.PutUint64(p[f.offset:], seq)
+	}
+}
+
+type heldPacket struct {
+	data    []byte
+	release int
+}
+
+// reordered packets are sent at the latest after this time, even if no more packets are written
+const faultHeldTimeout = time.Second
+
+// net.Conn sending each written packet through fault injection
+type faultConn struct {
+	net.Conn
+	lineB    net.Conn
+	conf     FaultConfig
+	rnd      *rand.Rand
+	seq      seqField
+	channel  string
+	flog     *log.Logger
+	count    int
+	burst    int
+	seqDelta uint64
+
+	mu        sync.Mutex
+	held      []heldPacket
+	heldTimer *time.Timer
+}
+
+// wraps conn if faults are configured for the channel
+func newFaultConn(conn net.Conn, c *Config, channel int) (fconn net.Conn, err error) {
+	defer errs.PassE(&err)
+	fconn = conn
+	conf := c.faultConfig(channel)
+	if conf == nil {
+		return
+	}
+	seq, ok := seqFields[c.Protocol]
+	errs.Check(ok, c.Protocol)
+	fc := &faultConn{
+		Conn:    conn,
+		conf:    *conf,
+		rnd:     rand.New(rand.NewSource(conf.Seed + int64(channel))),
+		seq:     seq,
+		channel: fmt.Sprintf("%s/%d", c.Protocol, channel),
+		flog:    c.FaultLog,
+	}
+	if fc.flog == nil {
+		fc.flog = log.New(logWriter{}, "", 0)
+	}
+	if conf.LineB != "" {
+		raddr, err := net.ResolveUDPAddr("udp", conf.LineB)
+		errs.CheckE(err)
+		fc.lineB, err = net.DialUDP("udp", nil, raddr)
+		errs.CheckE(err)
+	}
+	fc.logf(0, "injecting %+v", *conf)
+	return fc, nil
+}
+
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	log.Print(string(p))
+	return len(p), nil
+}
+
+func (fc *faultConn) logf(seq uint64, format string, v ...interface{}) {
+	fc.flog.Printf("fault %s packet %d seq %d: %s", fc.channel, fc.count, seq, fmt.Sprintf(format, v...))
+}
+
+func (fc *faultConn) hit(prob float64) bool {
+	return prob > 0 && fc.rnd.Float64() < prob
+}
+
+func (fc *faultConn) Write(b []byte) (n int, err error) {
+	defer errs.PassE(&err)
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	n = len(b)
+	fc.count++
+	p := make([]byte, len(b))
+	copy(p, b)
+	seq := fc.seq.get(p)
+	// zero seq marks unsequenced packets, e.g. BATS unit 0, and is kept as is
+	if seq != 0 && fc.hit(fc.conf.SequenceReset) {
+		fc.seqDelta = seq - 1
+		fc.logf(seq, "sequence reset")
+	}
+	if seq != 0 && fc.seqDelta != 0 {
+		fc.seq.set(p, seq-fc.seqDelta)
+	}
+	defer func() { errs.CheckE(fc.release(false)) }()
+	switch {
+	case fc.burst > 0:
+		fc.burst--
+		fc.logf(seq, "burst loss")
+		return
+	case fc.hit(fc.conf.BurstLoss):
+		fc.burst = fc.conf.BurstLength - 1
+		fc.logf(seq, "burst loss start, %d packets", fc.conf.BurstLength)
+		return
+	case fc.hit(fc.conf.Loss):
+		fc.logf(seq, "loss")
+		return
+	}
+	if len(p) > 0 && fc.hit(fc.conf.Truncate) {
+		l := fc.rnd.Intn(len(p))
+		fc.logf(seq, "truncated %d -> %d bytes", len(p), l)
+		p = p[:l]
+	}
+	if fc.hit(fc.conf.DelaySpike) {
+		fc.logf(seq, "delay %s", fc.conf.Delay)
+		time.Sleep(fc.conf.Delay)
+	}
+	if fc.hit(fc.conf.Reorder) {
+		h := heldPacket{data: p, release: fc.count + 1 + fc.rnd.Intn(fc.conf.ReorderWindow)}
+		fc.logf(seq, "reordered after packet %d", h.release)
+		fc.held = append(fc.held, h)
+		if fc.heldTimer == nil {
+			fc.heldTimer = time.AfterFunc(faultHeldTimeout, fc.releaseHeld)
+		} else {
+			fc.heldTimer.Reset(faultHeldTimeout)
+		}
+		return
+	}
+	errs.CheckE(fc.send(p, seq))
+	if fc.hit(fc.conf.Duplicate) {
+		fc.logf(seq, "duplicate")
+		errs.CheckE(fc.send(p, seq))
+	}
+	return
+}
+
+// sends held packets due for release, or all of them
+func (fc *faultConn) release(all bool) (err error) {
+	defer errs.PassE(&err)
+	held := fc.held[:0]
+	for _, h := range fc.held {
+		if all || h.release <= fc.count {
+			errs.CheckE(fc.send(h.data, fc.seq.get(h.data)))
+		} else {
+			held = append(held, h)
+		}
+	}
+	fc.held = held
+	return
+}
+func (fc *faultConn) releaseHeld() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if len(fc.held) != 0 {
+		fc.logf(0, "releasing %d held packets", len(fc.held))
+	}
+	if err := fc.release(true); err != nil {
+		log.Printf("fault %s: %s", fc.channel, err)
+	}
+}
+
+func (fc *faultConn) send(p []byte, seq uint64) (err error) {
+	defer errs.PassE(&err)
+	sendA, sendB := true, fc.lineB != nil
+	if sendB && fc.hit(fc.conf.Diverge) {
+		if fc.rnd.Intn(2) == 0 {
+			sendA = false
+			fc.logf(seq, "line A divergence")
+		} else {
+			sendB = false
+			fc.logf(seq, "line B divergence")
+		}
+	}
+	if sendA {
+		_, err = fc.Conn.Write(p)
+		errs.CheckE(err)
+	}
+	if sendB {
+		_, err = fc.lineB.Write(p)
+		errs.CheckE(err)
+	}
+	return
+}
+
+func (fc *faultConn) Close() error {
+	fc.mu.Lock()
+	if fc.heldTimer != nil {
+		fc.heldTimer.Stop()
+	}
+	fc.mu.Unlock()
+	fc.releaseHeld()
+	if fc.lineB != nil {
+		fc.lineB.Close()
+	}
+	return fc.Conn.Close()
+}
@@ -0,0 +1,290 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	matchTifDay = '0'
+	matchTifIoc = '3'
+)
+
+type matchOrder struct {
+	ref    uint32 // order reference number on the feed
+	token  string
+	option uint32
+	side   byte // B or S
+	price  uint32
+	size   int
+	tif    byte
+	owner  matchOwner
+}
+
+// order entry session receiving reports about its orders
+type matchOwner interface {
+	accepted(o *matchOrder)
+	replaced(o *matchOrder, prev *matchOrder)
+	// liquidity is 'A' for resting order, 'R' for incoming
+	executed(o *matchOrder, size int, price uint32, match uint32, liquidity byte)
+	canceled(o *matchOrder, size int, reason byte)
+}
+
+// market data publisher of book changes
+type matchFeed interface {
+	add(o *matchOrder)
+	replace(prev *matchOrder, o *matchOrder)
+	execute(o *matchOrder, size int, match uint32)
+	cancel(o *matchOrder, size int)
+	delete(o *matchOrder)
+}
+
+const (
+	matchCancelUser       = 'U'
+	matchCancelIoc        = 'I'
+	matchCancelDisconnect = 'D'
+)
+
+var (
+	matchUnknownOption = errors.New("unknown option")
+	matchBadOrder      = errors.New("bad order")
+)
+
+// orders of one side sorted by price and time
+type matchSide []*matchOrder
+
+type matchBook struct {
+	bids matchSide
+	asks matchSide
+}
+
+func (b *matchBook) side(side byte) *matchSide {
+	if side == 'B' {
+		return &b.bids
+	}
+	return &b.asks
+}
+func (b *matchBook) opposite(side byte) *matchSide {
+	if side == 'B' {
+		return &b.asks
+	}
+	return &b.bids
+}
+func (s *matchSide) insert(o *matchOrder) {
+	better := func(p uint32) bool {
+		if o.side == 'B' {
+			return o.price > p
+		}
+		return o.price < p
+	}
+	i := 0
+	for i < len(*s) && !better((*s)[i].price) {
+		i++
+	}
+	*s = append(*s, nil)
+	copy((*s)[i+1:], (*s)[i:])
+	(*s)[i] = o
+}
+func (s *matchSide) remove(o *matchOrder) {
+	for i, r := range *s {
+		if r == o {
+			*s = append((*s)[:i], (*s)[i+1:]...)
+			return
+		}
+	}
+}
+
+// price-time priority matching of limit orders
+type matchEngine struct {
+	mu        sync.Mutex
+	books     map[uint32]*matchBook
+	feed      matchFeed
+	nextRef   uint32
+	nextMatch uint32
+	reports   []func() // owner reports collected under mu
+
+	// delivers reports in the order of engine operations
+	reportMu sync.Mutex
+}
+
+func newMatchEngine(options []uint32, feed matchFeed) *matchEngine {
+	e := &matchEngine{
+		books:     make(map[uint32]*matchBook),
+		feed:      feed,
+		nextRef:   1,
+		nextMatch: 1,
+	}
+	for _, oid := range options {
+		e.books[oid] = &matchBook{}
+	}
+	return e
+}
+
+// releases mu and delivers collected reports outside of it
+func (e *matchEngine) unlock() {
+	reports := e.reports
+	e.reports = nil
+	e.reportMu.Lock()
+	defer e.reportMu.Unlock()
+	e.mu.Unlock()
+	for _, r := range reports {
+		r()
+	}
+}
+
+// reports get copies of orders, since the originals keep changing after mu is released
+func (e *matchEngine) accepted(o *matchOrder) {
+	c := *o
+	e.reports = append(e.reports, func() { c.owner.accepted(&c) })
+}
+func (e *matchEngine) replaced(o *matchOrder, prev *matchOrder) {
+	c, p := *o, *prev
+	e.reports = append(e.reports, func() { c.owner.replaced(&c, &p) })
+}
+func (e *matchEngine) executed(o *matchOrder, size int, price uint32, match uint32, liquidity byte) {
+	c := *o
+	e.reports = append(e.reports, func() { c.owner.executed(&c, size, price, match, liquidity) })
+}
+func (e *matchEngine) canceled(o *matchOrder, size int, reason byte) {
+	c := *o
+	e.reports = append(e.reports, func() { c.owner.canceled(&c, size, reason) })
+}
+
+func (e *matchEngine) enter(o *matchOrder) error {
+	e.mu.Lock()
+	defer e.unlock()
+	book, ok := e.books[o.option]
+	if !ok {
+		return matchUnknownOption
+	}
+	if o.size <= 0 || o.price == 0 || o.side != 'B' && o.side != 'S' {
+		return matchBadOrder
+	}
+	o.ref = e.nextRef
+	e.nextRef++
+	e.accepted(o)
+	e.match(book, o)
+	e.rest(book, o)
+	return nil
+}
+
+// reduces order size to newSize; zero cancels the order
+func (e *matchEngine) cancel(o *matchOrder, newSize int) {
+	e.mu.Lock()
+	defer e.unlock()
+	book, ok := e.books[o.option]
+	// never booked orders are ignored
+	if !ok || o.ref == 0 || o.size == 0 || newSize >= o.size {
+		return
+	}
+	dec := o.size - newSize
+	if newSize <= 0 {
+		book.side(o.side).remove(o)
+		e.feed.delete(o)
+	} else {
+		e.feed.cancel(o, dec)
+	}
+	o.size -= dec
+	e.canceled(o, dec, matchCancelUser)
+}
+
+// replaces order with a new one losing time priority
+func (e *matchEngine) replace(prev *matchOrder, o *matchOrder) error {
+	e.mu.Lock()
+	defer e.unlock()
+	book, ok := e.books[prev.option]
+	if !ok || prev.ref == 0 || prev.size == 0 {
+		return matchBadOrder
+	}
+	if o.size <= 0 || o.price == 0 {
+		return matchBadOrder
+	}
+	o.option, o.side, o.tif, o.owner = prev.option, prev.side, prev.tif, prev.owner
+	o.ref = e.nextRef
+	e.nextRef++
+	book.side(prev.side).remove(prev)
+	prev.size = 0
+	e.replaced(o, prev)
+	// executions of crossing order are published after prev leaves the book
+	if e.crosses(book, o) {
+		e.feed.delete(prev)
+		e.match(book, o)
+		e.rest(book, o)
+	} else {
+		book.side(o.side).insert(o)
+		e.feed.replace(prev, o)
+	}
+	return nil
+}
+
+// cancels all orders of the owner, e.g. on disconnect
+func (e *matchEngine) cancelAll(owner matchOwner) {
+	e.mu.Lock()
+	defer e.unlock()
+	for _, book := range e.books {
+		for _, s := range []*matchSide{&book.bids, &book.asks} {
+			kept := (*s)[:0]
+			for _, o := range *s {
+				if o.owner != owner {
+					kept = append(kept, o)
+					continue
+				}
+				e.feed.delete(o)
+				size := o.size
+				o.size = 0
+				e.canceled(o, size, matchCancelDisconnect)
+			}
+			*s = kept
+		}
+	}
+}
+
+// true if incoming order executes against the best opposite order
+func (e *matchEngine) crosses(book *matchBook, o *matchOrder) bool {
+	opp := book.opposite(o.side)
+	if o.size == 0 || len(*opp) == 0 {
+		return false
+	}
+	r := (*opp)[0]
+	return o.side == 'B' && o.price >= r.price || o.side == 'S' && o.price <= r.price
+}
+
+// executes incoming order against resting orders
+func (e *matchEngine) match(book *matchBook, o *matchOrder) {
+	opp := book.opposite(o.side)
+	for e.crosses(book, o) {
+		r := (*opp)[0]
+		size := o.size
+		if r.size < size {
+			size = r.size
+		}
+		match := e.nextMatch
+		e.nextMatch++
+		r.size -= size
+		o.size -= size
+		if r.size == 0 {
+			*opp = (*opp)[1:]
+		}
+		e.feed.execute(r, size, match)
+		e.executed(r, size, r.price, match, 'A')
+		e.executed(o, size, r.price, match, 'R')
+	}
+}
+
+// puts remainder of incoming order to the book
+func (e *matchEngine) rest(book *matchBook, o *matchOrder) {
+	if o.size == 0 {
+		return
+	}
+	if o.tif == matchTifIoc {
+		size := o.size
+		o.size = 0
+		e.canceled(o, size, matchCancelIoc)
+		return
+	}
+	book.side(o.side).insert(o)
+	e.feed.add(o)
+}
@@ -4,10 +4,13 @@
 package exch
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -20,13 +23,14 @@ import (
 type MiaxMessageSource interface {
 	SetSequence(uint64)
 	CurrentSequence() uint64
-	GetMessage(uint64) miax.MachPacket
-	Run()
+	GetMessage(uint64) (miax.MachPacket, error)
+	Run(context.Context) error
 	RunInteractive()
 	Stop()
 }
 
 type exchangeMiaxRegistry struct {
+	simulatorControl
 	exchangeMiaxN []*exchangeMiax
 }
 
@@ -48,11 +52,13 @@ func (e *exchangeMiaxRegistry) NewMiaxRegistry(c Config, msrc *miaxMessageSource
 
 func InitMiaxRegistry(c Config) (es ExchangeSimulator) {
 	esr := &exchangeMiaxRegistry{}
+	esr.protocol = c.Protocol
 	log.Printf("inited simulators %d\n", c.PartNumLimit)
 	for i := 0; i < c.PartNumLimit; i++ {
 		msrc := NewMiaxMessageSource(i, c.Speed)
 		esr.exchangeMiaxN = append(esr.exchangeMiaxN, esr.NewMiaxRegistry(c, msrc, i))
 		esr.exchangeMiaxN[i].num = i
+		esr.channels = append(esr.channels, msrc.ctl)
 	}
 	es = esr
 	return
@@ -60,6 +66,7 @@ func InitMiaxRegistry(c Config) (es ExchangeSimulator) {
 
 func NewMiaxExchangeSimulatorServer(c Config) (es ExchangeSimulator, err error) {
 	errs.Check(c.Protocol == "miax")
+	errs.Check(c.ScenarioFileName == "", "scenario is supported for nasdaq only, replay pcap compiled by scenario command instead")
 	es = InitMiaxRegistry(c)
 	return
 }
@@ -72,18 +79,21 @@ type exchangeMiax struct {
 	num         int
 }
 
-func (e *exchangeMiaxRegistry) Run() {
+func (e *exchangeMiaxRegistry) Run(ctx context.Context) (err error) {
+	g := newServerGroup(ctx)
 	for _, r := range e.exchangeMiaxN {
 		if r.interactive {
 			go r.src.RunInteractive()
 		} else {
-			go r.src.Run()
+			g.run(r.src.Run)
 		}
-		go r.sesm.run()
-		errs.CheckE(r.mcast.start())
+		g.run(r.sesm.run)
+		g.run(r.mcast.run)
 		log.Println(r.num, "started local", r.mcast.laddr.String(), "to ToM Real Time mcast", r.mcast.mcaddr.String())
 	}
-	select {}
+	err = g.wait()
+	log.Printf("stopped miax simulator: %v\n", err)
+	return
 }
 
 type SesMServer struct {
@@ -92,17 +102,22 @@ type SesMServer struct {
 	num   int
 }
 
-func (s *SesMServer) run() {
+func (s *SesMServer) run(ctx context.Context) (err error) {
+	defer errs.PassE(&err)
 	l, err := net.Listen("tcp", s.laddr)
 	errs.CheckE(err)
 	defer l.Close()
+	defer closeOnDone(ctx, l)()
 	log.Println(s.src.num, "started tcp", s.laddr)
 	for {
 		conn, err := l.Accept()
+		if err != nil && ctx.Err() != nil {
+			return nil
+		}
 		errs.CheckE(err)
 		log.Printf("accepted %s -> %s \n", conn.RemoteAddr(), conn.LocalAddr())
 		c := NewSesMServerConn(conn, s.src)
-		go c.run()
+		go c.run(ctx)
 	}
 }
 
@@ -122,10 +137,13 @@ func NewSesMServerConn(conn net.Conn, src *miaxMessageSource) *SesMServerConn {
 	}
 }
 
-func (s *SesMServerConn) run() {
+func (s *SesMServerConn) run(ctx context.Context) {
 	defer errs.Catch(func(ce errs.CheckerError) {
 		log.Printf("caught %s\n", ce)
 	})
+	defer closeOnDone(ctx, s.conn)()
+	s.src.ctl.addClient(1)
+	defer s.src.ctl.addClient(-1)
 	sendLastMessages := func(endSession bool) {
 		if endSession {
 			errs.CheckE(s.mconn.WriteMessageSimple(&miax.SesMEndOfSession{}))
@@ -174,13 +192,15 @@ func (s *SesMServerConn) run() {
 			rf, ok := m.(*miax.SesMRefreshRequest)
 			errs.Check(ok)
 			errs.Check(rf.RefreshType == miax.SesMRefreshToM || rf.RefreshType == miax.SesMRefreshSeriesUpdate)
+			sn, msgs := s.src.refresh(rf.RefreshType)
+			log.Printf("sesm refresh %c: %d messages as of seq %d", rf.RefreshType, len(msgs), sn)
 			// send miax system time first! (ToM 1.8, 3.2.2.2 note)
-			sn := uint64(s.src.CurrentSequence())
 			stime := &miax.MachSystemTime{TimeStamp: uint32(sn)}
 			stime.SetType(stime.GetType())
-			errs.CheckE(s.mconn.WriteMachMessage(sn-2, stime))
-			errs.CheckE(s.mconn.WriteMachMessage(sn-1, s.src.generateRefreshResponse(rf.RefreshType, 5)))
-			errs.CheckE(s.mconn.WriteMachMessage(sn, s.src.generateRefreshResponse(rf.RefreshType, 6)))
+			errs.CheckE(s.mconn.WriteMachMessage(sn, stime))
+			for _, m := range msgs {
+				errs.CheckE(s.mconn.WriteMachMessage(sn, m))
+			}
 			eor := miax.SesMEndRefreshNotif{
 				RefreshType:  rf.RefreshType,
 				ResponseType: 'E',
@@ -230,7 +250,11 @@ func (s *SesMServerConn) sendAll(start, end uint64) (err error) {
 	defer errs.PassE(&err)
 	log.Printf("sesm start retransm %d .. %d", start, end)
 	for i := start; i <= end; i++ {
-		m := s.src.GetMessage(i)
+		m, err := s.src.GetMessage(i)
+		if err != nil {
+			log.Printf("sesm retransm: %s", err)
+			continue
+		}
 		errs.CheckE(s.mconn.WriteMachPacket(m))
 	}
 	log.Printf("sesm retransm %d .. %d done", start, end)
@@ -242,10 +266,10 @@ type miaxMcastServer struct {
 	mcaddr *net.UDPAddr
 	src    *miaxMessageSource
 
-	cancel    chan struct{}
 	mmsc      *miaxMessageSourceClient
 	conn      net.Conn
 	num       int
+	config    *Config
 	gap       bool
 	gapSize   uint64
 	gapPeriod uint64
@@ -268,8 +292,8 @@ func newMiaxMcastServer(c Config, src *miaxMessageSource, i int) (mms *miaxMcast
 		laddr:     laddr,
 		mcaddr:    mcaddr,
 		src:       src,
-		cancel:    make(chan struct{}),
 		num:       i,
+		config:    &c,
 		gap:       0 != c.GapSize,
 		gapSize:   c.GapSize,
 		gapPeriod: gapP,
@@ -278,17 +302,15 @@ func newMiaxMcastServer(c Config, src *miaxMessageSource, i int) (mms *miaxMcast
 	return
 }
 
-func (s *miaxMcastServer) start() (err error) {
+func (s *miaxMcastServer) run(ctx context.Context) (err error) {
 	defer errs.PassE(&err)
 	s.conn, err = net.DialUDP("udp", s.laddr, s.mcaddr)
 	errs.CheckE(err)
+	s.conn, err = newFaultConn(s.conn, s.config, s.num)
+	errs.CheckE(err)
+	defer s.conn.Close()
 	//	mconn := miax.NewConn(s.conn)
 	s.mmsc = s.src.NewClient()
-	go s.run()
-	return
-}
-func (s *miaxMcastServer) run() {
-	defer s.conn.Close()
 	defer s.mmsc.Close()
 	ch := s.mmsc.Chan()
 
@@ -296,16 +318,23 @@ func (s *miaxMcastServer) run() {
 	s.src.SetSequence(uint64(s.num) << 24)
 	for {
 		select {
-		case _, _ = <-s.cancel:
+		case <-ctx.Done():
 			log.Printf("%d cancelled", s.num)
 			return
-		case seq := <-ch:
+		case seq, ok := <-ch:
+			if !ok {
+				log.Printf("%d source closed", s.num)
+				return
+			}
 			if s.gapCheck(seq) {
 				log.Printf("%d gap !!! mcast seq %d", s.num, seq)
+				s.src.ctl.published(int(seq), 0)
 			} else {
 				log.Printf("%d mcast seq %d", s.num, seq)
-				msg := s.src.GetMessage(uint64(seq))
+				msg, err := s.src.GetMessage(uint64(seq))
+				errs.CheckE(err)
 				errs.CheckE(msg.Write(s.conn))
+				s.src.ctl.published(int(seq), 1)
 			}
 		}
 	}
@@ -323,35 +352,66 @@ func (s *miaxMcastServer) gapCheck(seq uint64) (gap bool) {
 	return false
 }
 
+const (
+	miaxProducts = 64
+	// messages kept for retransmission
+	miaxMessageWindow = 1 << 16
+)
+
+type miaxToMSide struct {
+	price     uint32
+	size      uint32
+	priority  uint32
+	condition byte
+}
+
+type miaxToM struct {
+	bid   miaxToMSide
+	offer miaxToMSide
+}
+
+type miaxSeqMessage struct {
+	seq uint64
+	m   miax.MachMessage
+}
+
 type miaxMessageSource struct {
 	curSeq uint64
 	cancel chan struct{}
 	bchan  bchan.Bchan
-	mps    int
+	ctl    *channelControl
 	num    int
+
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	messages []miaxSeqMessage // ring buffer indexed by seq % miaxMessageWindow
+	lastSeq  uint64
+	series   []*miax.MachSeriesUpdate
+	tom      []miaxToM
 }
 
 func NewMiaxMessageSource(i int, speed int) *miaxMessageSource {
 	return &miaxMessageSource{
-		cancel: make(chan struct{}),
-		bchan:  bchan.NewBchan(),
-		mps:    speed,
-		curSeq: 0,
-		num:    i,
+		cancel:   make(chan struct{}),
+		bchan:    bchan.NewBchan(),
+		ctl:      newChannelControl("", speed),
+		curSeq:   0,
+		num:      i,
+		rnd:      rand.New(rand.NewSource(int64(i))),
+		messages: make([]miaxSeqMessage, miaxMessageWindow),
 	}
 }
-func (mms *miaxMessageSource) Run() {
-	ticker := time.NewTicker(time.Duration(1000000000/mms.mps) * time.Nanosecond)
-	defer ticker.Stop()
+func (mms *miaxMessageSource) Run(ctx context.Context) error {
 	defer mms.bchan.Close()
-	for {
+	for mms.ctl.sleep(ctx, mms.ctl.period()) && mms.ctl.waitResumed(ctx) {
 		select {
 		case _, _ = <-mms.cancel:
-			return
-		case <-ticker.C:
+			return nil
+		default:
 			mms.produceOne()
 		}
 	}
+	return nil
 }
 func (mms *miaxMessageSource) RunInteractive() {
 	for {
@@ -371,10 +431,12 @@ func (mms *miaxMessageSource) publish(seq uint64) {
 }
 func (mms *miaxMessageSource) produceOne() {
 	seq := atomic.AddUint64(&mms.curSeq, uint64(1))
+	mms.generate(seq)
 	mms.publish(seq)
 }
 func (mms *miaxMessageSource) produce(seq uint64) {
 	mms.SetSequence(seq)
+	mms.generate(seq)
 	mms.publish(seq)
 }
 func (mms *miaxMessageSource) Stop() {
@@ -394,71 +456,131 @@ func (mms *miaxMessageSource) NewClient() *miaxMessageSourceClient {
 	go c.run()
 	return c
 }
-func (mms *miaxMessageSource) GetMessage(seqNum uint64) miax.MachPacket { //, mtype miax.SesMMessageType
-	m := &miax.MachToMWide{
-		NanoTime:      uint32(seqNum),             //Nanoseconds part of the timestamp
-		ProductID:     uint32(seqNum),             //MIAX Product ID mapped to a given option. It is assigned per trading session and is valid for that session.
-		MBBOPrice:     uint32(seqNum % 10 * 1000), //MIAX Best price at the time stated in Timestamp and side specified in Message Type
-		MBBOSize:      uint32(seqNum % 10),        //Aggregate size at MIAX Best Price at the time stated in Timestamp and side specified in Message Type
-		MBBOPriority:  uint32((seqNum % 10) / 2),  //Aggregate size of Priority Customer contracts at the MIAX Best Price
-		MBBOCondition: miax.ConditionRegular,
+func (mms *miaxMessageSource) GetMessage(seqNum uint64) (p miax.MachPacket, err error) {
+	mms.mu.Lock()
+	defer mms.mu.Unlock()
+	m := mms.message(seqNum)
+	if m == nil {
+		return p, fmt.Errorf("message %d is not available", seqNum)
 	}
-	m.Type = miax.MachMessageType('A' + ('W'-'A')*(byte(seqNum%2)))
-	//	if seqNum%5 == 0 {
-	//		m := &miax.MachTradeCancel{}
-	//		m.SetType(m.GetType())
-	//		return miax.MakeMachPacket(seqNum, m)
-	//	}
-	return miax.MakeMachPacket(seqNum, m)
-}
-
-func (mms *miaxMessageSource) generateRefreshResponse(RefreshType byte, seqNum int) (m miax.MachMessage) {
-	u32, u16 := uint32(seqNum), uint16(seqNum)
-	switch RefreshType {
-	case miax.SesMRefreshSeriesUpdate:
-		m = &miax.MachSeriesUpdate{
-			NanoTime:         u32,                                             //Product Add/Update Time. Time at which this product is added/updated on MIAX system today.
-			ProductID:        u32,                                             //MIAX Product ID mapped to a given option. It is assigned per trading session and is valid for that session.
-			UnderlyingSymbol: [11]byte{'q', 'w', 'e', 'r', 't', 'y'},          //Stock Symbol for the option
-			SecuritySymbol:   [6]byte{'q', 'w', 'e', 'r', 't', 'y'},           //Option Security Symbol
-			ExpirationDate:   [8]byte{'2', '0', '1', '5', '1', '2', '1', '2'}, //Expiration date of the option in YYYYMMDD format
-			StrikePrice:      u32 % 10 * 1000,                                 //Explicit strike price of the option. Refer to data types for field processing notes
-			CallPut:          'C',                                             //Option Type “C” = Call "P" = Put
-			OpeningTime:      [8]byte{'0', '9', ':', '3', '0', ':', '0', '0'}, //Expressed in HH:MM:SS format. Eg: 09:30:00
-			ClosingTime:      [8]byte{'1', '6', ':', '1', '5', ':', '0', '0'}, //Expressed in HH:MM:SS format. Eg: 16:15:00
-			RestrictedOption: 'Y',                                             //“Y” = MIAX will accept position closing orders only “N” = MIAX will accept open and close positions
-			LongTermOption:   'Y',                                             //“Y” = Far month expiration (as defined by MIAX rules) “N” = Near month expiration (as defined by MIAX rules)
-			Active:           'A',                                             //Indicates if this symbol is tradable on MIAX in the current session:“A” = Active “I” = Inactive (not tradable)
-			BBOIncrement:     'P',                                             //This is the Minimum Price Variation as agreed to by the Options industry (penny pilot program) and as published by MIAX
-			AcceptIncrement:  'P',
-		}
-	case miax.SesMRefreshToM:
-		m = &miax.MachDoubleSidedToMCompact{
-			NanoTime:      u32,
-			ProductID:     u32,
-			BidPrice:      u16,
-			BidSize:       u16,
-			BidPriority:   u16,
-			OfferPrice:    u16,
-			OfferSize:     u16,
-			OfferPriority: u16,
-		}
-		if 0 == seqNum%2 {
-			m = &miax.MachDoubleSidedToMWide{
-				NanoTime:      u32,
-				ProductID:     u32,
-				BidPrice:      u32,
-				BidSize:       u32,
-				BidPriority:   u32,
-				OfferPrice:    u32,
-				OfferSize:     u32,
-				OfferPriority: u32,
+	return miax.MakeMachPacket(seqNum, m), nil
+}
+func (mms *miaxMessageSource) message(seqNum uint64) miax.MachMessage {
+	if sm := mms.messages[seqNum%miaxMessageWindow]; sm.m != nil && sm.seq == seqNum {
+		return sm.m
+	}
+	return nil
+}
+
+// series are defined first, then ToM of random series is updated; republished seq keeps its message
+func (mms *miaxMessageSource) generate(seqNum uint64) {
+	mms.mu.Lock()
+	defer mms.mu.Unlock()
+	if mms.message(seqNum) != nil {
+		return
+	}
+	var m miax.MachMessage
+	nano := uint32(seqNum % 1000000000)
+	if len(mms.series) < miaxProducts {
+		su := mms.newSeries(len(mms.series), nano)
+		mms.series = append(mms.series, su)
+		mms.tom = append(mms.tom, miaxToM{})
+		su.SetType(su.GetType())
+		m = su
+	} else {
+		i := mms.rnd.Intn(len(mms.series))
+		tom := &mms.tom[i]
+		pid := mms.series[i].ProductID
+		// one-sided updates keep the other side of the stored ToM uncrossed
+		switch mms.rnd.Intn(3) {
+		case 0:
+			bid := mms.newToMSide(0)
+			if tom.offer.price != 0 && bid.price >= tom.offer.price {
+				bid.price = tom.offer.price - 100
 			}
+			tom.bid = bid
+			m = &miax.MachToMWide{NanoTime: nano, ProductID: pid, MBBOPrice: bid.price, MBBOSize: bid.size,
+				MBBOPriority: bid.priority, MBBOCondition: bid.condition}
+			m.SetType('W')
+		case 1:
+			offer := mms.newToMSide(tom.bid.price)
+			tom.offer = offer
+			m = &miax.MachToMWide{NanoTime: nano, ProductID: pid, MBBOPrice: offer.price, MBBOSize: offer.size,
+				MBBOPriority: offer.priority, MBBOCondition: offer.condition}
+			m.SetType('A')
+		default:
+			bid := mms.newToMSide(0)
+			tom.bid, tom.offer = bid, mms.newToMSide(bid.price)
+			m = newMiaxDoubleSidedToM(nano, pid, tom)
+			m.SetType(m.GetType())
 		}
-	default:
-		errs.Check(false)
 	}
-	m.SetType(m.GetType())
+	mms.messages[seqNum%miaxMessageWindow] = miaxSeqMessage{seq: seqNum, m: m}
+	if seqNum > mms.lastSeq {
+		mms.lastSeq = seqNum
+	}
+}
+func (mms *miaxMessageSource) newSeries(i int, nano uint32) *miax.MachSeriesUpdate {
+	su := &miax.MachSeriesUpdate{
+		NanoTime:         nano,
+		ProductID:        uint32(mms.num<<16 + i + 1),
+		ExpirationDate:   [8]byte{'2', '0', '1', '6', '1', '2', '1', '6'},
+		StrikePrice:      uint32(i%8+1) * 50000,
+		CallPut:          "CP"[i%2],
+		OpeningTime:      [8]byte{'0', '9', ':', '3', '0', ':', '0', '0'},
+		ClosingTime:      [8]byte{'1', '6', ':', '1', '5', ':', '0', '0'},
+		RestrictedOption: 'N',
+		LongTermOption:   'N',
+		Active:           'A',
+		BBOIncrement:     'P',
+		AcceptIncrement:  'P',
+	}
+	symbol := fmt.Sprintf("U%02d%02d", mms.num%100, i/8)
+	copy(su.UnderlyingSymbol[:], symbol)
+	copy(su.SecuritySymbol[:], symbol)
+	return su
+}
+func (mms *miaxMessageSource) newToMSide(above uint32) (s miaxToMSide) {
+	s.price = above + uint32(mms.rnd.Intn(200)+1)*100
+	s.size = uint32(mms.rnd.Intn(100) + 1)
+	s.priority = uint32(mms.rnd.Intn(int(s.size) + 1))
+	s.condition = miax.ConditionRegular
+	return
+}
+func newMiaxDoubleSidedToM(nano uint32, pid uint32, tom *miaxToM) *miax.MachDoubleSidedToMWide {
+	return &miax.MachDoubleSidedToMWide{
+		NanoTime:       nano,
+		ProductID:      pid,
+		BidPrice:       tom.bid.price,
+		BidSize:        tom.bid.size,
+		BidPriority:    tom.bid.priority,
+		BidCondition:   tom.bid.condition,
+		OfferPrice:     tom.offer.price,
+		OfferSize:      tom.offer.size,
+		OfferPriority:  tom.offer.priority,
+		OfferCondition: tom.offer.condition,
+	}
+}
+
+// returns current state of every product as of the last sequence number
+func (mms *miaxMessageSource) refresh(refreshType byte) (seqNum uint64, msgs []miax.MachMessage) {
+	mms.mu.Lock()
+	defer mms.mu.Unlock()
+	seqNum = mms.lastSeq
+	for i, su := range mms.series {
+		var m miax.MachMessage
+		switch refreshType {
+		case miax.SesMRefreshSeriesUpdate:
+			c := *su
+			m = &c
+		case miax.SesMRefreshToM:
+			m = newMiaxDoubleSidedToM(su.NanoTime, su.ProductID, &mms.tom[i])
+		default:
+			errs.Check(false, refreshType)
+		}
+		m.SetType(m.GetType())
+		msgs = append(msgs, m)
+	}
 	return
 }
 
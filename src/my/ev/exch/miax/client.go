@@ -0,0 +1,193 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package miax
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ikravets/errs"
+)
+
+var SessionEnded = errors.New("SesM session ended")
+
+type ClientConfig struct {
+	Addr       string
+	Username   string
+	ComputerID string
+	Session    int           // 0 for currently active session
+	Timeout    time.Duration // connect and response timeout, default 5s
+	Heartbeat  time.Duration // client heartbeat interval, default 1s
+}
+
+// SesM client; application messages are passed to callbacks as received, without MACH header
+type Client struct {
+	config        ClientConfig
+	conn          net.Conn
+	mconn         Conn
+	sessionID     int
+	highestSeqNum uint64
+	ended         bool
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// connects, logs in and starts heartbeats
+func Dial(config ClientConfig) (c *Client, err error) {
+	defer errs.PassE(&err)
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.Heartbeat <= 0 {
+		config.Heartbeat = time.Second
+	}
+	conn, err := net.DialTimeout("tcp", config.Addr, config.Timeout)
+	errs.CheckE(err)
+	c = &Client{
+		config: config,
+		conn:   conn,
+		mconn:  NewConn(conn),
+		done:   make(chan struct{}),
+	}
+	if err = c.login(); err != nil {
+		conn.Close()
+		errs.CheckE(err)
+	}
+	go c.sendHeartbeat()
+	return
+}
+
+func (c *Client) login() (err error) {
+	defer errs.PassE(&err)
+	lr := SesMLoginRequest{
+		SesMVersion:  [5]byte{'1', '.', '1', ' ', ' '},
+		ApplProtocol: [8]byte{'T', 'O', 'M', '1', '.', '8', ' ', ' '},
+		ReqSession:   uint8(c.config.Session),
+	}
+	copy(lr.Username[:], c.config.Username)
+	copy(lr.ComputerID[:], c.config.ComputerID)
+	errs.CheckE(c.mconn.WriteMessageSimple(&lr))
+	m, err := c.read()
+	errs.CheckE(err)
+	res, ok := m.(*SesMLoginResponse)
+	errs.Check(ok, "unexpected login response", m)
+	errs.Check(res.LoginStatus == LoginStatusSuccess, "login rejected", string(res.LoginStatus))
+	c.sessionID = int(res.SessionID)
+	c.highestSeqNum = res.HighestSeqNum
+	log.Printf("sesm %s: logged in session %d, highest seq %d\n", c.config.Addr, c.sessionID, c.highestSeqNum)
+	return
+}
+
+func (c *Client) sendHeartbeat() {
+	ticker := time.NewTicker(c.config.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.mconn.WriteMessageSimple(&SesMClientHeartbeat{}); err != nil {
+				log.Printf("sesm %s: heartbeat: %s\n", c.config.Addr, err)
+				return
+			}
+		}
+	}
+}
+
+// reads next message other than server heartbeat
+func (c *Client) read() (m SesMMessage, err error) {
+	defer errs.PassE(&err)
+	for {
+		errs.CheckE(c.conn.SetReadDeadline(time.Now().Add(c.config.Timeout)))
+		m, err = c.mconn.ReadServerMessage()
+		errs.CheckE(err)
+		switch m := m.(type) {
+		case *SesMServerHeartbeat:
+			continue
+		case *SesMEndOfSession:
+			c.ended = true
+		case *SesMGoodBye:
+			c.ended = true
+			log.Printf("sesm %s: goodbye %c\n", c.config.Addr, m.Reason)
+		}
+		return
+	}
+}
+
+func (c *Client) SessionID() int {
+	return c.sessionID
+}
+
+// highest sequence number reported at login
+func (c *Client) HighestSequence() uint64 {
+	return c.highestSeqNum
+}
+
+// requests retransmission of sequence numbers start..end inclusive;
+// messages not available at server are skipped, server is expected to end the session afterwards
+func (c *Client) Retransmit(start, end uint64, f func(seq uint64, m []byte) error) (err error) {
+	defer errs.PassE(&err)
+	errs.Check(!c.ended, SessionEnded)
+	errs.Check(start <= end, start, end)
+	errs.CheckE(c.mconn.WriteMessageSimple(&SesMRetransmRequest{StartSeqNumber: start, EndSeqNumber: end}))
+	for {
+		m, err := c.read()
+		errs.CheckE(err)
+		if c.ended {
+			return nil
+		}
+		rr, ok := m.(*SesMRetransmResponse)
+		if !ok {
+			log.Printf("sesm %s: unexpected %#v\n", c.config.Addr, m)
+			continue
+		}
+		errs.CheckE(f(rr.Sequence, rr.ApplicationMessage))
+		if rr.Sequence == end {
+			break
+		}
+	}
+	// consume end of session following retransmission, so it is not taken as a reply to the next request
+	for !c.ended {
+		if _, err := c.read(); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil
+			}
+			return err
+		}
+	}
+	return
+}
+
+// requests current state of refreshType (e.g. SesMRefreshToM); f gets sequence number the state reflects
+func (c *Client) Refresh(refreshType byte, f func(seq uint64, m []byte) error) (err error) {
+	defer errs.PassE(&err)
+	errs.Check(!c.ended, SessionEnded)
+	errs.CheckE(c.mconn.WriteMessageSimple(&SesMRefreshRequest{RequestType: 'R', RefreshType: refreshType}))
+	for {
+		m, err := c.read()
+		errs.CheckE(err)
+		errs.Check(!c.ended, SessionEnded)
+		switch m := m.(type) {
+		case *SesMRefreshResponse:
+			errs.CheckE(f(m.SequenceNumber, m.ApplicationMessage))
+		case *SesMEndRefreshNotif:
+			if m.RefreshType == refreshType {
+				return nil
+			}
+		default:
+			log.Printf("sesm %s: unexpected %#v\n", c.config.Addr, m)
+		}
+	}
+}
+
+func (c *Client) Close() (err error) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.conn.Close()
+	})
+	return
+}
@@ -14,6 +14,7 @@ import (
 
 type Conn interface {
 	ReadMessage() (m SesMMessage, err error)
+	ReadServerMessage() (m SesMMessage, err error)
 	WriteMessageSimple(m SesMMessage) (err error)
 	WriteMachMessage(sn uint64, m MachMessage) (err error)
 	WriteMachPacket(p MachPacket) (err error)
@@ -58,6 +59,42 @@ func (c *conn) ReadMessage() (m SesMMessage, err error) {
 	log.Printf("rcv %#v\n", m)
 	return
 }
+
+// reads message sent by server, including retransmission and refresh responses carrying application message
+func (c *conn) ReadServerMessage() (m SesMMessage, err error) {
+	defer errs.PassE(&err)
+	errs.Check(c.messageReader.N == 0, c.messageReader.N)
+	var s uint16
+	errs.CheckE(binary.Read(c.rw, binary.LittleEndian, &s))
+	errs.Check(s > 0)
+	b := make([]byte, s)
+	_, err = io.ReadFull(c.rw, b)
+	errs.CheckE(err)
+	t, data := SesMMessageType(b[0]), b[1:]
+	switch {
+	case t == TypeSesMSeq:
+		errs.Check(len(data) >= 8, len(data))
+		rr := &SesMRetransmResponse{ApplicationMessage: data[8:]}
+		rr.Sequence = binary.LittleEndian.Uint64(data[0:8])
+		m = rr
+	case t == TypeSesMUnseq && len(data) > 0 && data[0] == 'E':
+		errs.Check(len(data) >= 2, len(data))
+		m = &SesMEndRefreshNotif{ResponseType: data[0], RefreshType: data[1]}
+	case t == TypeSesMUnseq:
+		errs.Check(len(data) >= 9, len(data))
+		m = &SesMRefreshResponse{
+			ResponseType:       data[0],
+			SequenceNumber:     binary.LittleEndian.Uint64(data[1:9]),
+			ApplicationMessage: data[9:],
+		}
+	default:
+		f := SesMMessageFactory[t]
+		errs.Check(f != nil, t)
+		m = f()
+		errs.CheckE(binary.Read(bytes.NewReader(data), binary.LittleEndian, m))
+	}
+	return
+}
 func writeSesMHeader(w io.Writer, m SesMMessage) error {
 	return binary.Write(w, binary.LittleEndian, SesMHeader{Length: m.Size() + 1, Type: m.Type()})
 }
@@ -157,6 +194,7 @@ func (m *SesMGoodBye) Size() uint16          { return 1 }
 func (m *SesMEndOfSession) Size() uint16     { return 0 }
 func (m *SesMServerHeartbeat) Size() uint16  { return 0 }
 func (m *SesMClientHeartbeat) Size() uint16  { return 0 }
+func (m *SesMRefreshRequest) Size() uint16   { return 2 }
 func (m *SesMRefreshResponse) Size() uint16  { return uint16(9 + len(m.ApplicationMessage)) }
 func (m *SesMEndRefreshNotif) Size() uint16  { return 2 }
 func (m *SesMRetransmResponse) Size() uint16 { return uint16(8 + len(m.ApplicationMessage)) }
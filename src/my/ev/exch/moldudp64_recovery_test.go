@@ -0,0 +1,134 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"my/ev/packet"
+	"my/ev/packet/nasdaq"
+)
+
+// collects sequence numbers of delivered messages
+type recoveryHandler struct {
+	mu   sync.Mutex
+	seqs []uint64
+}
+
+func (h *recoveryHandler) HandlePacket(packet.Packet) {}
+func (h *recoveryHandler) HandleMessage(m packet.ApplicationMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seqs = append(h.seqs, m.SequenceNumber())
+}
+func (h *recoveryHandler) delivered() []uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]uint64(nil), h.seqs...)
+}
+
+// waits until n messages are delivered and checks they are in sequence from first
+func (h *recoveryHandler) check(t *testing.T, first uint64, n int) {
+	for i := 0; len(h.delivered()) < n; i++ {
+		if i == 1000 {
+			t.Fatalf("delivered %d messages, expected %d", len(h.delivered()), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, seq := range h.delivered()[:n] {
+		if seq != first+uint64(i) {
+			t.Fatalf("message #%d has seq %d, expected %d", i, seq, first+uint64(i))
+		}
+	}
+}
+
+func freeLoopbackAddr(t *testing.T, network string) string {
+	var addr string
+	if network == "udp" {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = c.LocalAddr().String()
+		c.Close()
+	} else {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = l.Addr().String()
+		l.Close()
+	}
+	return addr
+}
+
+// runs simulator until returned stop is called
+func startSimulator(t *testing.T, c Config) (stop func()) {
+	es, err := NewExchangeSimulator(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		es.Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestMoldUDP64RecoveryGap(t *testing.T) {
+	// gaps at 1000, 1050 and 1100
+	const firstSeq, messages = 1000, 120
+	feedAddr := freeLoopbackAddr(t, "udp")
+	rerequestAddr := freeLoopbackAddr(t, "udp")
+	rc := nasdaq.NewRecoveryClient(nasdaq.RecoveryConfig{
+		FeedAddr:      feedAddr,
+		RerequestAddr: rerequestAddr,
+		StartSequence: firstSeq,
+		// synthetic source delays rerequest responses by over a second
+		Timeout: 2 * time.Second,
+	})
+	h := &recoveryHandler{}
+	rc.SetHandler(h)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- rc.Run(ctx) }()
+	// the feed socket is connected, so its destination must be bound before the simulator starts
+	time.Sleep(50 * time.Millisecond)
+
+	stop := startSimulator(t, Config{
+		Protocol:  "nasdaq",
+		LocalAddr: "127.0.0.1:0",
+		NasdaqSessions: []NasdaqSessionConfig{{
+			FeedAddr:      feedAddr,
+			GlimpseAddr:   freeLoopbackAddr(t, "tcp"),
+			RerequestAddr: rerequestAddr,
+			Speed:         1000,
+			FirstSeq:      firstSeq,
+			GapPeriod:     50,
+			GapSize:       3,
+		}},
+	})
+	defer stop()
+	h.check(t, firstSeq, messages)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	st := rc.Stats()
+	if st.Recovered == 0 || st.Requests == 0 {
+		t.Errorf("nothing recovered: %+v", st)
+	}
+	if st.Lost != 0 {
+		t.Errorf("lost messages: %+v", st)
+	}
+}
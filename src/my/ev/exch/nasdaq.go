@@ -5,6 +5,7 @@ package exch
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"log"
@@ -18,52 +19,123 @@ import (
 )
 
 func NewNasdaqExchangeSimulatorServer(c Config) (es ExchangeSimulator, err error) {
+	defer errs.PassE(&err)
 	errs.Check(c.Protocol == "nasdaq")
 	errs.Check(!c.Interactive)
-	es = &exchangeNasdaq{
-		glimpse: &glimpseServer{
-			laddr:          ":16001",
-			snapshotSeqNum: 5,
-		},
-		replay: &replayServer{
-			laddr:        ":17001",
-			sleepEnabled: true,
-		},
-		mcast: &mcastServer{
-			laddr: c.LocalAddr,
-			raddr: c.FeedAddr,
-			seq:   1000,
-			pps:   1,
-		},
+	sessions, err := c.nasdaqSessions()
+	errs.CheckE(err)
+	e := &exchangeNasdaq{}
+	e.protocol = c.Protocol
+	for i, sc := range sessions {
+		var src ittoMessageSource
+		var dropped map[int]bool
+		var ouch *ouchServer
+		sleepEnabled := false
+		if sc.Match {
+			var options []uint32
+			for oid := 1; oid <= sc.Options; oid++ {
+				options = append(options, uint32(oid))
+			}
+			live := newLiveIttoMessageSource(sc.Session, sc.FirstSeq, options)
+			ouch = &ouchServer{
+				laddr:   sc.OrderEntryAddr,
+				session: sc.Session,
+				engine:  newMatchEngine(options, live),
+			}
+			src = live
+		} else if sc.ScenarioFileName != "" {
+			src, dropped, err = newScenarioIttoMessageSource(sc.ScenarioFileName)
+			errs.CheckE(err)
+		} else if sc.InputFileName != "" {
+			src, err = newRecordedIttoMessageSource(sc.InputFileName, sc.InputDstAddr)
+			errs.CheckE(err)
+		} else {
+			src = newSyntheticIttoMessageSource(sc.Session, sc.FirstSeq)
+			sleepEnabled = true
+		}
+		snap := newIttoSnapshotter(src)
+		ctl := newChannelControl(sc.Session, sc.Speed)
+		e.channels = append(e.channels, ctl)
+		e.sessions = append(e.sessions, &nasdaqSession{
+			ouch: ouch,
+			glimpse: &glimpseServer{
+				laddr: sc.GlimpseAddr,
+				src:   src,
+				snap:  snap,
+				ctl:   ctl,
+			},
+			replay: &replayServer{
+				laddr:        sc.RerequestAddr,
+				src:          src,
+				sleepEnabled: sleepEnabled,
+			},
+			mcast: &mcastServer{
+				laddr:          c.LocalAddr,
+				raddr:          sc.FeedAddr,
+				src:            src,
+				snap:           snap,
+				ctl:            ctl,
+				originalPacing: sc.OriginalPacing,
+				gapPeriod:      int(sc.GapPeriod),
+				gapSize:        int(sc.GapSize),
+				dropped:        dropped,
+				config:         &c,
+				channel:        i,
+			},
+		})
 	}
+	es = e
 	return
 }
 
-type exchangeNasdaq struct {
+type nasdaqSession struct {
+	ouch    *ouchServer
 	glimpse *glimpseServer
 	replay  *replayServer
 	mcast   *mcastServer
 }
 
-func (e *exchangeNasdaq) Run() {
-	go e.glimpse.run()
-	go e.replay.run()
-	go e.mcast.run()
-	log.Println("started")
-	select {}
+type exchangeNasdaq struct {
+	simulatorControl
+	sessions []*nasdaqSession
+}
+
+func (e *exchangeNasdaq) Run(ctx context.Context) (err error) {
+	g := newServerGroup(ctx)
+	for i, s := range e.sessions {
+		g.run(s.glimpse.run)
+		g.run(s.replay.run)
+		g.run(s.mcast.run)
+		if s.ouch != nil {
+			g.run(s.ouch.run)
+			log.Printf("%d started order entry %s\n", i, s.ouch.laddr)
+		}
+		log.Printf("%d started session %s: feed %s glimpse %s rerequest %s\n",
+			i, s.mcast.src.Session(), s.mcast.raddr, s.glimpse.laddr, s.replay.laddr)
+	}
+	err = g.wait()
+	log.Printf("stopped nasdaq simulator: %v\n", err)
+	return
 }
 
 type glimpseServer struct {
-	laddr          string
-	snapshotSeqNum int
+	laddr string
+	src   ittoMessageSource
+	snap  *ittoSnapshotter
+	ctl   *channelControl
 }
 
-func (s *glimpseServer) run() {
+func (s *glimpseServer) run(ctx context.Context) (err error) {
+	defer errs.PassE(&err)
 	l, err := net.Listen("tcp", s.laddr)
 	errs.CheckE(err)
 	defer l.Close()
+	defer closeOnDone(ctx, l)()
 	for {
 		conn, err := l.Accept()
+		if err != nil && ctx.Err() != nil {
+			return nil
+		}
 		errs.CheckE(err)
 		log.Printf("accepted %s -> %s \n", conn.RemoteAddr(), conn.LocalAddr())
 		go s.handleClient(conn)
@@ -71,6 +143,11 @@ func (s *glimpseServer) run() {
 }
 func (s *glimpseServer) handleClient(conn net.Conn) {
 	defer conn.Close()
+	defer errs.Catch(func(ce errs.CheckerError) {
+		log.Printf("glimpse client %s: %s\n", conn.RemoteAddr(), ce)
+	})
+	s.ctl.addClient(1)
+	defer s.ctl.addClient(-1)
 	m, err := sbtcp.ReadMessage(conn)
 	errs.CheckE(err)
 	log.Printf("got %#v\n", m)
@@ -78,31 +155,35 @@ func (s *glimpseServer) handleClient(conn net.Conn) {
 	errs.Check(lr != nil)
 
 	la := sbtcp.MessageLoginAccepted{
-		Session:        "00TestSess",
+		Session:        s.src.Session(),
 		SequenceNumber: 1,
 	}
 	errs.CheckE(sbtcp.WriteMessage(conn, &la))
 	log.Printf("glimpse send: %v\n", la)
 
-	for i := 0; i < s.snapshotSeqNum; i++ {
-		s.sendSeqData(conn, generateIttoMessage(i))
+	msgs, nextSeq, err := s.snap.snapshot()
+	errs.CheckE(err)
+	for _, m := range msgs {
+		s.sendSeqData(conn, m)
 	}
-	snap := fmt.Sprintf("M%020d", s.snapshotSeqNum)
+	snap := fmt.Sprintf("M%020d", nextSeq)
 	s.sendSeqData(conn, []byte(snap))
+	log.Printf("glimpse snapshot sent: %d messages, next seq %d\n", len(msgs), nextSeq)
 }
 func (s *glimpseServer) sendSeqData(conn net.Conn, data []byte) {
 	sd := sbtcp.MessageSequencedData{}
 	sd.SetPayload(data)
 	errs.CheckE(sbtcp.WriteMessage(conn, &sd))
-	log.Printf("glimpse send: %v\n", sd)
 }
 
 type replayServer struct {
 	laddr        string
+	src          ittoMessageSource
 	sleepEnabled bool
 }
 
-func (s *replayServer) run() {
+func (s *replayServer) run(ctx context.Context) (err error) {
+	defer errs.PassE(&err)
 	type moldudp64request struct {
 		Session        string
 		SequenceNumber uint64
@@ -114,9 +195,13 @@ func (s *replayServer) run() {
 	conn, err := net.ListenUDP("udp", laddr)
 	errs.CheckE(err)
 	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
 	buf := make([]byte, 20, 65536)
 	for {
 		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil && ctx.Err() != nil {
+			return nil
+		}
 		errs.CheckE(err)
 		if n != 20 {
 			log.Printf("ignore wrong request from %s: %v\n", addr, buf)
@@ -128,25 +213,32 @@ func (s *replayServer) run() {
 			MessageCount:   binary.BigEndian.Uint16(buf[18:20]),
 		}
 		go func() {
-			const MAX_MESSAGES = (1500 - 34 - 20) / 40
+			defer errs.Catch(func(ce errs.CheckerError) {
+				log.Printf("rerequest from %s: %s\n", addr, ce)
+			})
 			log.Printf("got request: %v\n", req)
-			//num := int(req.SequenceNumber) - 10
+			seq := int(req.SequenceNumber)
 			num := int(req.MessageCount)
 			if num <= 0 {
 				num = 1
-			} else if num > MAX_MESSAGES {
-				num = MAX_MESSAGES
 			}
-			resp, err := createMoldPacket(int(req.SequenceNumber), num)
+			if seq < s.src.FirstSequence() || seq >= s.src.Published() {
+				log.Printf("ignore request for unavailable seq %d (available %d .. %d)\n",
+					seq, s.src.FirstSequence(), s.src.Published())
+				return
+			}
+			if seq+num > s.src.Published() {
+				num = s.src.Published() - seq
+			}
+			resp, num, err := createMoldPacket(s.src, seq, num)
 			errs.CheckE(err)
-			errs.Check(len(resp) < 1500-34)
 
 			if s.sleepEnabled {
 				sleep := time.Duration(250+2500/num) * time.Millisecond
 				log.Printf("sleeping for %s\n", sleep)
 				time.Sleep(sleep)
 			}
-			log.Printf("send response: %v\n", resp)
+			log.Printf("send response: seq %d count %d\n", seq, num)
 			n, err = conn.WriteToUDP(resp, addr)
 			errs.CheckE(err)
 			errs.Check(n == len(resp), n, len(resp))
@@ -155,36 +247,137 @@ func (s *replayServer) run() {
 }
 
 type mcastServer struct {
-	laddr string
-	raddr string
-	seq   int
-	pps   int
+	laddr          string
+	raddr          string
+	src            ittoMessageSource
+	snap           *ittoSnapshotter
+	ctl            *channelControl
+	originalPacing bool
+	gapPeriod      int
+	gapSize        int
+	gapCnt         int
+	dropped        map[int]bool
+	config         *Config
+	channel        int
+	conn           net.Conn
 }
 
-func (s *mcastServer) run() {
-	errs.Check(s.pps != 0)
+func (s *mcastServer) run(ctx context.Context) (err error) {
+	defer errs.PassE(&err)
 	laddr, err := net.ResolveUDPAddr("udp", s.laddr)
 	errs.CheckE(err)
 	raddr, err := net.ResolveUDPAddr("udp", s.raddr)
 	errs.CheckE(err)
-	conn, err := net.DialUDP("udp", laddr, raddr)
+	s.conn, err = net.DialUDP("udp", laddr, raddr)
+	errs.CheckE(err)
+	s.conn, err = newFaultConn(s.conn, s.config, s.channel)
 	errs.CheckE(err)
+	defer s.conn.Close()
+
+	seq := s.src.FirstSequence()
+	end := s.src.EndSequence()
+	var startTime, startCapTime time.Time
+	for end < 0 || seq < end {
+		next := seq + 1
+		if live, ok := s.src.(*liveIttoMessageSource); ok {
+			if next = live.wait(seq, time.Second); next == seq {
+				if ctx.Err() != nil {
+					return
+				}
+				s.heartbeat(seq)
+				continue
+			}
+		} else if s.originalPacing && !s.src.Time(seq).IsZero() {
+			capTime := s.src.Time(seq)
+			if startTime.IsZero() {
+				startTime, startCapTime = time.Now(), capTime
+			}
+			if !s.ctl.sleep(ctx, capTime.Sub(startCapTime)-time.Now().Sub(startTime)) {
+				return
+			}
+			// messages captured in the same packet are sent together
+			for next < end && s.src.Time(next).Equal(capTime) {
+				next++
+			}
+		} else if !s.ctl.sleep(ctx, s.ctl.period()) {
+			return
+		}
+		if s.ctl.paused() {
+			// original pacing starts over after resume
+			startTime = time.Time{}
+		}
+		if !s.ctl.waitResumed(ctx) {
+			return
+		}
+		s.ctl.published(next-1, s.send(seq, next))
+		for i := seq; i < next; i++ {
+			s.snap.apply(i, s.src.Message(i))
+		}
+		s.src.SetPublished(next)
+		seq = next
+	}
+	log.Printf("end of input at seq %d, sending heartbeats\n", seq)
 	for {
-		p, err := createMoldPacket(s.seq, 1)
-		errs.CheckE(err)
-		log.Printf("send mcast: %v\n", p)
-		n, err := conn.Write(p)
-		errs.CheckE(err)
-		errs.Check(n == len(p), n, len(p))
+		s.heartbeat(seq)
+		if !s.ctl.sleep(ctx, time.Second) {
+			return
+		}
+	}
+}
+func (s *mcastServer) heartbeat(seq int) {
+	p, _, err := createMoldPacket(s.src, seq, 0)
+	errs.CheckE(err)
+	s.write(p)
+}
 
-		delay := time.Duration(1000/s.pps) * time.Millisecond
-		time.Sleep(delay)
-		s.seq++
+// returns number of messages sent
+func (s *mcastServer) send(start, end int) (sent int) {
+	for start < end {
+		stop := start
+		for stop < end && !s.gapCheck(stop) {
+			stop++
+		}
+		for start < stop {
+			p, n, err := createMoldPacket(s.src, start, stop-start)
+			errs.CheckE(err)
+			s.write(p)
+			start += n
+			sent += n
+		}
+		if stop < end {
+			// message dropped by gap simulation
+			log.Printf("gap !!! mcast seq %d\n", stop)
+			start = stop + 1
+		}
 	}
-	defer conn.Close()
+	return
+}
+func (s *mcastServer) write(p []byte) {
+	n, err := s.conn.Write(p)
+	errs.CheckE(err)
+	errs.Check(n == len(p), n, len(p))
+}
+func (s *mcastServer) gapCheck(seq int) (gap bool) {
+	if s.dropped[seq] {
+		return true
+	}
+	if s.gapSize == 0 || s.gapPeriod == 0 {
+		return false
+	}
+	if 0 == seq%s.gapPeriod && 0 == s.gapCnt {
+		s.gapCnt = s.gapSize
+	}
+	if 0 != s.gapCnt {
+		s.gapCnt--
+		return true
+	}
+	return false
 }
 
-func createMoldPacket(startSeqNum, count int) (bs []byte, err error) {
+const moldMaxPacketSize = 1500 - 34
+
+// packs up to count messages that fit in one packet; count 0 makes a heartbeat
+func createMoldPacket(src ittoMessageSource, startSeqNum, count int) (bs []byte, packed int, err error) {
 	defer errs.PassE(&err)
 	type moldUDP64 struct {
 		Session        string `struc:"[10]byte"`
@@ -197,21 +390,28 @@ func createMoldPacket(startSeqNum, count int) (bs []byte, err error) {
 	}
 
 	errs.Check(startSeqNum >= 0)
-	errs.Check(count >= 0 && count < 1000)
-	mh := moldUDP64{
-		Session:        "00TestSess",
-		SequenceNumber: uint64(startSeqNum),
-		MessageCount:   uint16(count),
-	}
+	errs.Check(count >= 0)
 	var bb bytes.Buffer
-	errs.CheckE(struc.Pack(&bb, &mh))
-	for i := 0; i < count; i++ {
+	size := 20
+	for ; packed < count; packed++ {
+		m := src.Message(startSeqNum + packed)
+		if size+2+len(m) >= moldMaxPacketSize && packed > 0 {
+			break
+		}
+		size += 2 + len(m)
 		mb := moldUDP64MessageBlock{
-			Payload: generateIttoMessage(startSeqNum + i),
+			Payload: m,
 		}
 		errs.CheckE(struc.Pack(&bb, &mb))
 	}
-	bs = bb.Bytes()
+	mh := moldUDP64{
+		Session:        src.Session(),
+		SequenceNumber: uint64(startSeqNum),
+		MessageCount:   uint16(packed),
+	}
+	var hb bytes.Buffer
+	errs.CheckE(struc.Pack(&hb, &mh))
+	bs = append(hb.Bytes(), bb.Bytes()...)
 	return
 }
 
@@ -0,0 +1,148 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/go-yaml/yaml"
+	"github.com/ikravets/errs"
+
+	"my/ev/channels"
+)
+
+// one NASDAQ channel: MoldUDP64 session with its own feed, GLIMPSE and rerequest endpoints
+type NasdaqSessionConfig struct {
+	Session       string `yaml:"session"`
+	FeedAddr      string `yaml:"feed"`
+	GlimpseAddr   string `yaml:"glimpse"`
+	RerequestAddr string `yaml:"rerequest"`
+	Speed         int    `yaml:"speed"` // messages per second
+	FirstSeq      int    `yaml:"first_seq"`
+
+	InputFileName    string `yaml:"input"`
+	InputDstAddr     string `yaml:"input_dst"`
+	ScenarioFileName string `yaml:"scenario"`
+
+	// publish activity of matching engine with OUCH order entry instead of input or synthetic messages
+	Match          bool   `yaml:"match"`
+	OrderEntryAddr string `yaml:"order_entry"`
+	Options        int    `yaml:"options"` // number of options traded by matching engine
+
+	OriginalPacing bool   `yaml:"original_pacing"`
+	GapPeriod      uint64 `yaml:"gap_period"` // simulate gap of GapSize messages every GapPeriod messages
+	GapSize        uint64 `yaml:"gap_size"`
+}
+
+// e.g.
+//   - {session: 00TestSess, feed: "233.54.12.1:18001", glimpse: ":16001", rerequest: ":17001", speed: 100}
+//   - {session: 01TestSess, feed: "233.54.12.2:18002", input: ch2.pcap, original_pacing: true, gap_period: 1000, gap_size: 2}
+func LoadNasdaqSessions(r io.Reader) (sessions []NasdaqSessionConfig, err error) {
+	defer errs.PassE(&err)
+	buf, err := ioutil.ReadAll(r)
+	errs.CheckE(err)
+	errs.CheckE(yaml.Unmarshal(buf, &sessions))
+	errs.Check(len(sessions) > 0, "no sessions")
+	return
+}
+
+// explicitly configured sessions with unset fields taken from defaults,
+// or PartNumLimit default sessions
+func (c *Config) nasdaqSessions() (sessions []NasdaqSessionConfig, err error) {
+	defer errs.PassE(&err)
+	num := len(c.NasdaqSessions)
+	if num == 0 {
+		num = c.PartNumLimit
+	}
+	if num == 0 {
+		num = 1
+	}
+	feedAddr := c.FeedAddr
+	var chAddrs []string
+	if feedAddr == "" {
+		cc := channels.NewConfig()
+		errs.CheckE(cc.LoadFromStr("nasdaq"))
+		chAddrs = cc.Addrs()
+		feedAddr = chAddrs[0]
+	}
+	feed, err := net.ResolveUDPAddr("udp", feedAddr)
+	errs.CheckE(err)
+	for i := 0; i < num; i++ {
+		// channel i of FeedAddr 233.54.12.1:18001 is 233.54.12.(1+i):(18001+i), as in channels
+		ip := make(net.IP, len(feed.IP))
+		copy(ip, feed.IP)
+		ip[len(ip)-1] += byte(i)
+		s := NasdaqSessionConfig{
+			Session:        fmt.Sprintf("%02dTestSess", i),
+			FeedAddr:       (&net.UDPAddr{IP: ip, Port: feed.Port + i}).String(),
+			GlimpseAddr:    fmt.Sprintf(":%d", 16001+i),
+			RerequestAddr:  fmt.Sprintf(":%d", 17001+i),
+			Speed:          c.Speed,
+			FirstSeq:       1000,
+			Match:          c.Match,
+			OrderEntryAddr: fmt.Sprintf(":%d", 15001+i),
+			Options:        16,
+			OriginalPacing: c.OriginalPacing,
+			GapPeriod:      c.GapPeriod,
+			GapSize:        c.GapSize,
+		}
+		if i < len(chAddrs) {
+			s.FeedAddr = chAddrs[i]
+		}
+		if i == 0 {
+			s.InputFileName = c.InputFileName
+			s.InputDstAddr = c.InputDstAddr
+			s.ScenarioFileName = c.ScenarioFileName
+		}
+		if i < len(c.NasdaqSessions) {
+			cs := c.NasdaqSessions[i]
+			if cs.Session != "" {
+				s.Session = cs.Session
+			}
+			if cs.FeedAddr != "" {
+				s.FeedAddr = cs.FeedAddr
+			}
+			if cs.GlimpseAddr != "" {
+				s.GlimpseAddr = cs.GlimpseAddr
+			}
+			if cs.RerequestAddr != "" {
+				s.RerequestAddr = cs.RerequestAddr
+			}
+			if cs.Speed != 0 {
+				s.Speed = cs.Speed
+			}
+			if cs.FirstSeq != 0 {
+				s.FirstSeq = cs.FirstSeq
+			}
+			if cs.OrderEntryAddr != "" {
+				s.OrderEntryAddr = cs.OrderEntryAddr
+			}
+			if cs.Options != 0 {
+				s.Options = cs.Options
+			}
+			if cs.GapPeriod != 0 {
+				s.GapPeriod = cs.GapPeriod
+			}
+			if cs.GapSize != 0 {
+				s.GapSize = cs.GapSize
+			}
+			s.OriginalPacing = s.OriginalPacing || cs.OriginalPacing
+			s.Match = s.Match || cs.Match
+			if cs.InputFileName != "" || cs.ScenarioFileName != "" {
+				s.InputFileName = cs.InputFileName
+				s.InputDstAddr = cs.InputDstAddr
+				s.ScenarioFileName = cs.ScenarioFileName
+			}
+		}
+		if s.Speed == 0 {
+			s.Speed = 1
+		}
+		errs.Check(len(s.Session) == 10, "session must be 10 characters", s.Session)
+		sessions = append(sessions, s)
+	}
+	return
+}
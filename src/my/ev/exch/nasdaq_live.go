@@ -0,0 +1,132 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"sync"
+	"time"
+
+	"my/ev/exch/scenario"
+)
+
+// ITTO messages published by matching engine as order activity happens
+type liveIttoMessageSource struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	session   string
+	firstSeq  int
+	messages  [][]byte
+	second    int64
+	published int
+}
+
+func newLiveIttoMessageSource(session string, firstSeq int, options []uint32) *liveIttoMessageSource {
+	s := &liveIttoMessageSource{
+		session:   session,
+		firstSeq:  firstSeq,
+		published: firstSeq,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	var dir []scenario.Option
+	for _, oid := range options {
+		dir = append(dir, scenario.Option{
+			Id:         oid,
+			Underlying: "TEST",
+			Expiration: time.Now().AddDate(0, 1, 0).Format("20060102"),
+			Strike:     float64(oid),
+			Type:       "C",
+		})
+	}
+	s.append(scenario.IttoDirectory(dir)...)
+	return s
+}
+
+func (s *liveIttoMessageSource) Session() string    { return s.session }
+func (s *liveIttoMessageSource) FirstSequence() int { return s.firstSeq }
+func (s *liveIttoMessageSource) EndSequence() int   { return -1 }
+func (s *liveIttoMessageSource) Message(seq int) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.messages[seq-s.firstSeq]
+}
+func (s *liveIttoMessageSource) Time(int) time.Time { return time.Time{} }
+func (s *liveIttoMessageSource) Published() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.published
+}
+func (s *liveIttoMessageSource) SetPublished(seq int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published = seq
+}
+
+func (s *liveIttoMessageSource) append(msgs ...[]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msgs...)
+	s.cond.Broadcast()
+}
+
+// waits until message seq is available; returns sequence number after the last available message
+func (s *liveIttoMessageSource) wait(seq int, timeout time.Duration) (end int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	timer := time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	for seq >= s.firstSeq+len(s.messages) && time.Now().Before(deadline) {
+		s.cond.Wait()
+	}
+	return s.firstSeq + len(s.messages)
+}
+
+// publishes time-stamped events, preceded by seconds message when second changes
+func (s *liveIttoMessageSource) publish(e *scenario.Event) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sec := now.Unix(); sec != s.second {
+		s.second = sec
+		seconds := int(sec % 86400)
+		s.messages = append(s.messages, scenario.IttoMessages(&scenario.Event{Seconds: &seconds}, 0)...)
+	}
+	s.messages = append(s.messages, scenario.IttoMessages(e, uint32(now.Nanosecond()))...)
+	s.cond.Broadcast()
+}
+
+func ittoPrice(p uint32) float64 {
+	return float64(p) / 10000
+}
+
+func (s *liveIttoMessageSource) add(o *matchOrder) {
+	s.publish(&scenario.Event{Add: &scenario.Order{
+		Order:  o.ref,
+		Option: o.option,
+		Side:   string(o.side),
+		Price:  ittoPrice(o.price),
+		Size:   o.size,
+	}})
+}
+func (s *liveIttoMessageSource) replace(prev *matchOrder, o *matchOrder) {
+	s.publish(&scenario.Event{Replace: &scenario.Order{
+		Order:    prev.ref,
+		NewOrder: o.ref,
+		Price:    ittoPrice(o.price),
+		Size:     o.size,
+	}})
+}
+func (s *liveIttoMessageSource) execute(o *matchOrder, size int, match uint32) {
+	s.publish(&scenario.Event{Execute: &scenario.Order{Order: o.ref, Size: size, Match: match}})
+}
+func (s *liveIttoMessageSource) cancel(o *matchOrder, size int) {
+	s.publish(&scenario.Event{Cancel: &scenario.Order{Order: o.ref, Size: size}})
+}
+func (s *liveIttoMessageSource) delete(o *matchOrder) {
+	s.publish(&scenario.Event{Delete: &scenario.Order{Order: o.ref}})
+}
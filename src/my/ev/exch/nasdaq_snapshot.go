@@ -0,0 +1,174 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/ikravets/errs"
+
+	"my/ev/packet"
+	"my/ev/packet/nasdaq"
+	"my/ev/sim"
+)
+
+// market state built by simulator over published messages
+type ittoSnapshotter struct {
+	mu             sync.Mutex
+	simu           sim.Sim
+	flows          []gopacket.Flow
+	nextSeq        int
+	seconds        []byte
+	systemEvents   [][]byte
+	directory      [][]byte
+	directoryOids  []packet.OptionId
+	directoryIndex map[packet.OptionId]int
+	tradingActions map[packet.OptionId][]byte
+	opens          map[packet.OptionId][]byte
+	arrival        map[packet.OrderId]int
+	nextArrival    int
+}
+
+func newIttoSnapshotter(src ittoMessageSource) *ittoSnapshotter {
+	session := []byte(src.Session())
+	return &ittoSnapshotter{
+		simu:           sim.NewSim(false),
+		flows:          []gopacket.Flow{gopacket.NewFlow(nasdaq.EndpointMoldUDP64Session, session, session)},
+		nextSeq:        src.FirstSequence(),
+		directoryIndex: make(map[packet.OptionId]int),
+		tradingActions: make(map[packet.OptionId][]byte),
+		opens:          make(map[packet.OptionId][]byte),
+		arrival:        make(map[packet.OrderId]int),
+	}
+}
+
+func (s *ittoSnapshotter) apply(seq int, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs.Check(seq == s.nextSeq, seq, s.nextSeq)
+	s.nextSeq = seq + 1
+	if len(data) == 0 {
+		return
+	}
+	layer := nasdaq.IttoMessageTypeMetadata[data[0]].CreateLayer()
+	if err := layer.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		log.Printf("snapshot: skip message seq %d: %s\n", seq, err)
+		return
+	}
+	switch m := layer.(type) {
+	case *nasdaq.IttoMessageSeconds:
+		s.seconds = data
+	case *nasdaq.IttoMessageSystemEvent:
+		s.systemEvents = append(s.systemEvents, data)
+	case *nasdaq.IttoMessageOptionDirectory:
+		if i, ok := s.directoryIndex[m.OId]; ok {
+			s.directory[i] = data
+		} else {
+			s.directoryIndex[m.OId] = len(s.directory)
+			s.directory = append(s.directory, data)
+			s.directoryOids = append(s.directoryOids, m.OId)
+		}
+	case *nasdaq.IttoMessageOptionTradingAction:
+		s.tradingActions[m.OId] = data
+	case *nasdaq.IttoMessageOptionOpen:
+		s.opens[m.OId] = data
+	case *nasdaq.IttoMessageAddOrder:
+		s.arrive(m.RefNumD)
+	case *nasdaq.IttoMessageAddQuote:
+		s.arrive(m.Bid.RefNumD)
+		s.arrive(m.Ask.RefNumD)
+	case *nasdaq.IttoMessageSingleSideReplace:
+		delete(s.arrival, m.OrigRefNumD)
+		s.arrive(m.RefNumD)
+	case *nasdaq.IttoMessageQuoteReplace:
+		delete(s.arrival, m.Bid.OrigRefNumD)
+		delete(s.arrival, m.Ask.OrigRefNumD)
+		s.arrive(m.Bid.RefNumD)
+		s.arrive(m.Ask.RefNumD)
+	case *nasdaq.IttoMessageSingleSideDelete:
+		delete(s.arrival, m.OrigRefNumD)
+	case *nasdaq.IttoMessageQuoteDelete:
+		delete(s.arrival, m.BidOrigRefNumD)
+		delete(s.arrival, m.AskOrigRefNumD)
+	case *nasdaq.IttoMessageBlockSingleSideDelete:
+		for _, ref := range m.RefNumDs {
+			delete(s.arrival, ref)
+		}
+	}
+
+	applySimMessage(s.simu, &simAppMessage{layer: layer, flows: s.flows, seq: uint64(seq)})
+}
+
+func (s *ittoSnapshotter) arrive(oid packet.OrderId) {
+	s.arrival[oid] = s.nextArrival
+	s.nextArrival++
+}
+
+// returns snapshot messages and sequence number of the first message not reflected in the snapshot
+func (s *ittoSnapshotter) snapshot() (msgs [][]byte, nextSeq int, err error) {
+	defer errs.PassE(&err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seconds != nil {
+		msgs = append(msgs, s.seconds)
+	}
+	msgs = append(msgs, s.systemEvents...)
+	msgs = append(msgs, s.directory...)
+	for _, oid := range s.directoryOids {
+		if ta, ok := s.tradingActions[oid]; ok {
+			msgs = append(msgs, ta)
+		}
+		if o, ok := s.opens[oid]; ok {
+			msgs = append(msgs, o)
+		}
+	}
+	orders := s.simu.OrderDb().Orders()
+	arrival := make(map[packet.OrderId]int, len(orders))
+	for _, o := range orders {
+		arrival[o.OrderId] = s.arrival[o.OrderId]
+	}
+	s.arrival = arrival
+	sort.Stable(&bookOrderList{orders: orders, arrival: arrival})
+	for _, o := range orders {
+		m := nasdaq.IttoMessageAddOrder{
+			IttoMessageCommon: nasdaq.IttoMessageCommon{Type: nasdaq.IttoMessageTypeAddOrderLong},
+			OId:               o.OptionId,
+			OrderSide: nasdaq.OrderSide{
+				RefNumD: o.OrderId,
+				Side:    o.Side,
+				Price:   o.Price,
+				Size:    o.Size,
+			},
+		}
+		buf := gopacket.NewSerializeBuffer()
+		errs.CheckE(m.SerializeTo(buf, gopacket.SerializeOptions{}))
+		msgs = append(msgs, buf.Bytes())
+	}
+	nextSeq = s.nextSeq
+	return
+}
+
+// book order: best price first, then time priority within a price level
+type bookOrderList struct {
+	orders  []sim.Order
+	arrival map[packet.OrderId]int
+}
+
+func (a *bookOrderList) Len() int      { return len(a.orders) }
+func (a *bookOrderList) Swap(i, j int) { a.orders[i], a.orders[j] = a.orders[j], a.orders[i] }
+func (a *bookOrderList) Less(i, j int) bool {
+	oi, oj := a.orders[i], a.orders[j]
+	switch {
+	case oi.OptionId != oj.OptionId:
+		return oi.OptionId.ToUint64() < oj.OptionId.ToUint64()
+	case oi.Side != oj.Side:
+		return oi.Side == packet.MarketSideBid
+	case oi.Price != oj.Price:
+		return (oi.Price > oj.Price) == (oi.Side == packet.MarketSideBid)
+	}
+	return a.arrival[oi.OrderId] < a.arrival[oj.OrderId]
+}
@@ -0,0 +1,384 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/ikravets/errs"
+
+	"my/ev/exch/scenario"
+	"my/ev/packet"
+	"my/ev/packet/nasdaq"
+)
+
+type ittoMessageSource interface {
+	Session() string
+	FirstSequence() int
+	// sequence number after the last message, or -1 if unlimited
+	EndSequence() int
+	Message(seq int) []byte
+	// packet capture time of the message; zero if unknown
+	Time(seq int) time.Time
+	// sequence number after the last published message
+	Published() int
+	SetPublished(seq int)
+}
+
+type syntheticIttoMessageSource struct {
+	session   string
+	firstSeq  int
+	published int64
+}
+
+func newSyntheticIttoMessageSource(session string, firstSeq int) *syntheticIttoMessageSource {
+	return &syntheticIttoMessageSource{
+		session:   session,
+		firstSeq:  firstSeq,
+		published: int64(firstSeq),
+	}
+}
+func (s *syntheticIttoMessageSource) Session() string        { return s.session }
+func (s *syntheticIttoMessageSource) FirstSequence() int     { return s.firstSeq }
+func (s *syntheticIttoMessageSource) EndSequence() int       { return -1 }
+func (s *syntheticIttoMessageSource) Message(seq int) []byte { return generateIttoMessage(seq) }
+func (s *syntheticIttoMessageSource) Time(int) time.Time     { return time.Time{} }
+func (s *syntheticIttoMessageSource) Published() int {
+	return int(atomic.LoadInt64(&s.published))
+}
+func (s *syntheticIttoMessageSource) SetPublished(seq int) {
+	atomic.StoreInt64(&s.published, int64(seq))
+}
+
+type recordedIttoMessageSource struct {
+	session   string
+	firstSeq  int
+	messages  [][]byte
+	times     []time.Time
+	published int64
+}
+
+func (s *recordedIttoMessageSource) Session() string    { return s.session }
+func (s *recordedIttoMessageSource) FirstSequence() int { return s.firstSeq }
+func (s *recordedIttoMessageSource) EndSequence() int   { return s.firstSeq + len(s.messages) }
+func (s *recordedIttoMessageSource) Message(seq int) []byte {
+	return s.messages[seq-s.firstSeq]
+}
+func (s *recordedIttoMessageSource) Time(seq int) time.Time {
+	return s.times[seq-s.firstSeq]
+}
+func (s *recordedIttoMessageSource) Published() int {
+	return int(atomic.LoadInt64(&s.published))
+}
+func (s *recordedIttoMessageSource) SetPublished(seq int) {
+	atomic.StoreInt64(&s.published, int64(seq))
+}
+
+// reads pcap with MoldUDP64 feed or soupbintcp data stream (as captured from GLIMPSE)
+// only the location of each message is kept in memory, messages are read from the file when served
+func newRecordedIttoMessageSource(fileName string, dstAddr string) (s ittoMessageSource, err error) {
+	defer errs.PassE(&err)
+	var end int
+	if strings.HasSuffix(fileName, ".pcap") {
+		ps, err := newPcapIttoMessageSource(fileName, dstAddr)
+		errs.CheckE(err)
+		s, end = ps, ps.EndSequence()
+	} else {
+		ss, err := newSoupbinIttoMessageSource(fileName)
+		errs.CheckE(err)
+		s, end = ss, ss.EndSequence()
+	}
+	errs.Check(end > s.FirstSequence(), "no ITTO messages found in", fileName)
+	log.Printf("indexed %d messages in %s, session %s seq %d .. %d\n",
+		end-s.FirstSequence(), fileName, s.Session(), s.FirstSequence(), end)
+	return
+}
+
+// compiles scenario to ITTO; returns also sequence numbers of messages not to be sent by multicast
+func newScenarioIttoMessageSource(fileName string) (s *recordedIttoMessageSource, dropped map[int]bool, err error) {
+	defer errs.PassE(&err)
+	file, err := os.Open(fileName)
+	errs.CheckE(err)
+	defer file.Close()
+	sc, err := scenario.Load(file)
+	errs.CheckE(err)
+	feed, err := scenario.Compile(sc, "nasdaq")
+	errs.CheckE(err)
+	s = &recordedIttoMessageSource{
+		session:   feed.Session,
+		firstSeq:  sc.FirstSeq,
+		published: int64(sc.FirstSeq),
+	}
+	dropped = make(map[int]bool)
+	for _, p := range feed.Packets {
+		for i, m := range p.Messages {
+			if p.Dropped {
+				dropped[p.Seq+i] = true
+			}
+			s.messages = append(s.messages, m)
+			s.times = append(s.times, p.Time)
+		}
+	}
+	errs.Check(len(s.messages) > 0, "no ITTO messages in scenario", fileName)
+	log.Printf("compiled %d messages from scenario %s, seq %d .. %d\n",
+		len(s.messages), fileName, s.firstSeq, s.EndSequence())
+	return
+}
+
+// pcap packet with messages not found in previous packets
+type pcapIttoPacket struct {
+	offset int64
+	start  int   // sequence number of the first new message
+	seq    int   // sequence number of the first message in the packet
+	time   int64 // capture time, ns
+}
+
+type pcapIttoMessageSource struct {
+	session   string
+	firstSeq  int
+	endSeq    int
+	published int64
+	dstAddr   string
+	packets   []pcapIttoPacket
+
+	mu       sync.Mutex
+	file     *packet.PcapFile
+	cached   int // index of the packet with messages in cachedMs
+	cachedMs [][]byte
+}
+
+func newPcapIttoMessageSource(fileName string, dstAddr string) (s *pcapIttoMessageSource, err error) {
+	defer errs.PassE(&err)
+	file, err := packet.OpenPcapFile(fileName)
+	errs.CheckE(err)
+	defer func() {
+		if err != nil {
+			file.Close()
+		}
+	}()
+	s = &pcapIttoMessageSource{
+		dstAddr: dstAddr,
+		file:    file,
+		cached:  -1,
+	}
+	var mold nasdaq.MoldUDP64
+	nextSeq := 0
+	for {
+		offset := file.Offset()
+		data, ci, err := file.ZeroCopyReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		errs.CheckE(err)
+		payload, ok := s.moldPayload(data)
+		if !ok {
+			continue
+		}
+		errs.CheckE(mold.DecodeFromBytes(payload, gopacket.NilDecodeFeedback))
+		seq := int(mold.SequenceNumber)
+		if nextSeq == 0 {
+			nextSeq = seq
+			s.firstSeq = seq
+			s.session = mold.Session
+		}
+		if seq+int(mold.MessageCount) <= nextSeq {
+			// heartbeat or duplicate (e.g. from feed B)
+			continue
+		}
+		// messages are served by sequence number, which must stay as captured
+		errs.Check(seq <= nextSeq, "input gap: expected seq, got", nextSeq, seq)
+		s.packets = append(s.packets, pcapIttoPacket{
+			offset: offset,
+			start:  nextSeq,
+			seq:    seq,
+			time:   ci.Timestamp.UnixNano(),
+		})
+		nextSeq = seq + int(mold.MessageCount)
+	}
+	s.endSeq = nextSeq
+	s.published = int64(s.firstSeq)
+	return
+}
+
+// MoldUDP64 payload of UDP packet to dstAddr; the first packet to NASDAQ ports selects dstAddr if not set
+func (s *pcapIttoMessageSource) moldPayload(data []byte) (payload []byte, ok bool) {
+	p := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	ipl, ok := p.NetworkLayer().(*layers.IPv4)
+	if !ok {
+		return
+	}
+	udpl, ok := p.TransportLayer().(*layers.UDP)
+	if !ok {
+		return
+	}
+	dst := (&net.UDPAddr{IP: ipl.DstIP, Port: int(udpl.DstPort)}).String()
+	if s.dstAddr == "" && udpl.DstPort >= 18000 && udpl.DstPort < 18010 {
+		// same port range as in packet processor
+		s.dstAddr = dst
+	}
+	if dst != s.dstAddr || !validMoldUDP64(udpl.Payload) {
+		return nil, false
+	}
+	return udpl.Payload, true
+}
+
+func (s *pcapIttoMessageSource) Session() string    { return s.session }
+func (s *pcapIttoMessageSource) FirstSequence() int { return s.firstSeq }
+func (s *pcapIttoMessageSource) EndSequence() int   { return s.endSeq }
+func (s *pcapIttoMessageSource) packetIndex(seq int) int {
+	errs.Check(seq >= s.firstSeq && seq < s.endSeq, "message is not in input", seq)
+	return sort.Search(len(s.packets), func(i int) bool { return s.packets[i].start > seq }) - 1
+}
+func (s *pcapIttoMessageSource) Message(seq int) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.packetIndex(seq)
+	if i != s.cached {
+		ms, err := s.readPacket(s.packets[i])
+		errs.CheckE(err)
+		s.cached, s.cachedMs = i, ms
+	}
+	return s.cachedMs[seq-s.packets[i].seq]
+}
+func (s *pcapIttoMessageSource) readPacket(ip pcapIttoPacket) (ms [][]byte, err error) {
+	defer errs.PassE(&err)
+	errs.CheckE(s.file.SeekTo(ip.offset))
+	data, _, err := s.file.ZeroCopyReadPacketData()
+	errs.CheckE(err)
+	payload, ok := s.moldPayload(data)
+	errs.Check(ok, "input changed at offset", ip.offset)
+	var mold nasdaq.MoldUDP64
+	errs.CheckE(mold.DecodeFromBytes(payload, gopacket.NilDecodeFeedback))
+	for _, tp := range mold.NextLayers() {
+		m := make([]byte, len(tp.Payload)-2)
+		copy(m, tp.Payload[2:])
+		ms = append(ms, m)
+	}
+	return
+}
+func (s *pcapIttoMessageSource) Time(seq int) time.Time {
+	return time.Unix(0, s.packets[s.packetIndex(seq)].time)
+}
+func (s *pcapIttoMessageSource) Published() int {
+	return int(atomic.LoadInt64(&s.published))
+}
+func (s *pcapIttoMessageSource) SetPublished(seq int) {
+	atomic.StoreInt64(&s.published, int64(seq))
+}
+
+func validMoldUDP64(data []byte) bool {
+	if len(data) < 20 {
+		return false
+	}
+	count := int(binary.BigEndian.Uint16(data[18:20]))
+	data = data[20:]
+	for i := 0; i < count; i++ {
+		if len(data) < 2 {
+			return false
+		}
+		length := int(binary.BigEndian.Uint16(data[0:2])) + 2
+		if length == 2 || len(data) < length {
+			return false
+		}
+		data = data[length:]
+	}
+	return true
+}
+
+// location of sequenced message payload in soupbintcp stream
+type soupbinIttoMessage struct {
+	offset int64
+	size   uint16
+}
+
+type soupbinIttoMessageSource struct {
+	session   string
+	firstSeq  int
+	published int64
+	file      *os.File
+	messages  []soupbinIttoMessage
+}
+
+func newSoupbinIttoMessageSource(fileName string) (s *soupbinIttoMessageSource, err error) {
+	defer errs.PassE(&err)
+	file, err := os.Open(fileName)
+	errs.CheckE(err)
+	defer func() {
+		if err != nil {
+			file.Close()
+		}
+	}()
+	s = &soupbinIttoMessageSource{file: file}
+	r := bufio.NewReader(file)
+	var offset int64
+	loggedIn := false
+	for {
+		var header struct {
+			Size uint16
+			Type byte
+		}
+		err := binary.Read(r, binary.BigEndian, &header)
+		if err == io.EOF {
+			break
+		}
+		errs.CheckE(err)
+		errs.Check(header.Size > 0)
+		offset += 3
+		payload := make([]byte, header.Size-1)
+		_, err = io.ReadFull(r, payload)
+		errs.CheckE(err)
+		switch header.Type {
+		case 'S':
+			if len(payload) > 0 && payload[0] == 'M' {
+				// GLIMPSE end of snapshot
+				break
+			}
+			errs.Check(loggedIn, "sequenced data before login accepted")
+			s.messages = append(s.messages, soupbinIttoMessage{offset: offset, size: uint16(len(payload))})
+		case 'A':
+			// login accepted: session and sequence number of the first message
+			errs.Check(len(payload) >= 30, "short login accepted")
+			errs.Check(len(s.messages) == 0, "login accepted after sequenced data")
+			s.session = string(payload[0:10])
+			s.firstSeq, err = strconv.Atoi(strings.TrimSpace(string(payload[10:30])))
+			errs.CheckE(err)
+			loggedIn = true
+		}
+		offset += int64(len(payload))
+	}
+	s.published = int64(s.firstSeq)
+	return
+}
+
+func (s *soupbinIttoMessageSource) Session() string    { return s.session }
+func (s *soupbinIttoMessageSource) FirstSequence() int { return s.firstSeq }
+func (s *soupbinIttoMessageSource) EndSequence() int   { return s.firstSeq + len(s.messages) }
+func (s *soupbinIttoMessageSource) Message(seq int) []byte {
+	errs.Check(seq >= s.firstSeq && seq < s.EndSequence(), "message is not in input", seq)
+	sm := s.messages[seq-s.firstSeq]
+	m := make([]byte, sm.size)
+	_, err := s.file.ReadAt(m, sm.offset)
+	errs.CheckE(err)
+	return m
+}
+func (s *soupbinIttoMessageSource) Time(int) time.Time { return time.Time{} }
+func (s *soupbinIttoMessageSource) Published() int {
+	return int(atomic.LoadInt64(&s.published))
+}
+func (s *soupbinIttoMessageSource) SetPublished(seq int) {
+	atomic.StoreInt64(&s.published, int64(seq))
+}
@@ -0,0 +1,316 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ikravets/errs"
+
+	"my/ev/exch/sbtcp"
+)
+
+// OUCH-style order entry, all integers big-endian, prices with 4 decimals
+//
+// inbound (unsequenced data):
+//
+//	'O' enter:   token[14] side quantity4 option4 price4 tif
+//	'U' replace: token[14] newToken[14] quantity4 price4
+//	'X' cancel:  token[14] quantity4 (remaining quantity, 0 cancels)
+//
+// outbound (sequenced data), ts8 is nanoseconds since midnight:
+//
+//	'A' accepted: ts8 token[14] side quantity4 option4 price4 tif orderRef8
+//	'U' replaced: ts8 newToken[14] side quantity4 option4 price4 tif orderRef8 token[14]
+//	'E' executed: ts8 token[14] quantity4 price4 liquidity matchNumber8
+//	'C' canceled: ts8 token[14] quantity4 reason
+//	'J' rejected: ts8 token[14] reason
+const ouchTokenSize = 14
+
+const (
+	ouchRejectUnknownOption = 'O'
+	ouchRejectBadOrder      = 'Z'
+	ouchRejectDuplicate     = 'D'
+	ouchRejectUnknownToken  = 'T'
+)
+
+const (
+	// messages waiting to be written, a client falling behind further is disconnected
+	ouchQueueSize    = 4096
+	ouchWriteTimeout = 5 * time.Second
+)
+
+type ouchServer struct {
+	laddr   string
+	session string
+	engine  *matchEngine
+}
+
+func (s *ouchServer) run(ctx context.Context) (err error) {
+	defer errs.PassE(&err)
+	l, err := net.Listen("tcp", s.laddr)
+	errs.CheckE(err)
+	defer l.Close()
+	defer closeOnDone(ctx, l)()
+	for {
+		conn, err := l.Accept()
+		if err != nil && ctx.Err() != nil {
+			return nil
+		}
+		errs.CheckE(err)
+		log.Printf("ouch accepted %s -> %s\n", conn.RemoteAddr(), conn.LocalAddr())
+		c := &ouchClient{
+			conn:   conn,
+			engine: s.engine,
+			out:    make(chan sbtcp.Message, ouchQueueSize),
+			done:   make(chan struct{}),
+			orders: make(map[string]*matchOrder),
+		}
+		go c.run(ctx, s.session)
+	}
+}
+
+type ouchClient struct {
+	conn   net.Conn
+	engine *matchEngine
+	out    chan sbtcp.Message
+	done   chan struct{}
+	mu     sync.Mutex
+	orders map[string]*matchOrder
+}
+
+var _ matchOwner = &ouchClient{}
+
+func (c *ouchClient) run(ctx context.Context, session string) {
+	defer c.conn.Close()
+	defer closeOnDone(ctx, c.conn)()
+	defer errs.Catch(func(ce errs.CheckerError) {
+		log.Printf("ouch client %s: %s\n", c.conn.RemoteAddr(), ce)
+	})
+	defer close(c.done)
+	go c.writeLoop()
+	m, err := sbtcp.ReadMessage(c.conn)
+	errs.CheckE(err)
+	lr, ok := m.(*sbtcp.MessageLoginRequest)
+	errs.Check(ok, "expected login request")
+	log.Printf("ouch login %q\n", lr.Username)
+	c.write(&sbtcp.MessageLoginAccepted{
+		Session:        session,
+		SequenceNumber: 1,
+	})
+	defer c.engine.cancelAll(c)
+
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-t.C:
+				c.write(&sbtcp.MessageHeartbeat{})
+			}
+		}
+	}()
+	for {
+		m, err := sbtcp.ReadMessage(c.conn)
+		errs.CheckE(err)
+		switch m := m.(type) {
+		case *sbtcp.MessageUnsequencedData:
+			c.handle(m.Payload)
+		case *sbtcp.MessageLogout:
+			log.Printf("ouch logout %s\n", c.conn.RemoteAddr())
+			return
+		}
+	}
+}
+
+func (c *ouchClient) handle(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	token := func(off int) string {
+		return string(data[off : off+ouchTokenSize])
+	}
+	u32 := func(off int) uint32 {
+		return binary.BigEndian.Uint32(data[off : off+4])
+	}
+	switch {
+	case data[0] == 'O' && len(data) >= 29:
+		o := &matchOrder{
+			token:  token(1),
+			side:   data[15],
+			size:   int(u32(16)),
+			option: u32(20),
+			price:  u32(24),
+			tif:    data[28],
+			owner:  c,
+		}
+		c.mu.Lock()
+		_, dup := c.orders[o.token]
+		if !dup {
+			c.orders[o.token] = o
+		}
+		c.mu.Unlock()
+		if dup {
+			c.reject(o.token, ouchRejectDuplicate)
+			return
+		}
+		if err := c.engine.enter(o); err != nil {
+			c.forget(o.token)
+			c.reject(o.token, ouchRejectReason(err))
+		}
+	case data[0] == 'U' && len(data) >= 37:
+		prev, ok := c.order(token(1))
+		if !ok {
+			c.reject(token(15), ouchRejectUnknownToken)
+			return
+		}
+		o := &matchOrder{
+			token: token(15),
+			size:  int(u32(29)),
+			price: u32(33),
+		}
+		c.mu.Lock()
+		_, dup := c.orders[o.token]
+		if !dup {
+			c.orders[o.token] = o
+		}
+		c.mu.Unlock()
+		if dup {
+			c.reject(o.token, ouchRejectDuplicate)
+			return
+		}
+		// prev is left intact by rejected replace
+		if err := c.engine.replace(prev, o); err != nil {
+			c.forget(o.token)
+			c.reject(o.token, ouchRejectReason(err))
+		}
+	case data[0] == 'X' && len(data) >= 19:
+		o, ok := c.order(token(1))
+		if !ok {
+			c.reject(token(1), ouchRejectUnknownToken)
+			return
+		}
+		c.engine.cancel(o, int(u32(15)))
+	default:
+		log.Printf("ouch ignore message %q\n", data)
+	}
+}
+
+func ouchRejectReason(err error) byte {
+	if err == matchUnknownOption {
+		return ouchRejectUnknownOption
+	}
+	return ouchRejectBadOrder
+}
+
+func (c *ouchClient) order(token string) (o *matchOrder, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	o, ok = c.orders[token]
+	return
+}
+
+// drops token of rejected order, so it can not be canceled or replaced
+func (c *ouchClient) forget(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.orders, token)
+}
+
+// queues message without blocking, so that a slow client does not stall the matching engine
+func (c *ouchClient) write(m sbtcp.Message) {
+	select {
+	case <-c.done:
+	case c.out <- m:
+	default:
+		log.Printf("ouch client %s: output queue full, disconnecting\n", c.conn.RemoteAddr())
+		c.conn.Close()
+	}
+}
+
+func (c *ouchClient) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case m := <-c.out:
+			err := c.conn.SetWriteDeadline(time.Now().Add(ouchWriteTimeout))
+			if err == nil {
+				err = sbtcp.WriteMessage(c.conn, m)
+			}
+			if err != nil {
+				log.Printf("ouch write to %s: %s\n", c.conn.RemoteAddr(), err)
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// sequenced data message of given size with type, timestamp and token
+func ouchMessage(typ byte, size int, token string) []byte {
+	now := time.Now()
+	y, mo, d := now.Date()
+	midnight := time.Date(y, mo, d, 0, 0, 0, 0, now.Location())
+	m := make([]byte, size)
+	m[0] = typ
+	binary.BigEndian.PutUint64(m[1:9], uint64(now.Sub(midnight)))
+	copy(m[9:9+ouchTokenSize], strings.Repeat(" ", ouchTokenSize))
+	copy(m[9:9+ouchTokenSize], token)
+	return m
+}
+
+func (c *ouchClient) send(m []byte) {
+	sd := sbtcp.MessageSequencedData{}
+	sd.SetPayload(m)
+	c.write(&sd)
+}
+
+func ouchPutOrder(m []byte, o *matchOrder) {
+	m[23] = o.side
+	binary.BigEndian.PutUint32(m[24:28], uint32(o.size))
+	binary.BigEndian.PutUint32(m[28:32], o.option)
+	binary.BigEndian.PutUint32(m[32:36], o.price)
+	m[36] = o.tif
+	binary.BigEndian.PutUint64(m[37:45], uint64(o.ref))
+}
+
+func (c *ouchClient) accepted(o *matchOrder) {
+	m := ouchMessage('A', 45, o.token)
+	ouchPutOrder(m, o)
+	c.send(m)
+}
+func (c *ouchClient) replaced(o *matchOrder, prev *matchOrder) {
+	m := ouchMessage('U', 59, o.token)
+	ouchPutOrder(m, o)
+	copy(m[45:59], prev.token)
+	c.send(m)
+}
+func (c *ouchClient) executed(o *matchOrder, size int, price uint32, match uint32, liquidity byte) {
+	m := ouchMessage('E', 40, o.token)
+	binary.BigEndian.PutUint32(m[23:27], uint32(size))
+	binary.BigEndian.PutUint32(m[27:31], price)
+	m[31] = liquidity
+	binary.BigEndian.PutUint64(m[32:40], uint64(match))
+	c.send(m)
+}
+func (c *ouchClient) canceled(o *matchOrder, size int, reason byte) {
+	m := ouchMessage('C', 28, o.token)
+	binary.BigEndian.PutUint32(m[23:27], uint32(size))
+	m[27] = reason
+	c.send(m)
+}
+func (c *ouchClient) reject(token string, reason byte) {
+	m := ouchMessage('J', 24, token)
+	m[23] = reason
+	c.send(m)
+}
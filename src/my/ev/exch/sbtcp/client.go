@@ -0,0 +1,163 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package sbtcp
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ikravets/errs"
+)
+
+type ClientConfig struct {
+	Addr     string
+	Username string
+	Password string
+	Session  string // blank for currently active session
+	// next sequence number to receive, 0 to receive only new messages
+	Sequence  int
+	Timeout   time.Duration // connect, login and server heartbeat timeout, default 15s
+	Heartbeat time.Duration // client heartbeat interval, default 1s
+}
+
+// SoupBinTCP client receiving sequenced data of one session
+type Client struct {
+	config   ClientConfig
+	conn     net.Conn
+	session  string
+	sequence int // of the next sequenced message
+	ended    bool
+	wmu      sync.Mutex
+}
+
+// connects and logs in
+func Dial(config ClientConfig) (c *Client, err error) {
+	defer errs.PassE(&err)
+	if config.Timeout <= 0 {
+		config.Timeout = 15 * time.Second
+	}
+	if config.Heartbeat <= 0 {
+		config.Heartbeat = time.Second
+	}
+	conn, err := net.DialTimeout("tcp", config.Addr, config.Timeout)
+	errs.CheckE(err)
+	c = &Client{
+		config: config,
+		conn:   conn,
+	}
+	if err = c.login(); err != nil {
+		conn.Close()
+		errs.CheckE(err)
+	}
+	return
+}
+
+func (c *Client) login() (err error) {
+	defer errs.PassE(&err)
+	errs.CheckE(c.write(&MessageLoginRequest{
+		Username:       c.config.Username,
+		Password:       c.config.Password,
+		Session:        c.config.Session,
+		SequenceNumber: c.config.Sequence,
+	}))
+	errs.CheckE(c.conn.SetReadDeadline(time.Now().Add(c.config.Timeout)))
+	m, err := ReadMessage(c.conn)
+	errs.CheckE(err)
+	switch m := m.(type) {
+	case *MessageLoginAccepted:
+		c.session = strings.TrimSpace(strings.Trim(m.Session, "\x00"))
+		c.sequence = m.SequenceNumber
+	case *MessageLoginRejected:
+		errs.Check(false, "login rejected", string(m.Reason))
+	default:
+		errs.Check(false, "unexpected login response", m)
+	}
+	log.Printf("soupbintcp %s: logged in session %q, seq %d\n", c.config.Addr, c.session, c.sequence)
+	return
+}
+
+func (c *Client) write(m Message) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return WriteMessage(c.conn, m)
+}
+
+// session accepted by server
+func (c *Client) Session() string {
+	return c.session
+}
+
+// sequence number of the next sequenced message
+func (c *Client) Sequence() int {
+	return c.sequence
+}
+
+// passes sequenced data to f until end of session, server disconnect or ctx is done; sends heartbeats meanwhile
+func (c *Client) Run(ctx context.Context, f func(seq int, data []byte) error) (err error) {
+	defer errs.PassE(&err)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(c.config.Heartbeat)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				// unblock read
+				c.conn.SetReadDeadline(time.Now())
+				return
+			case <-t.C:
+				if err := c.write(&MessageClientHeartbeat{}); err != nil {
+					log.Printf("soupbintcp %s: heartbeat: %s\n", c.config.Addr, err)
+					return
+				}
+			}
+		}
+	}()
+	for {
+		errs.CheckE(c.conn.SetReadDeadline(time.Now().Add(c.config.Timeout)))
+		m, err := ReadMessage(c.conn)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == io.EOF {
+			log.Printf("soupbintcp %s: disconnected at seq %d\n", c.config.Addr, c.sequence)
+			c.ended = true
+			return nil
+		}
+		errs.CheckE(err)
+		switch m := m.(type) {
+		case *MessageSequencedData:
+			errs.CheckE(f(c.sequence, m.Payload))
+			c.sequence++
+		case *MessageEnd:
+			log.Printf("soupbintcp %s: end of session at seq %d\n", c.config.Addr, c.sequence)
+			c.ended = true
+			return nil
+		case *MessageDebug:
+			log.Printf("soupbintcp %s: debug %q\n", c.config.Addr, m.Payload)
+		case *MessageHeartbeat:
+		default:
+			log.Printf("soupbintcp %s: unexpected %#v\n", c.config.Addr, m)
+		}
+	}
+}
+
+// logs out unless server ended the session, and disconnects
+func (c *Client) Close() error {
+	if c.ended {
+		return c.conn.Close()
+	}
+	if err := c.write(&MessageLogout{}); err != nil {
+		log.Printf("soupbintcp %s: logout: %s\n", c.config.Addr, err)
+	}
+	return c.conn.Close()
+}
@@ -153,6 +153,10 @@ func (m *MessageLoginRequest) decodePayload() (err error) {
 	m.SequenceNumber, err = strconv.Atoi(strings.TrimSpace(string(m.Payload[26:46])))
 	return
 }
+func (m *MessageLoginRequest) encodePayload() (err error) {
+	m.Payload = []byte(fmt.Sprintf("%-6.6s%-10.10s%-10.10s%20d", m.Username, m.Password, m.Session, m.SequenceNumber))
+	return nil
+}
 
 type MessageUnsequencedData struct {
 	MessageCommon
@@ -171,9 +175,8 @@ func ReadMessage(r io.Reader) (m Message, err error) {
 	var mc MessageCommon
 	errs.CheckE(binary.Read(r, binary.BigEndian, &mc.Header))
 	mc.Payload = make([]byte, mc.Header.Length-1)
-	n, err := r.Read(mc.Payload)
+	_, err = io.ReadFull(r, mc.Payload)
 	errs.CheckE(err)
-	errs.Check(n == len(mc.Payload), n, len(mc.Payload))
 	switch mc.Header.Type {
 	case TypeDebug:
 		m = &MessageDebug{}
@@ -0,0 +1,187 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package scenario
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// NASDAQ ITTO, long forms of order messages
+type ittoEncoder struct{}
+
+// ITTO messages of the event, for publishing order activity not described by a scenario
+func IttoMessages(e *Event, ts uint32) [][]byte {
+	return (&ittoEncoder{}).event(e, ts)
+}
+
+// ITTO option directory messages
+func IttoDirectory(options []Option) [][]byte {
+	return (&ittoEncoder{}).definitions(&Scenario{Options: options})
+}
+
+func ittoMessage(typ byte, size int, ts uint32) []byte {
+	m := make([]byte, size)
+	m[0] = typ
+	binary.BigEndian.PutUint32(m[1:5], ts)
+	return m
+}
+
+func (_ *ittoEncoder) definitions(s *Scenario) (msgs [][]byte) {
+	for _, o := range s.Options {
+		m := ittoMessage('R', 40, 0)
+		binary.BigEndian.PutUint32(m[5:9], o.Id)
+		copy(m[9:15], padded(o.Underlying, 6))
+		if len(o.Expiration) == 8 {
+			y, _ := strconv.Atoi(o.Expiration[0:4])
+			mo, _ := strconv.Atoi(o.Expiration[4:6])
+			d, _ := strconv.Atoi(o.Expiration[6:8])
+			m[15], m[16], m[17] = byte(y-2000), byte(mo), byte(d)
+		}
+		binary.BigEndian.PutUint32(m[18:22], price4(o.Strike))
+		m[22] = 'C'
+		if o.Type == "P" {
+			m[22] = 'P'
+		}
+		copy(m[24:37], padded(o.Underlying, 13))
+		m[37] = 'N'
+		m[38] = 'Y'
+		m[39] = 'S'
+		msgs = append(msgs, m)
+	}
+	return
+}
+
+func (_ *ittoEncoder) event(e *Event, ts uint32) (msgs [][]byte) {
+	add := func(m []byte) {
+		msgs = append(msgs, m)
+	}
+	switch {
+	case e.Seconds != nil:
+		m := make([]byte, 5)
+		m[0] = 'T'
+		binary.BigEndian.PutUint32(m[1:5], uint32(*e.Seconds))
+		add(m)
+	case e.Session != "":
+		m := ittoMessage('S', 6, ts)
+		m[5] = 'O'
+		if e.Session == "end" {
+			m[5] = 'C'
+		}
+		add(m)
+	case e.Add != nil:
+		o := e.Add
+		m := ittoMessage('A', 22, ts)
+		binary.BigEndian.PutUint32(m[5:9], o.Order)
+		m[9] = sideByte(o.Side)
+		binary.BigEndian.PutUint32(m[10:14], o.Option)
+		binary.BigEndian.PutUint32(m[14:18], price4(o.Price))
+		binary.BigEndian.PutUint32(m[18:22], uint32(o.Size))
+		add(m)
+	case e.Replace != nil:
+		o := e.Replace
+		newOrder := o.NewOrder
+		if newOrder == 0 {
+			newOrder = o.Order
+		}
+		m := ittoMessage('U', 21, ts)
+		binary.BigEndian.PutUint32(m[5:9], o.Order)
+		binary.BigEndian.PutUint32(m[9:13], newOrder)
+		binary.BigEndian.PutUint32(m[13:17], price4(o.Price))
+		binary.BigEndian.PutUint32(m[17:21], uint32(o.Size))
+		add(m)
+	case e.Execute != nil:
+		o := e.Execute
+		m := ittoMessage('E', 21, ts)
+		binary.BigEndian.PutUint32(m[5:9], o.Order)
+		binary.BigEndian.PutUint32(m[9:13], uint32(o.Size))
+		binary.BigEndian.PutUint32(m[17:21], o.Match)
+		add(m)
+	case e.Cancel != nil:
+		m := ittoMessage('X', 13, ts)
+		binary.BigEndian.PutUint32(m[5:9], e.Cancel.Order)
+		binary.BigEndian.PutUint32(m[9:13], uint32(e.Cancel.Size))
+		add(m)
+	case e.Delete != nil:
+		m := ittoMessage('D', 9, ts)
+		binary.BigEndian.PutUint32(m[5:9], e.Delete.Order)
+		add(m)
+	case e.Quote != nil:
+		q := e.Quote
+		m := ittoMessage('J', 33, ts)
+		binary.BigEndian.PutUint32(m[5:9], q.Bid)
+		binary.BigEndian.PutUint32(m[9:13], q.Ask)
+		binary.BigEndian.PutUint32(m[13:17], q.Option)
+		binary.BigEndian.PutUint32(m[17:21], price4(q.BidPrice))
+		binary.BigEndian.PutUint32(m[21:25], uint32(q.BidSize))
+		binary.BigEndian.PutUint32(m[25:29], price4(q.AskPrice))
+		binary.BigEndian.PutUint32(m[29:33], uint32(q.AskSize))
+		add(m)
+	case e.QuoteReplace != nil:
+		q := e.QuoteReplace
+		newBid, newAsk := q.NewBid, q.NewAsk
+		if newBid == 0 {
+			newBid = q.Bid
+		}
+		if newAsk == 0 {
+			newAsk = q.Ask
+		}
+		m := ittoMessage('K', 37, ts)
+		binary.BigEndian.PutUint32(m[5:9], q.Bid)
+		binary.BigEndian.PutUint32(m[9:13], newBid)
+		binary.BigEndian.PutUint32(m[13:17], q.Ask)
+		binary.BigEndian.PutUint32(m[17:21], newAsk)
+		binary.BigEndian.PutUint32(m[21:25], price4(q.BidPrice))
+		binary.BigEndian.PutUint32(m[25:29], uint32(q.BidSize))
+		binary.BigEndian.PutUint32(m[29:33], price4(q.AskPrice))
+		binary.BigEndian.PutUint32(m[33:37], uint32(q.AskSize))
+		add(m)
+	case e.QuoteDelete != nil:
+		m := ittoMessage('Y', 13, ts)
+		binary.BigEndian.PutUint32(m[5:9], e.QuoteDelete.Bid)
+		binary.BigEndian.PutUint32(m[9:13], e.QuoteDelete.Ask)
+		add(m)
+	case e.BlockDelete != nil:
+		refs := e.BlockDelete.Orders
+		m := ittoMessage('Z', 7+4*len(refs), ts)
+		binary.BigEndian.PutUint16(m[5:7], uint16(len(refs)))
+		for i, ref := range refs {
+			binary.BigEndian.PutUint32(m[7+4*i:], ref)
+		}
+		add(m)
+	case e.Trade != nil:
+		t := e.Trade
+		m := ittoMessage('P', 26, ts)
+		m[5] = sideByte(t.Side)
+		binary.BigEndian.PutUint32(m[6:10], t.Option)
+		binary.BigEndian.PutUint32(m[14:18], t.Match)
+		binary.BigEndian.PutUint32(m[18:22], price4(t.Price))
+		binary.BigEndian.PutUint32(m[22:26], uint32(t.Size))
+		add(m)
+	case e.Bust != nil:
+		m := ittoMessage('B', 13, ts)
+		binary.BigEndian.PutUint32(m[9:13], e.Bust.Match)
+		add(m)
+	case e.Halt != nil, e.Resume != nil:
+		m := ittoMessage('H', 11, ts)
+		if e.Halt != nil {
+			binary.BigEndian.PutUint32(m[5:9], e.Halt.Option)
+			m[9] = 'H'
+		} else {
+			binary.BigEndian.PutUint32(m[5:9], e.Resume.Option)
+			m[9] = 'T'
+		}
+		add(m)
+	}
+	return
+}
+
+func padded(s string, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, s)
+	return b
+}
@@ -0,0 +1,146 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package scenario
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/ikravets/errs"
+
+	"my/ev/rec"
+)
+
+var feedDstIP = net.IP{233, 54, 12, 1}
+
+// destination ports are within the ranges recognized by packet processor
+var feedPorts = map[string]layers.UDPPort{
+	"nasdaq": 18001,
+	"bats":   30101,
+	"miax":   51001,
+}
+
+// UDP payload of a packet: MoldUDP64, BATS sequenced unit or MACH
+func (f *Feed) Payload(p *Packet) []byte {
+	var data []byte
+	switch f.Protocol {
+	case "nasdaq":
+		data = make([]byte, 20)
+		copy(data[0:10], f.Session)
+		binary.BigEndian.PutUint64(data[10:18], uint64(p.Seq))
+		binary.BigEndian.PutUint16(data[18:20], uint16(len(p.Messages)))
+		for _, m := range p.Messages {
+			var l [2]byte
+			binary.BigEndian.PutUint16(l[:], uint16(len(m)))
+			data = append(data, l[:]...)
+			data = append(data, m...)
+		}
+	case "bats":
+		data = make([]byte, 8)
+		data[2] = byte(len(p.Messages))
+		data[3] = 1
+		binary.LittleEndian.PutUint32(data[4:8], uint32(p.Seq))
+		for _, m := range p.Messages {
+			data = append(data, m...)
+		}
+		binary.LittleEndian.PutUint16(data[0:2], uint16(len(data)))
+	case "miax":
+		for i, m := range p.Messages {
+			h := make([]byte, 12)
+			binary.LittleEndian.PutUint64(h[0:8], uint64(p.Seq+i))
+			binary.LittleEndian.PutUint16(h[8:10], uint16(12+len(m)))
+			h[10] = 3
+			h[11] = 1
+			data = append(data, h...)
+			data = append(data, m...)
+		}
+	}
+	return data
+}
+
+// writes packets sent by multicast; dropped packets are omitted
+func WritePcap(w io.Writer, f *Feed) (err error) {
+	defer errs.PassE(&err)
+	pw := pcapgo.NewWriter(w)
+	errs.CheckE(pw.WriteFileHeader(65536, layers.LinkTypeEthernet))
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr([]byte{0, 22, 33, 44, 55, 66}),
+		DstMAC:       net.HardwareAddr([]byte{1, 0, 0x5e, 0, 0, 1}),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		SrcIP:    net.IP{1, 2, 3, 4},
+		DstIP:    feedDstIP,
+		TTL:      1,
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp := &layers.UDP{
+		SrcPort: 1,
+		DstPort: feedPorts[f.Protocol],
+	}
+	errs.CheckE(udp.SetNetworkLayerForChecksum(ip))
+	sb := gopacket.NewSerializeBuffer()
+	so := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	for i := range f.Packets {
+		p := &f.Packets[i]
+		if p.Dropped {
+			continue
+		}
+		errs.CheckE(gopacket.SerializeLayers(sb, so, eth, ip, udp, gopacket.Payload(f.Payload(p))))
+		ci := gopacket.CaptureInfo{
+			Timestamp:     p.Time,
+			CaptureLength: len(sb.Bytes()),
+			Length:        len(sb.Bytes()),
+		}
+		errs.CheckE(pw.WritePacket(ci, sb.Bytes()))
+	}
+	return
+}
+
+// multicast channel of WritePcap output, as accepted by channels.Config
+func (f *Feed) Channel() string {
+	return fmt.Sprintf("%s:%d", feedDstIP, feedPorts[f.Protocol])
+}
+
+// checks EFH dump messages against expected ones; only fields present in an expected message are compared
+func (s *Scenario) CheckExpected(dump io.Reader) (err error) {
+	defer errs.PassE(&err)
+	exp, err := rec.NewEfhDumpReader(strings.NewReader(strings.Join(s.Expect, "\n")))
+	errs.CheckE(err)
+	act, err := rec.NewEfhDumpReader(dump)
+	errs.CheckE(err)
+	for i := 0; ; i++ {
+		em, eerr := exp.ReadMessage()
+		am, aerr := act.ReadMessage()
+		if eerr == io.EOF && aerr == io.EOF {
+			return
+		}
+		if eerr != io.EOF {
+			errs.CheckE(eerr)
+		}
+		if aerr != io.EOF {
+			errs.CheckE(aerr)
+		}
+		if eerr == io.EOF {
+			return fmt.Errorf("unexpected message #%d: %s", i, am.Text)
+		}
+		if aerr == io.EOF {
+			return fmt.Errorf("missing message #%d: %s", i, em.Text)
+		}
+		for _, f := range em.Fields {
+			v, ok := am.Field(f.Name)
+			errs.Check(ok && v == f.Value, fmt.Sprintf("message #%d: %s\nexpected %s", i, am.Text, em.Text))
+		}
+	}
+}
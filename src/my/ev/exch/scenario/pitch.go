@@ -0,0 +1,145 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package scenario
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BATS PITCH, long forms of order messages
+type pitchEncoder struct {
+	book *book
+}
+
+func newPitchEncoder() *pitchEncoder {
+	return &pitchEncoder{book: newBook()}
+}
+
+func pitchMessage(typ byte, size int, ts uint32) []byte {
+	m := make([]byte, size)
+	m[0] = byte(size)
+	m[1] = typ
+	binary.LittleEndian.PutUint32(m[2:6], ts)
+	return m
+}
+
+func pitchSymbol(option uint32) []byte {
+	return []byte(fmt.Sprintf("%06d", option))
+}
+
+func pitchAdd(ts, id, option uint32, side byte, price float64, size int) []byte {
+	m := pitchMessage(0x21, 34, ts)
+	binary.LittleEndian.PutUint64(m[6:14], uint64(id))
+	m[14] = side
+	binary.LittleEndian.PutUint32(m[15:19], uint32(size))
+	copy(m[19:25], pitchSymbol(option))
+	binary.LittleEndian.PutUint64(m[25:33], uint64(price4(price)))
+	return m
+}
+
+func pitchDelete(ts, id uint32) []byte {
+	m := pitchMessage(0x29, 14, ts)
+	binary.LittleEndian.PutUint64(m[6:14], uint64(id))
+	return m
+}
+
+func pitchReduce(ts, id uint32, size int) []byte {
+	m := pitchMessage(0x25, 18, ts)
+	binary.LittleEndian.PutUint64(m[6:14], uint64(id))
+	binary.LittleEndian.PutUint32(m[14:18], uint32(size))
+	return m
+}
+
+func (pe *pitchEncoder) replace(ts, id, newId uint32, price float64, size int) [][]byte {
+	if newId == 0 || newId == id {
+		m := pitchMessage(0x27, 27, ts)
+		binary.LittleEndian.PutUint64(m[6:14], uint64(id))
+		binary.LittleEndian.PutUint32(m[14:18], uint32(size))
+		binary.LittleEndian.PutUint64(m[18:26], uint64(price4(price)))
+		return [][]byte{m}
+	}
+	o, ok := pe.book.orders[id]
+	if !ok {
+		return [][]byte{pitchDelete(ts, id)}
+	}
+	return [][]byte{pitchDelete(ts, id), pitchAdd(ts, newId, o.option, o.side, price, size)}
+}
+
+// PITCH has no option definitions
+func (_ *pitchEncoder) definitions(s *Scenario) [][]byte {
+	return nil
+}
+
+func (pe *pitchEncoder) event(e *Event, ts uint32) (msgs [][]byte) {
+	add := func(m ...[]byte) {
+		msgs = append(msgs, m...)
+	}
+	switch {
+	case e.Seconds != nil:
+		m := make([]byte, 6)
+		m[0], m[1] = 6, 0x20
+		binary.LittleEndian.PutUint32(m[2:6], uint32(*e.Seconds))
+		add(m)
+	case e.Session == "end":
+		add(pitchMessage(0x2d, 6, ts))
+	case e.Add != nil:
+		o := e.Add
+		add(pitchAdd(ts, o.Order, o.Option, sideByte(o.Side), o.Price, o.Size))
+	case e.Replace != nil:
+		o := e.Replace
+		add(pe.replace(ts, o.Order, o.NewOrder, o.Price, o.Size)...)
+	case e.Execute != nil:
+		o := e.Execute
+		m := pitchMessage(0x23, 26, ts)
+		binary.LittleEndian.PutUint64(m[6:14], uint64(o.Order))
+		binary.LittleEndian.PutUint32(m[14:18], uint32(o.Size))
+		binary.LittleEndian.PutUint64(m[18:26], uint64(o.Match))
+		add(m)
+	case e.Cancel != nil:
+		add(pitchReduce(ts, e.Cancel.Order, e.Cancel.Size))
+	case e.Delete != nil:
+		add(pitchDelete(ts, e.Delete.Order))
+	case e.Quote != nil:
+		q := e.Quote
+		add(pitchAdd(ts, q.Bid, q.Option, 'B', q.BidPrice, q.BidSize))
+		add(pitchAdd(ts, q.Ask, q.Option, 'S', q.AskPrice, q.AskSize))
+	case e.QuoteReplace != nil:
+		q := e.QuoteReplace
+		add(pe.replace(ts, q.Bid, q.NewBid, q.BidPrice, q.BidSize)...)
+		add(pe.replace(ts, q.Ask, q.NewAsk, q.AskPrice, q.AskSize)...)
+	case e.QuoteDelete != nil:
+		add(pitchDelete(ts, e.QuoteDelete.Bid), pitchDelete(ts, e.QuoteDelete.Ask))
+	case e.BlockDelete != nil:
+		for _, id := range e.BlockDelete.Orders {
+			add(pitchDelete(ts, id))
+		}
+	case e.Trade != nil:
+		t := e.Trade
+		m := pitchMessage(0x2a, 41, ts)
+		m[14] = sideByte(t.Side)
+		binary.LittleEndian.PutUint32(m[15:19], uint32(t.Size))
+		copy(m[19:25], pitchSymbol(t.Option))
+		binary.LittleEndian.PutUint64(m[25:33], uint64(price4(t.Price)))
+		binary.LittleEndian.PutUint64(m[33:41], uint64(t.Match))
+		add(m)
+	case e.Bust != nil:
+		m := pitchMessage(0x2c, 14, ts)
+		binary.LittleEndian.PutUint64(m[6:14], uint64(e.Bust.Match))
+		add(m)
+	case e.Halt != nil, e.Resume != nil:
+		m := pitchMessage(0x31, 18, ts)
+		if e.Halt != nil {
+			copy(m[6:14], pitchSymbol(e.Halt.Option))
+			m[14] = 'H'
+		} else {
+			copy(m[6:14], pitchSymbol(e.Resume.Option))
+			m[14] = 'T'
+		}
+		m[15] = '0'
+		add(m)
+	}
+	pe.book.apply(e)
+	return
+}
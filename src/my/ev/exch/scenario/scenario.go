@@ -0,0 +1,342 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package scenario
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"time"
+
+	"github.com/go-yaml/yaml"
+	"github.com/ikravets/errs"
+)
+
+// protocol-neutral description of market events, e.g.
+//
+//	options:
+//	  - {id: 1, underlying: AAPL, expiration: "20161216", strike: 100, type: C}
+//	events:
+//	  - seconds: 34200
+//	  - add: {order: 1, option: 1, side: B, price: 1.25, size: 10}
+//	  - replace: {order: 7, new_order: 8, price: 1.3, size: 5}
+//	  - gap: 1
+//	  - delete: {order: 1}
+//	expect:
+//	  - "HDR{T:3} ORD{OS:+1, P:12500, S:10}"
+type Scenario struct {
+	Name     string   `yaml:"name"`
+	Session  string   `yaml:"session"`
+	FirstSeq int      `yaml:"first_seq"`
+	Options  []Option `yaml:"options"`
+	Events   []Event  `yaml:"events"`
+	// expected EFH output in text form, see rec.EfhDumpReader; omitted fields are not compared
+	Expect []string `yaml:"expect"`
+}
+
+type Option struct {
+	Id         uint32  `yaml:"id"`
+	Underlying string  `yaml:"underlying"`
+	Expiration string  `yaml:"expiration"` // YYYYMMDD
+	Strike     float64 `yaml:"strike"`
+	Type       string  `yaml:"type"` // C or P
+}
+
+type Order struct {
+	Order    uint32  `yaml:"order"`
+	NewOrder uint32  `yaml:"new_order"` // replace only; zero keeps order id
+	Option   uint32  `yaml:"option"`
+	Side     string  `yaml:"side"` // B or S
+	Price    float64 `yaml:"price"`
+	Size     int     `yaml:"size"`
+	Match    uint32  `yaml:"match"` // execute only
+}
+
+type Quote struct {
+	Option   uint32  `yaml:"option"`
+	Bid      uint32  `yaml:"bid"`
+	Ask      uint32  `yaml:"ask"`
+	NewBid   uint32  `yaml:"new_bid"`
+	NewAsk   uint32  `yaml:"new_ask"`
+	BidPrice float64 `yaml:"bid_price"`
+	BidSize  int     `yaml:"bid_size"`
+	AskPrice float64 `yaml:"ask_price"`
+	AskSize  int     `yaml:"ask_size"`
+}
+
+type BlockDelete struct {
+	Orders []uint32 `yaml:"orders"`
+}
+
+type Trade struct {
+	Option uint32  `yaml:"option"`
+	Side   string  `yaml:"side"`
+	Price  float64 `yaml:"price"`
+	Size   int     `yaml:"size"`
+	Match  uint32  `yaml:"match"`
+}
+
+type Status struct {
+	Option uint32 `yaml:"option"`
+}
+
+// exactly one field must be set
+type Event struct {
+	Seconds      *int         `yaml:"seconds"`
+	Session      string       `yaml:"session"` // start or end
+	Add          *Order       `yaml:"add"`
+	Replace      *Order       `yaml:"replace"`
+	Execute      *Order       `yaml:"execute"`
+	Cancel       *Order       `yaml:"cancel"`
+	Delete       *Order       `yaml:"delete"`
+	Quote        *Quote       `yaml:"quote"`
+	QuoteReplace *Quote       `yaml:"quote_replace"`
+	QuoteDelete  *Quote       `yaml:"quote_delete"`
+	BlockDelete  *BlockDelete `yaml:"block_delete"`
+	Trade        *Trade       `yaml:"trade"`
+	Bust         *Trade       `yaml:"bust"`
+	Halt         *Status      `yaml:"halt"`
+	Resume       *Status      `yaml:"resume"`
+	Gap          int          `yaml:"gap"` // number of following events not sent by multicast
+}
+
+func (e *Event) kinds() (n int) {
+	for _, set := range []bool{
+		e.Seconds != nil, e.Session != "", e.Add != nil, e.Replace != nil, e.Execute != nil,
+		e.Cancel != nil, e.Delete != nil, e.Quote != nil, e.QuoteReplace != nil, e.QuoteDelete != nil,
+		e.BlockDelete != nil, e.Trade != nil, e.Bust != nil, e.Halt != nil, e.Resume != nil, e.Gap != 0,
+	} {
+		if set {
+			n++
+		}
+	}
+	return
+}
+
+func Load(r io.Reader) (s *Scenario, err error) {
+	defer errs.PassE(&err)
+	buf, err := ioutil.ReadAll(r)
+	errs.CheckE(err)
+	s = &Scenario{}
+	errs.CheckE(yaml.Unmarshal(buf, s))
+	if s.Session == "" {
+		s.Session = "00TestSess"
+	}
+	if s.FirstSeq == 0 {
+		s.FirstSeq = 1
+	}
+	errs.Check(len(s.Session) == 10, "session must be 10 characters", s.Session)
+	for _, o := range s.Options {
+		errs.Check(o.Id > 0 && o.Id < 1000000, "option id out of range", o.Id)
+	}
+	for i, e := range s.Events {
+		if e.kinds() != 1 {
+			return nil, fmt.Errorf("scenario event #%d: exactly one action expected", i)
+		}
+		if e.Session != "" && e.Session != "start" && e.Session != "end" {
+			return nil, fmt.Errorf("scenario event #%d: unknown session event %s", i, e.Session)
+		}
+	}
+	return
+}
+
+func (s *Scenario) option(id uint32) *Option {
+	for i := range s.Options {
+		if s.Options[i].Id == id {
+			return &s.Options[i]
+		}
+	}
+	return nil
+}
+
+type Packet struct {
+	Time     time.Time
+	Seq      int
+	Messages [][]byte
+	// not sent by multicast, available only by retransmission
+	Dropped bool
+}
+
+type Feed struct {
+	Protocol string
+	Session  string
+	Packets  []Packet
+}
+
+type encoder interface {
+	definitions(s *Scenario) [][]byte
+	event(e *Event, ts uint32) [][]byte
+}
+
+// compiles scenario to ITTO (nasdaq), PITCH (bats) or ToM (miax) messages; every event makes one packet
+func Compile(s *Scenario, protocol string) (f *Feed, err error) {
+	defer errs.PassE(&err)
+	var enc encoder
+	switch protocol {
+	case "nasdaq":
+		enc = &ittoEncoder{}
+	case "bats":
+		enc = newPitchEncoder()
+	case "miax":
+		enc = newTomEncoder(s)
+	default:
+		errs.Check(false, "unknown protocol", protocol)
+	}
+	f = &Feed{
+		Protocol: protocol,
+		Session:  s.Session,
+	}
+	seq := s.FirstSeq
+	seconds := 0
+	add := func(nanos int, msgs [][]byte, dropped bool) {
+		if len(msgs) == 0 {
+			return
+		}
+		f.Packets = append(f.Packets, Packet{
+			Time:     time.Unix(int64(seconds), int64(nanos)),
+			Seq:      seq,
+			Messages: msgs,
+			Dropped:  dropped,
+		})
+		seq += len(msgs)
+	}
+	add(0, enc.definitions(s), false)
+	drop := 0
+	for i := range s.Events {
+		e := &s.Events[i]
+		if e.Gap != 0 {
+			drop = e.Gap
+			continue
+		}
+		if e.Seconds != nil {
+			seconds = *e.Seconds
+		}
+		nanos := (i + 1) * 1000
+		add(nanos, enc.event(e, uint32(nanos)), drop > 0)
+		if drop > 0 {
+			drop--
+		}
+	}
+	return
+}
+
+func price4(p float64) uint32 {
+	return uint32(math.Floor(p*10000 + 0.5))
+}
+
+func sideByte(side string) byte {
+	if side == "S" || side == "A" {
+		return 'S'
+	}
+	return 'B'
+}
+
+type bookOrder struct {
+	option uint32
+	side   byte
+	price  float64
+	size   int
+}
+
+// live orders, needed by protocols without order-level messages for some events
+type book struct {
+	orders map[uint32]*bookOrder
+}
+
+func newBook() *book {
+	return &book{orders: make(map[uint32]*bookOrder)}
+}
+
+func (b *book) add(id, option uint32, side byte, price float64, size int) {
+	b.orders[id] = &bookOrder{option: option, side: side, price: price, size: size}
+}
+func (b *book) replace(id, newId uint32, price float64, size int) (option uint32) {
+	if newId == 0 {
+		newId = id
+	}
+	if o, ok := b.orders[id]; ok {
+		delete(b.orders, id)
+		b.add(newId, o.option, o.side, price, size)
+		option = o.option
+	}
+	return
+}
+func (b *book) reduce(id uint32, size int) (option uint32) {
+	if o, ok := b.orders[id]; ok {
+		option = o.option
+		if o.size -= size; o.size <= 0 {
+			delete(b.orders, id)
+		}
+	}
+	return
+}
+func (b *book) remove(id uint32) (option uint32) {
+	if o, ok := b.orders[id]; ok {
+		option = o.option
+		delete(b.orders, id)
+	}
+	return
+}
+
+// applies order event, returns affected options
+func (b *book) apply(e *Event) (options []uint32) {
+	affected := func(oid uint32) {
+		if oid == 0 {
+			return
+		}
+		for _, o := range options {
+			if o == oid {
+				return
+			}
+		}
+		options = append(options, oid)
+	}
+	switch {
+	case e.Add != nil:
+		b.add(e.Add.Order, e.Add.Option, sideByte(e.Add.Side), e.Add.Price, e.Add.Size)
+		affected(e.Add.Option)
+	case e.Replace != nil:
+		affected(b.replace(e.Replace.Order, e.Replace.NewOrder, e.Replace.Price, e.Replace.Size))
+	case e.Execute != nil:
+		affected(b.reduce(e.Execute.Order, e.Execute.Size))
+	case e.Cancel != nil:
+		affected(b.reduce(e.Cancel.Order, e.Cancel.Size))
+	case e.Delete != nil:
+		affected(b.remove(e.Delete.Order))
+	case e.Quote != nil:
+		q := e.Quote
+		b.add(q.Bid, q.Option, 'B', q.BidPrice, q.BidSize)
+		b.add(q.Ask, q.Option, 'S', q.AskPrice, q.AskSize)
+		affected(q.Option)
+	case e.QuoteReplace != nil:
+		q := e.QuoteReplace
+		affected(b.replace(q.Bid, q.NewBid, q.BidPrice, q.BidSize))
+		affected(b.replace(q.Ask, q.NewAsk, q.AskPrice, q.AskSize))
+	case e.QuoteDelete != nil:
+		affected(b.remove(e.QuoteDelete.Bid))
+		affected(b.remove(e.QuoteDelete.Ask))
+	case e.BlockDelete != nil:
+		for _, id := range e.BlockDelete.Orders {
+			affected(b.remove(id))
+		}
+	}
+	return
+}
+
+// best price and total size at it
+func (b *book) top(option uint32, side byte) (price float64, size int) {
+	for _, o := range b.orders {
+		if o.option != option || o.side != side {
+			continue
+		}
+		better := size == 0 || side == 'B' && o.price > price || side == 'S' && o.price < price
+		if better {
+			price, size = o.price, o.size
+		} else if o.price == price {
+			size += o.size
+		}
+	}
+	return
+}
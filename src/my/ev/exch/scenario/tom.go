@@ -0,0 +1,176 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package scenario
+
+import (
+	"encoding/binary"
+)
+
+type tomTop struct {
+	price float64
+	size  int
+}
+
+type tomTrade struct {
+	option uint32
+	price  float64
+	size   int
+}
+
+// MIAX ToM, top of market derived from order level events
+type tomEncoder struct {
+	scenario *Scenario
+	book     *book
+	tops     map[uint32][2]tomTop
+	trades   map[uint32]tomTrade
+}
+
+func newTomEncoder(s *Scenario) *tomEncoder {
+	return &tomEncoder{
+		scenario: s,
+		book:     newBook(),
+		tops:     make(map[uint32][2]tomTop),
+		trades:   make(map[uint32]tomTrade),
+	}
+}
+
+func tomMessage(typ byte, size int, ts uint32) []byte {
+	m := make([]byte, size)
+	m[0] = typ
+	binary.LittleEndian.PutUint32(m[1:5], ts)
+	return m
+}
+
+func putTomSide(b []byte, t tomTop) {
+	binary.LittleEndian.PutUint32(b[0:4], price4(t.price))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.size))
+	b[12] = 'A'
+}
+
+func (_ *tomEncoder) definitions(s *Scenario) (msgs [][]byte) {
+	for _, o := range s.Options {
+		m := tomMessage('P', 73, 0)
+		binary.LittleEndian.PutUint32(m[5:9], o.Id)
+		copy(m[9:20], padded(o.Underlying, 11))
+		copy(m[20:26], padded(o.Underlying, 6))
+		copy(m[26:34], o.Expiration)
+		binary.LittleEndian.PutUint32(m[34:38], price4(o.Strike))
+		m[38] = 'C'
+		if o.Type == "P" {
+			m[38] = 'P'
+		}
+		copy(m[39:47], "09:30:00")
+		copy(m[47:55], "16:00:00")
+		m[55] = 'N'
+		m[56] = 'N'
+		m[57] = 'A'
+		m[58] = 'P'
+		m[59] = 'P'
+		m[60] = 'Q'
+		msgs = append(msgs, m)
+	}
+	return
+}
+
+func (te *tomEncoder) trade(ts uint32, match, option uint32, price float64, size int) []byte {
+	te.trades[match] = tomTrade{option: option, price: price, size: size}
+	m := tomMessage('T', 28, ts)
+	binary.LittleEndian.PutUint32(m[5:9], option)
+	binary.LittleEndian.PutUint32(m[9:13], match)
+	binary.LittleEndian.PutUint32(m[19:23], price4(price))
+	binary.LittleEndian.PutUint32(m[23:27], uint32(size))
+	m[27] = 'A'
+	return m
+}
+
+func (te *tomEncoder) event(e *Event, ts uint32) (msgs [][]byte) {
+	add := func(m []byte) {
+		msgs = append(msgs, m)
+	}
+	switch {
+	case e.Seconds != nil:
+		m := make([]byte, 5)
+		m[0] = '1'
+		binary.LittleEndian.PutUint32(m[1:5], uint32(*e.Seconds))
+		add(m)
+	case e.Session != "":
+		m := tomMessage('S', 18, ts)
+		copy(m[5:13], "1.0     ")
+		binary.LittleEndian.PutUint32(m[13:17], 1)
+		m[17] = 'S'
+		if e.Session == "end" {
+			m[17] = 'C'
+		}
+		add(m)
+	case e.Execute != nil:
+		if o, ok := te.book.orders[e.Execute.Order]; ok {
+			add(te.trade(ts, e.Execute.Match, o.option, o.price, e.Execute.Size))
+		}
+	case e.Trade != nil:
+		t := e.Trade
+		add(te.trade(ts, t.Match, t.Option, t.Price, t.Size))
+	case e.Bust != nil:
+		t, ok := te.trades[e.Bust.Match]
+		if !ok {
+			break
+		}
+		delete(te.trades, e.Bust.Match)
+		m := tomMessage('X', 23, ts)
+		binary.LittleEndian.PutUint32(m[5:9], t.option)
+		binary.LittleEndian.PutUint32(m[9:13], e.Bust.Match)
+		binary.LittleEndian.PutUint32(m[14:18], price4(t.price))
+		binary.LittleEndian.PutUint32(m[18:22], uint32(t.size))
+		m[22] = 'A'
+		add(m)
+	case e.Halt != nil, e.Resume != nil:
+		m := tomMessage('H', 26, ts)
+		var option uint32
+		if e.Halt != nil {
+			option = e.Halt.Option
+			m[16] = 'H'
+		} else {
+			option = e.Resume.Option
+			m[16] = 'R'
+		}
+		if o := te.scenario.option(option); o != nil {
+			copy(m[5:16], padded(o.Underlying, 11))
+		}
+		add(m)
+	}
+	for _, option := range te.book.apply(e) {
+		if m := te.updateTop(option, ts); m != nil {
+			add(m)
+		}
+	}
+	return
+}
+
+// publishes changed top of market, nil if unchanged
+func (te *tomEncoder) updateTop(option uint32, ts uint32) []byte {
+	var top [2]tomTop
+	top[0].price, top[0].size = te.book.top(option, 'B')
+	top[1].price, top[1].size = te.book.top(option, 'S')
+	old := te.tops[option]
+	te.tops[option] = top
+	switch {
+	case top == old:
+		return nil
+	case top[0] != old[0] && top[1] != old[1]:
+		m := tomMessage('D', 35, ts)
+		binary.LittleEndian.PutUint32(m[5:9], option)
+		putTomSide(m[9:22], top[0])
+		putTomSide(m[22:35], top[1])
+		return m
+	case top[0] != old[0]:
+		m := tomMessage('W', 22, ts)
+		binary.LittleEndian.PutUint32(m[5:9], option)
+		putTomSide(m[9:22], top[0])
+		return m
+	default:
+		m := tomMessage('A', 22, ts)
+		binary.LittleEndian.PutUint32(m[5:9], option)
+		putTomSide(m[9:22], top[1])
+		return m
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"my/ev/exch/miax"
+)
+
+// starts SesMServer on a loopback port with messages 1..n generated
+func startSesMServer(t *testing.T, n int) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = l.Addr().String()
+	l.Close()
+	src := NewMiaxMessageSource(0, 0)
+	for i := 0; i < n; i++ {
+		src.produceOne()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		(&SesMServer{laddr: addr, src: src}).run(ctx)
+		close(done)
+	}()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return addr, func() {
+		cancel()
+		<-done
+	}
+}
+
+func dialSesM(t *testing.T, addr string) *miax.Client {
+	c, err := miax.Dial(miax.ClientConfig{Addr: addr, Username: "test", Timeout: 3 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSesMClientLogin(t *testing.T) {
+	addr, stop := startSesMServer(t, 100)
+	defer stop()
+	c := dialSesM(t, addr)
+	defer c.Close()
+	if c.HighestSequence() != 100 {
+		t.Errorf("highest sequence %d, expected 100", c.HighestSequence())
+	}
+}
+
+func TestSesMClientRetransmit(t *testing.T) {
+	addr, stop := startSesMServer(t, 100)
+	defer stop()
+	c := dialSesM(t, addr)
+	defer c.Close()
+	var seqs []uint64
+	err := c.Retransmit(10, 20, func(seq uint64, m []byte) error {
+		if len(m) == 0 {
+			t.Errorf("seq %d: empty message", seq)
+		}
+		seqs = append(seqs, seq)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 11 || seqs[0] != 10 || seqs[10] != 20 {
+		t.Errorf("retransmitted %v, expected 10..20", seqs)
+	}
+	// server ends the session after retransmission
+	if err := c.Retransmit(1, 2, func(uint64, []byte) error { return nil }); err == nil {
+		t.Error("retransmit after end of session succeeded")
+	}
+}
+
+func TestSesMClientRetransmitUnavailable(t *testing.T) {
+	addr, stop := startSesMServer(t, 100)
+	defer stop()
+	c := dialSesM(t, addr)
+	defer c.Close()
+	var seqs []uint64
+	err := c.Retransmit(95, 120, func(seq uint64, m []byte) error {
+		seqs = append(seqs, seq)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 6 || seqs[0] != 95 || seqs[5] != 100 {
+		t.Errorf("retransmitted %v, expected 95..100", seqs)
+	}
+}
+
+func TestSesMClientRefresh(t *testing.T) {
+	addr, stop := startSesMServer(t, 100)
+	defer stop()
+	c := dialSesM(t, addr)
+	defer c.Close()
+	for _, rt := range []byte{miax.SesMRefreshToM, miax.SesMRefreshSeriesUpdate} {
+		var n int
+		seqs := make(map[uint64]bool)
+		err := c.Refresh(rt, func(seq uint64, m []byte) error {
+			if seq > 100 {
+				t.Errorf("refresh %c: seq %d after highest", rt, seq)
+			}
+			seqs[seq] = true
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// system time and one message per product
+		if n != miaxProducts+1 {
+			t.Errorf("refresh %c: %d messages, expected %d", rt, n, miaxProducts+1)
+		}
+		// system time and products are stamped with the highest seq
+		if len(seqs) != 1 || !seqs[100] {
+			t.Errorf("refresh %c: seqs %v, expected 100 only", rt, seqs)
+		}
+	}
+}
+
+func TestSesMClientErrors(t *testing.T) {
+	addr, stop := startSesMServer(t, 10)
+	c := dialSesM(t, addr)
+	if err := c.Retransmit(5, 1, func(uint64, []byte) error { return nil }); err == nil {
+		t.Error("retransmit of bad range succeeded")
+	}
+	c.Close()
+	stop()
+	if _, err := miax.Dial(miax.ClientConfig{Addr: addr, Timeout: time.Second}); err == nil {
+		t.Error("dial to stopped server succeeded")
+	}
+
+	// server closing connection instead of login response
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	if _, err := miax.Dial(miax.ClientConfig{Addr: l.Addr().String(), Timeout: time.Second}); err == nil {
+		t.Error("login without response succeeded")
+	}
+}
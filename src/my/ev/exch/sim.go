@@ -0,0 +1,37 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package exch
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+
+	"my/ev/packet"
+	"my/ev/sim"
+)
+
+type simAppMessage struct {
+	layer gopacket.Layer
+	flows []gopacket.Flow
+	seq   uint64
+}
+
+func (m *simAppMessage) Layer() gopacket.Layer  { return m.layer }
+func (m *simAppMessage) Flows() []gopacket.Flow { return m.flows }
+func (m *simAppMessage) SequenceNumber() uint64 { return m.seq }
+func (m *simAppMessage) Timestamp() time.Time   { return time.Time{} }
+
+// keeps options and orders of the simulator up to date; books are not needed to serve snapshots
+func applySimMessage(simu sim.Sim, pam packet.ApplicationMessage) {
+	m := simu.NewMessage(pam)
+	for _, op := range m.MessageOperations() {
+		if op.CanAffect(sim.OA_OPTIONS) {
+			simu.Options().ApplyOperation(op)
+		}
+		if op.CanAffect(sim.OA_ORDERS) {
+			simu.OrderDb().ApplyOperation(op)
+		}
+	}
+}
@@ -54,6 +54,23 @@ func NewConfig(dev device.Device) *Config {
 func (c *Config) IsBad() bool {
 	return c.isBad
 }
+
+// names of registers and fields which are not good, as block/register[/field]; only valid after Probe
+func (c *Config) BadNames() (names []string) {
+	for _, block := range c.ast {
+		for _, reg := range block.Regs {
+			if reg.isBad {
+				names = append(names, block.Name+"/"+reg.Name)
+			}
+			for _, f := range reg.Fields {
+				if f.isBad {
+					names = append(names, block.Name+"/"+reg.Name+"/"+f.Name)
+				}
+			}
+		}
+	}
+	return
+}
 func (c *Config) Parse(yamlDoc string) (err error) {
 	defer errs.PassE(&err)
 	errs.CheckE(yaml.Unmarshal([]byte(yamlDoc), &c.ast))
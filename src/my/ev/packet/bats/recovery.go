@@ -0,0 +1,569 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package bats
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/ikravets/errs"
+
+	exchbats "my/ev/exch/bats"
+	"my/ev/packet"
+)
+
+const bsuHeaderSize = 8
+
+var EndpointBatsUnitMetadata = gopacket.EndpointTypeMetadata{"BatsUnit", func(b []byte) string {
+	return fmt.Sprintf("unit %d", b[0])
+}}
+var EndpointBatsUnit = gopacket.RegisterEndpointType(12000, EndpointBatsUnitMetadata)
+
+type RecoveryConfig struct {
+	FeedAddr  string // multicast or unicast
+	GapAddr   string // gap response multicast, no gap recovery if empty
+	Interface string // for multicast addresses; system default if empty
+	GrpAddr   string // gap request proxy
+	// spin server; start from the first received message if empty
+	SpinAddr     string
+	Unit         int
+	SessionSubId string
+	Username     string
+	Password     string
+	MaxMessages  int           // messages per gap request, default 100
+	Timeout      time.Duration // gap response and spin retry timeout, default 1s
+	Retries      int           // retries of unanswered gap request before messages are given up, default 3
+}
+
+type RecoveryStats struct {
+	Delivered  uint64
+	Duplicates uint64
+	Requests   uint64
+	Recovered  uint64 // delivered from gap responses
+	Lost       uint64
+	Spun       uint64 // orders delivered from spin image
+}
+
+// PITCH client of one unit delivering messages in sequence order;
+// starts from spin image synchronized with buffered feed and recovers gaps by GRP requests
+type RecoveryClient struct {
+	config  RecoveryConfig
+	handler packet.Handler
+
+	mu    sync.Mutex
+	stats RecoveryStats
+
+	flow     gopacket.Flow
+	expected uint64 // next sequence number to deliver, 0 until known
+	highest  uint64 // sequence number after the last known message
+	ended    bool
+	pending  map[uint64]recoveryMessage
+	req      recoveryRequest
+
+	sessionMessages chan sessionMessage
+	done            chan struct{}
+	grp             *recoverySession
+	spin            *recoverySession
+	spinning        bool
+	spinSeq         uint64 // requested image, 0 if none
+	spinOrders      bool   // image orders are delivered
+	spinTries       int
+	spinAttempt     time.Time
+}
+
+type recoveryMessage struct {
+	data      []byte
+	timestamp time.Time
+}
+
+// outstanding gap request, none if count is 0
+type recoveryRequest struct {
+	seq      uint64
+	count    int
+	sent     time.Time
+	tries    int
+	answered bool
+}
+
+// logged in TCP connection to GRP or spin server
+type recoverySession struct {
+	conn  net.Conn
+	bconn exchbats.Conn
+}
+
+type sessionMessage struct {
+	s   *recoverySession
+	m   exchbats.Message
+	err error
+}
+
+func NewRecoveryClient(config RecoveryConfig) *RecoveryClient {
+	if config.MaxMessages <= 0 {
+		config.MaxMessages = 100
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second
+	}
+	if config.Retries <= 0 {
+		config.Retries = 3
+	}
+	return &RecoveryClient{
+		config:   config,
+		handler:  &packet.NopHandler{},
+		flow:     gopacket.NewFlow(EndpointBatsUnit, []byte{byte(config.Unit)}, []byte{byte(config.Unit)}),
+		pending:  make(map[uint64]recoveryMessage),
+		spinning: config.SpinAddr != "",
+	}
+}
+
+func (c *RecoveryClient) SetHandler(handler packet.Handler) {
+	c.handler = handler
+}
+
+func (c *RecoveryClient) Stats() RecoveryStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// receives and recovers until ctx is done or end of session is delivered
+func (c *RecoveryClient) Run(ctx context.Context) (err error) {
+	defer errs.PassE(&err)
+	errs.Check(c.config.Unit > 0 && c.config.Unit < 256, "bad unit", c.config.Unit)
+	errs.Check(c.config.GapAddr == "" || c.config.GrpAddr != "", "gap multicast requires GRP address")
+	c.done = make(chan struct{})
+	defer close(c.done)
+	c.sessionMessages = make(chan sessionMessage)
+	defer func() {
+		c.closeSession(&c.grp)
+		c.closeSession(&c.spin)
+	}()
+
+	type datagram struct {
+		data      []byte
+		timestamp time.Time
+		recovered bool
+	}
+	datagrams := make(chan datagram)
+	readErrs := make(chan error, 2)
+	read := func(conn *net.UDPConn, recovered bool) {
+		for {
+			buf := make([]byte, 65536)
+			n, err := conn.Read(buf)
+			if err != nil {
+				select {
+				case <-c.done:
+				case readErrs <- err:
+				}
+				return
+			}
+			select {
+			case datagrams <- datagram{buf[:n], time.Now(), recovered}:
+			case <-c.done:
+				return
+			}
+		}
+	}
+	feed, err := packet.ListenUDP(c.config.FeedAddr, c.config.Interface)
+	errs.CheckE(err)
+	defer feed.Close()
+	go read(feed, false)
+	if c.config.GapAddr != "" {
+		gap, err := packet.ListenUDP(c.config.GapAddr, c.config.Interface)
+		errs.CheckE(err)
+		defer gap.Close()
+		go read(gap, true)
+	}
+
+	ticker := time.NewTicker(c.config.Timeout / 4)
+	defer ticker.Stop()
+	for !c.ended || c.expected < c.highest {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErrs:
+			errs.CheckE(err)
+		case d := <-datagrams:
+			c.handler.HandlePacket(&recoveryPacket{data: d.data, timestamp: d.timestamp})
+			c.receive(d.data, d.timestamp, d.recovered)
+		case sm := <-c.sessionMessages:
+			if sm.s == c.spin {
+				errs.CheckE(c.spinMessage(sm.m, sm.err))
+			} else if sm.s == c.grp {
+				c.grpMessage(sm.m, sm.err)
+			}
+		case <-ticker.C:
+		}
+		now := time.Now()
+		if c.spinning && c.spin == nil && now.Sub(c.spinAttempt) >= c.config.Timeout {
+			c.spinConnect(now)
+		}
+		c.gapRequest(now)
+	}
+	log.Printf("bats unit %d: end of session at seq %d\n", c.config.Unit, c.expected)
+	return
+}
+
+// connects and logs in; messages read afterwards are sent to c.sessionMessages
+func (c *RecoveryClient) login(address string) (s *recoverySession, err error) {
+	var conn net.Conn
+	defer func() {
+		if err != nil && conn != nil {
+			conn.Close()
+		}
+	}()
+	defer errs.PassE(&err)
+	conn, err = net.DialTimeout("tcp", address, c.config.Timeout)
+	errs.CheckE(err)
+	s = &recoverySession{conn: conn, bconn: exchbats.NewConn(conn)}
+	m := exchbats.MessageLogin{}
+	copy(m.SessionSubId[:], c.config.SessionSubId)
+	copy(m.Username[:], c.config.Username)
+	copy(m.Password[:], c.config.Password)
+	errs.CheckE(conn.SetDeadline(time.Now().Add(c.config.Timeout)))
+	errs.CheckE(s.bconn.WriteMessageSimple(&m))
+	res, err := s.bconn.ReadMessage()
+	errs.CheckE(err)
+	lr, ok := res.(*exchbats.MessageLoginResponse)
+	errs.Check(ok, "unexpected login response", res)
+	errs.Check(lr.Status == exchbats.LoginAccepted, "login rejected", string(lr.Status))
+	errs.CheckE(conn.SetDeadline(time.Time{}))
+	go func() {
+		for {
+			m, err := s.bconn.ReadMessage()
+			select {
+			case c.sessionMessages <- sessionMessage{s: s, m: m, err: err}:
+			case <-c.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return
+}
+
+func (c *RecoveryClient) closeSession(s **recoverySession) {
+	if *s != nil {
+		(*s).conn.Close()
+		*s = nil
+	}
+}
+
+// takes messages of BSU packet from the feed or gap response
+func (c *RecoveryClient) receive(data []byte, timestamp time.Time, recovered bool) {
+	if len(data) < bsuHeaderSize {
+		log.Printf("bats: ignore short packet of %d bytes\n", len(data))
+		return
+	}
+	length := int(binary.LittleEndian.Uint16(data[0:2]))
+	count := int(data[2])
+	unit := int(data[3])
+	seq := uint64(binary.LittleEndian.Uint32(data[4:8]))
+	if unit != c.config.Unit || seq == 0 {
+		// other unit or unsequenced
+		return
+	}
+	if length < len(data) {
+		data = data[:length]
+	}
+	data = data[bsuHeaderSize:]
+	for i := 0; i < count; i++ {
+		if len(data) < 2 || len(data) < int(data[0]) || data[0] < 2 {
+			log.Printf("bats unit %d: truncated packet at seq %d\n", c.config.Unit, seq+uint64(i))
+			count = i
+			break
+		}
+		length := int(data[0])
+		c.add(seq+uint64(i), data[:length], timestamp, recovered)
+		data = data[length:]
+	}
+	if end := seq + uint64(count); end > c.highest {
+		c.highest = end
+	}
+	if c.expected == 0 && !c.spinning {
+		c.expected = seq
+	}
+	c.deliver()
+}
+
+func (c *RecoveryClient) add(seq uint64, data []byte, timestamp time.Time, recovered bool) {
+	if _, ok := c.pending[seq]; ok || seq < c.expected {
+		c.mu.Lock()
+		c.stats.Duplicates++
+		c.mu.Unlock()
+		return
+	}
+	if recovered {
+		c.mu.Lock()
+		c.stats.Recovered++
+		c.mu.Unlock()
+	}
+	c.pending[seq] = recoveryMessage{
+		data:      append([]byte(nil), data...),
+		timestamp: timestamp,
+	}
+}
+
+func (c *RecoveryClient) deliver() {
+	if c.expected == 0 {
+		return
+	}
+	for {
+		m, ok := c.pending[c.expected]
+		if !ok {
+			return
+		}
+		delete(c.pending, c.expected)
+		c.handleMessage(m.data, c.expected, m.timestamp)
+		if PitchMessageType(m.data[1]) == PitchMessageTypeEndOfSession {
+			c.ended = true
+		}
+		c.mu.Lock()
+		c.stats.Delivered++
+		c.mu.Unlock()
+		c.expected++
+	}
+}
+
+func (c *RecoveryClient) handleMessage(data []byte, seq uint64, timestamp time.Time) {
+	layer := PitchMessageTypeMetadata[data[1]].CreateLayer()
+	if err := layer.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		log.Printf("bats unit %d: seq %d: %s\n", c.config.Unit, seq, err)
+		return
+	}
+	c.handler.HandleMessage(&recoveryApplicationMessage{
+		layer:     layer,
+		flows:     []gopacket.Flow{c.flow},
+		seqNum:    seq,
+		timestamp: timestamp,
+	})
+}
+
+// lowest buffered sequence number, 0 if none
+func (c *RecoveryClient) lowest() (seq uint64) {
+	for s := range c.pending {
+		if seq == 0 || s < seq {
+			seq = s
+		}
+	}
+	return
+}
+
+func (c *RecoveryClient) spinConnect(now time.Time) {
+	c.spinAttempt = now
+	s, err := c.login(c.config.SpinAddr)
+	if err != nil {
+		log.Printf("bats unit %d: spin: %s\n", c.config.Unit, err)
+		c.spinFailed()
+		return
+	}
+	c.spin = s
+}
+
+// retries spin later; after retries starts from the buffered feed
+func (c *RecoveryClient) spinFailed() {
+	c.closeSession(&c.spin)
+	c.spinSeq = 0
+	if c.spinTries++; c.spinTries <= c.config.Retries {
+		return
+	}
+	c.spinning = false
+	c.expected = c.lowest()
+	log.Printf("bats unit %d: spin given up after %d tries, start from seq %d\n", c.config.Unit, c.spinTries, c.expected)
+	c.deliver()
+}
+
+func (c *RecoveryClient) spinMessage(m exchbats.Message, err error) (err2 error) {
+	defer errs.PassE(&err2)
+	if err != nil {
+		errs.Check(!c.spinOrders, "spin image is broken", err)
+		log.Printf("bats unit %d: spin: %s\n", c.config.Unit, err)
+		c.spinFailed()
+		return
+	}
+	switch m := m.(type) {
+	case *exchbats.MessageSpinImageAvail:
+		// image is usable if the feed is buffered right after it
+		if low := c.lowest(); c.spinSeq == 0 && low != 0 && uint64(m.Sequence)+1 >= low {
+			c.spinSeq = uint64(m.Sequence)
+			if err := c.spin.bconn.WriteMessageSimple(&exchbats.MessageSpinRequest{Sequence: m.Sequence}); err != nil {
+				log.Printf("bats unit %d: spin: %s\n", c.config.Unit, err)
+				c.spinFailed()
+			}
+		}
+	case *exchbats.MessageSpinResponse:
+		if m.Status != exchbats.SpinStatusAccepted {
+			log.Printf("bats unit %d: spin %d rejected: %c\n", c.config.Unit, m.Sequence, m.Status)
+			c.spinFailed()
+			return
+		}
+		log.Printf("bats unit %d: spin %d: %d orders\n", c.config.Unit, m.Sequence, m.Count)
+	case *exchbats.MessageAddOrder:
+		c.spinOrders = true
+		data, err := exchbats.EncodeMessage(m)
+		errs.CheckE(err)
+		c.handleMessage(data, c.spinSeq, time.Now())
+		c.mu.Lock()
+		c.stats.Spun++
+		c.mu.Unlock()
+	case *exchbats.MessageSpinFinished:
+		c.closeSession(&c.spin)
+		c.spinning = false
+		c.expected = uint64(m.Sequence) + 1
+		for s := range c.pending {
+			if s < c.expected {
+				delete(c.pending, s)
+			}
+		}
+		log.Printf("bats unit %d: spin %d finished, continue from seq %d\n", c.config.Unit, m.Sequence, c.expected)
+		c.deliver()
+	default:
+		log.Printf("bats unit %d: spin: unexpected message %#v\n", c.config.Unit, m)
+	}
+	return
+}
+
+func (c *RecoveryClient) grpMessage(m exchbats.Message, err error) {
+	if err != nil {
+		// GRP may close the connection after the response; unanswered request is retried at once
+		c.closeSession(&c.grp)
+		if !c.req.answered {
+			c.req.sent = time.Time{}
+		}
+		return
+	}
+	res, ok := m.(*exchbats.MessageGapResponse)
+	if !ok {
+		log.Printf("bats unit %d: grp: unexpected message %#v\n", c.config.Unit, m)
+		return
+	}
+	if uint64(res.Sequence) != c.req.seq || int(res.Count) != c.req.count {
+		return
+	}
+	c.req.answered = true
+	switch res.Status {
+	case exchbats.GapStatusAccepted:
+	case exchbats.GapStatusRange, exchbats.GapStatusInvalidUnit:
+		// give up at once
+		c.req.tries = c.config.Retries + 1
+		c.req.sent = time.Time{}
+	default:
+		log.Printf("bats unit %d: gap %d+%d: status %c\n", c.config.Unit, res.Sequence, res.Count, res.Status)
+	}
+}
+
+// requests the first missing messages unless already requested;
+// gives them up when request is not answered after retries
+func (c *RecoveryClient) gapRequest(now time.Time) {
+	if c.config.GapAddr == "" || c.expected == 0 {
+		return
+	}
+	tries := 1
+	if end := c.req.seq + uint64(c.req.count); c.expected >= c.req.seq && c.expected < end {
+		if now.Sub(c.req.sent) < c.config.Timeout {
+			return
+		}
+		if c.req.tries > c.config.Retries {
+			lost := 0
+			for ; c.expected < end && c.expected < c.highest; lost++ {
+				if _, ok := c.pending[c.expected]; ok {
+					break
+				}
+				c.expected++
+			}
+			log.Printf("bats unit %d: lost %d messages from seq %d after %d gap requests\n", c.config.Unit, lost, c.expected-uint64(lost), c.req.tries)
+			c.mu.Lock()
+			c.stats.Lost += uint64(lost)
+			c.mu.Unlock()
+			c.deliver()
+		} else {
+			tries = c.req.tries + 1
+		}
+	}
+	c.req = recoveryRequest{}
+	if c.expected >= c.highest {
+		return
+	}
+	count := 0
+	for count < c.config.MaxMessages && c.expected+uint64(count) < c.highest {
+		if _, ok := c.pending[c.expected+uint64(count)]; ok {
+			break
+		}
+		count++
+	}
+	c.req = recoveryRequest{
+		seq:   c.expected,
+		count: count,
+		sent:  now,
+		tries: tries,
+	}
+	c.mu.Lock()
+	c.stats.Requests++
+	c.mu.Unlock()
+	m := exchbats.MessageGapRequest{
+		Unit:     uint8(c.config.Unit),
+		Sequence: uint32(c.req.seq),
+		Count:    uint16(count),
+	}
+	// GRP may have closed the connection since the last request, reconnect once
+	for i := 0; i < 2; i++ {
+		if c.grp == nil {
+			s, err := c.login(c.config.GrpAddr)
+			if err != nil {
+				log.Printf("bats unit %d: grp: %s\n", c.config.Unit, err)
+				return
+			}
+			c.grp = s
+		}
+		err := c.grp.bconn.WriteMessageSimple(&m)
+		if err == nil {
+			return
+		}
+		log.Printf("bats unit %d: grp: %s\n", c.config.Unit, err)
+		c.closeSession(&c.grp)
+	}
+}
+
+type recoveryPacket struct {
+	data      []byte
+	timestamp time.Time
+}
+
+func (p *recoveryPacket) String() string {
+	return fmt.Sprintf("BSU datagram: %d bytes @ %v", len(p.data), p.timestamp)
+}
+func (p *recoveryPacket) Data() []byte {
+	return p.data
+}
+func (p *recoveryPacket) Timestamp() time.Time {
+	return p.timestamp
+}
+
+type recoveryApplicationMessage struct {
+	layer     gopacket.Layer
+	flows     []gopacket.Flow
+	seqNum    uint64
+	timestamp time.Time
+}
+
+func (am *recoveryApplicationMessage) Layer() gopacket.Layer {
+	return am.layer
+}
+func (am *recoveryApplicationMessage) Flows() []gopacket.Flow {
+	return am.flows
+}
+func (am *recoveryApplicationMessage) SequenceNumber() uint64 {
+	return am.seqNum
+}
+func (am *recoveryApplicationMessage) Timestamp() time.Time {
+	return am.timestamp
+}
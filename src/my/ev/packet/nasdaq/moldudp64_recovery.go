@@ -0,0 +1,342 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package nasdaq
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/ikravets/errs"
+
+	"my/ev/packet"
+)
+
+const (
+	moldUDP64HeaderSize   = 20
+	moldUDP64EndOfSession = 0xFFFF
+)
+
+type RecoveryConfig struct {
+	FeedAddr      string // MoldUDP64 stream, multicast or unicast
+	Interface     string // for multicast FeedAddr; system default if empty
+	RerequestAddr string
+	// first sequence number to deliver, 0 to start from the first received packet
+	StartSequence uint64
+	MaxMessages   int           // messages per rerequest, default 64
+	Timeout       time.Duration // rerequest response timeout, default 1s
+	Retries       int           // retries of unanswered rerequest before messages are given up, default 3
+}
+
+type RecoveryStats struct {
+	Delivered  uint64
+	Duplicates uint64
+	Requests   uint64
+	Recovered  uint64 // delivered from rerequest responses
+	Lost       uint64
+}
+
+// MoldUDP64 client delivering messages in sequence order, recovering gaps by rerequests
+type RecoveryClient struct {
+	config  RecoveryConfig
+	handler packet.Handler
+
+	mu    sync.Mutex
+	stats RecoveryStats
+
+	session  string
+	flow     gopacket.Flow
+	expected uint64 // next sequence number to deliver, 0 until known
+	highest  uint64 // sequence number after the last known message
+	ended    bool
+	pending  map[uint64]recoveryMessage
+	req      recoveryRequest
+}
+
+type recoveryMessage struct {
+	data      []byte
+	timestamp time.Time
+}
+
+// outstanding rerequest, none if count is 0
+type recoveryRequest struct {
+	seq   uint64
+	count int
+	sent  time.Time
+	tries int
+}
+
+func NewRecoveryClient(config RecoveryConfig) *RecoveryClient {
+	if config.MaxMessages <= 0 {
+		config.MaxMessages = 64
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second
+	}
+	if config.Retries <= 0 {
+		config.Retries = 3
+	}
+	return &RecoveryClient{
+		config:   config,
+		handler:  &packet.NopHandler{},
+		expected: config.StartSequence,
+		pending:  make(map[uint64]recoveryMessage),
+	}
+}
+
+func (c *RecoveryClient) SetHandler(handler packet.Handler) {
+	c.handler = handler
+}
+
+func (c *RecoveryClient) Stats() RecoveryStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// receives and recovers until ctx is done or end of session is delivered
+func (c *RecoveryClient) Run(ctx context.Context) (err error) {
+	defer errs.PassE(&err)
+	feed, err := packet.ListenUDP(c.config.FeedAddr, c.config.Interface)
+	errs.CheckE(err)
+	defer feed.Close()
+	raddr, err := net.ResolveUDPAddr("udp", c.config.RerequestAddr)
+	errs.CheckE(err)
+	rereq, err := net.DialUDP("udp", nil, raddr)
+	errs.CheckE(err)
+	defer rereq.Close()
+
+	type datagram struct {
+		data      []byte
+		timestamp time.Time
+		recovered bool
+	}
+	done := make(chan struct{})
+	defer close(done)
+	datagrams := make(chan datagram)
+	readErrs := make(chan error, 2)
+	read := func(conn *net.UDPConn, recovered bool) {
+		for {
+			buf := make([]byte, 65536)
+			n, err := conn.Read(buf)
+			if err != nil {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if recovered {
+					// e.g. refused by rerequest server, unanswered requests are retried
+					log.Printf("moldudp64 %s: rerequest: %s\n", c.session, err)
+					continue
+				}
+				readErrs <- err
+				return
+			}
+			select {
+			case datagrams <- datagram{buf[:n], time.Now(), recovered}:
+			case <-done:
+				return
+			}
+		}
+	}
+	go read(feed, false)
+	go read(rereq, true)
+
+	ticker := time.NewTicker(c.config.Timeout / 4)
+	defer ticker.Stop()
+	for !c.ended || c.expected < c.highest {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErrs:
+			errs.CheckE(err)
+		case d := <-datagrams:
+			c.handler.HandlePacket(&recoveryPacket{data: d.data, timestamp: d.timestamp})
+			c.receive(d.data, d.timestamp, d.recovered)
+		case <-ticker.C:
+		}
+		c.rerequest(rereq, time.Now())
+	}
+	log.Printf("moldudp64 %s: end of session at seq %d\n", c.session, c.expected)
+	return
+}
+
+// takes messages of MoldUDP64 packet from the feed or rerequest response
+func (c *RecoveryClient) receive(data []byte, timestamp time.Time, recovered bool) {
+	if len(data) < moldUDP64HeaderSize {
+		log.Printf("moldudp64: ignore short packet of %d bytes\n", len(data))
+		return
+	}
+	session := string(data[0:10])
+	seq := binary.BigEndian.Uint64(data[10:18])
+	count := int(binary.BigEndian.Uint16(data[18:20]))
+	if c.session == "" {
+		c.session = session
+		c.flow = gopacket.NewFlow(EndpointMoldUDP64Session, data[0:10:10], data[0:10:10])
+	} else if session != c.session {
+		log.Printf("moldudp64 %s: ignore packet of session %s\n", c.session, session)
+		return
+	}
+	if c.expected == 0 {
+		c.expected = seq
+	}
+	if count == moldUDP64EndOfSession {
+		c.ended = true
+		count = 0
+	}
+	data = data[moldUDP64HeaderSize:]
+	for i := 0; i < count; i++ {
+		if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+			log.Printf("moldudp64 %s: truncated packet at seq %d\n", c.session, seq+uint64(i))
+			break
+		}
+		length := 2 + int(binary.BigEndian.Uint16(data))
+		c.add(seq+uint64(i), data[2:length], timestamp, recovered)
+		data = data[length:]
+	}
+	if end := seq + uint64(count); end > c.highest {
+		c.highest = end
+	}
+	c.deliver()
+}
+
+func (c *RecoveryClient) add(seq uint64, data []byte, timestamp time.Time, recovered bool) {
+	if _, ok := c.pending[seq]; ok || seq < c.expected {
+		c.mu.Lock()
+		c.stats.Duplicates++
+		c.mu.Unlock()
+		return
+	}
+	if recovered {
+		c.mu.Lock()
+		c.stats.Recovered++
+		c.mu.Unlock()
+	}
+	c.pending[seq] = recoveryMessage{
+		data:      append([]byte(nil), data...),
+		timestamp: timestamp,
+	}
+}
+
+func (c *RecoveryClient) deliver() {
+	for {
+		m, ok := c.pending[c.expected]
+		if !ok {
+			return
+		}
+		delete(c.pending, c.expected)
+		if len(m.data) > 0 {
+			layer := IttoMessageTypeMetadata[m.data[0]].CreateLayer()
+			if err := layer.DecodeFromBytes(m.data, gopacket.NilDecodeFeedback); err != nil {
+				log.Printf("moldudp64 %s: seq %d: %s\n", c.session, c.expected, err)
+			} else {
+				c.handler.HandleMessage(&recoveryApplicationMessage{
+					layer:     layer,
+					flows:     []gopacket.Flow{c.flow},
+					seqNum:    c.expected,
+					timestamp: m.timestamp,
+				})
+			}
+		}
+		c.mu.Lock()
+		c.stats.Delivered++
+		c.mu.Unlock()
+		c.expected++
+	}
+}
+
+// requests the first missing messages unless already requested;
+// gives them up when request is not answered after retries
+func (c *RecoveryClient) rerequest(conn net.Conn, now time.Time) {
+	tries := 1
+	if c.req.count != 0 && c.req.seq == c.expected {
+		if now.Sub(c.req.sent) < c.config.Timeout {
+			return
+		}
+		if c.req.tries > c.config.Retries {
+			lost := 0
+			for ; lost < c.req.count && c.expected < c.highest; lost++ {
+				if _, ok := c.pending[c.expected]; ok {
+					break
+				}
+				c.expected++
+			}
+			log.Printf("moldudp64 %s: lost %d messages from seq %d after %d rerequests\n", c.session, lost, c.req.seq, c.req.tries)
+			c.mu.Lock()
+			c.stats.Lost += uint64(lost)
+			c.mu.Unlock()
+			c.deliver()
+		} else {
+			tries = c.req.tries + 1
+		}
+	}
+	c.req = recoveryRequest{}
+	if c.expected >= c.highest {
+		return
+	}
+	count := 0
+	for count < c.config.MaxMessages && c.expected+uint64(count) < c.highest {
+		if _, ok := c.pending[c.expected+uint64(count)]; ok {
+			break
+		}
+		count++
+	}
+	req := make([]byte, moldUDP64HeaderSize)
+	copy(req[0:10], c.session)
+	binary.BigEndian.PutUint64(req[10:18], c.expected)
+	binary.BigEndian.PutUint16(req[18:20], uint16(count))
+	if _, err := conn.Write(req); err != nil {
+		log.Printf("moldudp64 %s: rerequest: %s\n", c.session, err)
+	}
+	c.req = recoveryRequest{
+		seq:   c.expected,
+		count: count,
+		sent:  now,
+		tries: tries,
+	}
+	c.mu.Lock()
+	c.stats.Requests++
+	c.mu.Unlock()
+}
+
+type recoveryPacket struct {
+	data      []byte
+	timestamp time.Time
+}
+
+func (p *recoveryPacket) String() string {
+	return fmt.Sprintf("MoldUDP64 datagram: %d bytes @ %v", len(p.data), p.timestamp)
+}
+func (p *recoveryPacket) Data() []byte {
+	return p.data
+}
+func (p *recoveryPacket) Timestamp() time.Time {
+	return p.timestamp
+}
+
+type recoveryApplicationMessage struct {
+	layer     gopacket.Layer
+	flows     []gopacket.Flow
+	seqNum    uint64
+	timestamp time.Time
+}
+
+func (am *recoveryApplicationMessage) Layer() gopacket.Layer {
+	return am.layer
+}
+func (am *recoveryApplicationMessage) Flows() []gopacket.Flow {
+	return am.flows
+}
+func (am *recoveryApplicationMessage) SequenceNumber() uint64 {
+	return am.seqNum
+}
+func (am *recoveryApplicationMessage) Timestamp() time.Time {
+	return am.timestamp
+}
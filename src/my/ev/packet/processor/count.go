@@ -0,0 +1,55 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package processor
+
+import (
+	"io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"my/ev/packet"
+)
+
+// number of application messages in ethernet frame, 0 if it cannot be decoded
+func CountMessages(data []byte) int {
+	var h messageCounter
+	p := NewProcessor()
+	p.SetObtainer(&singlePacketObtainer{data: data})
+	p.SetHandler(&h)
+	if err := p.ProcessAll(); err != nil {
+		return 0
+	}
+	return h.messages
+}
+
+type messageCounter struct {
+	packet.NopHandler
+	messages int
+}
+
+func (h *messageCounter) HandleMessage(_ packet.ApplicationMessage) {
+	h.messages++
+}
+
+type singlePacketObtainer struct {
+	data []byte
+	done bool
+}
+
+func (o *singlePacketObtainer) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if o.done {
+		return nil, ci, io.EOF
+	}
+	o.done = true
+	ci.CaptureLength = len(o.data)
+	ci.Length = len(o.data)
+	return o.data, ci, nil
+}
+func (o *singlePacketObtainer) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	return o.ReadPacketData()
+}
+func (o *singlePacketObtainer) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
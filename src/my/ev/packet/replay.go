@@ -4,11 +4,17 @@
 package packet
 
 import (
+	"errors"
 	"io"
+	"log"
+	"net"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/ikravets/errs"
 )
@@ -25,43 +31,158 @@ type ReplayConfig struct {
 	Limit     int
 	Pps       int
 	Loop      int
+	// send UDP payloads through ordinary sockets instead of raw frames;
+	// IfaceName is optional then and selects source address
+	Socket bool
+	// socket replay destinations, keyed by original "ip:port", "ip" (port is kept) or "*"
+	Remap map[string]string
+	// follow capture timestamps, Speed times faster; Pps then caps the rate
+	// allowing Burst packets back to back
+	Speed float64
+	Burst int
+	// with Speed, capture gaps longer than CompressIdle are shortened to CompressIdle
+	CompressIdle time.Duration
+	// header rewrite rules applied before sending
+	Rewrite []RewriteRule
+	// channels ("ip:port" or "ip") to replay, others are dropped; all if empty
+	Keep []string
+	// number of application messages in frame, for stepping by messages
+	CountMessages func(data []byte) int
 }
 
+// replay controllable while running; controls are applied between packets
+type ReplaySession interface {
+	Replay
+	Pause() error
+	Resume() error
+	// pauses and sends next n packets
+	Step(n int) error
+	// pauses and sends packets until n more application messages are sent; needs ReplayConfig.CountMessages
+	StepMessages(n int) error
+	SeekPacket(index int) error
+	SeekTime(t time.Time) error
+	// 0 for as fast as possible (or Pps)
+	SetSpeed(speed float64) error
+	Status() ReplayStatus
+}
+
+type ReplayStatus struct {
+	Packet    int       // index of the next packet in dump
+	Packets   int       // in dump
+	Start     time.Time // capture time of the first packet
+	Timestamp time.Time // capture time of the last sent packet
+	Paused    bool
+	Speed     float64
+}
+
+var ReplayFinishedError = errors.New("replay finished")
+
 type replay struct {
 	conf       ReplayConfig
 	stopCh     chan struct{}
 	progressCh chan float64
+	finishedCh chan struct{}
+	session    bool
+	controlCh  chan replayControl
+	// state changed by controls, owned by Run goroutine
+	index        *replayIndex
+	file         *PcapFile
+	progress     *progress
+	tp           timestampPacer
+	pos          int // index of the next packet to read
+	paused       bool
+	seeked       bool
+	stepPackets  int
+	stepMessages int
+	statusMu     sync.Mutex
+	status       ReplayStatus
+}
+
+type replayControl struct {
+	f   func() error
+	res chan error
 }
 
 func NewReplay(c *ReplayConfig) Replay {
+	return newReplay(c)
+}
+
+// controlled replay; classic pcap file is indexed on the first pass, other formats are not seekable
+func NewReplaySession(c *ReplayConfig) ReplaySession {
+	r := newReplay(c)
+	r.session = true
+	r.controlCh = make(chan replayControl)
+	return r
+}
+
+func newReplay(c *ReplayConfig) *replay {
 	return &replay{
 		conf:       *c,
 		stopCh:     make(chan struct{}),
 		progressCh: make(chan float64, 1),
+		finishedCh: make(chan struct{}),
+		status:     ReplayStatus{Speed: c.Speed},
 	}
 }
 
+type packetSource interface {
+	ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error)
+	Close()
+}
+
+func (r *replay) openInput() (in packetSource, err error) {
+	if r.index == nil {
+		return pcap.OpenOffline(r.conf.DumpName)
+	}
+	r.file, err = OpenPcapFile(r.conf.DumpName)
+	return r.file, err
+}
+
 func (r *replay) Run() (err error) {
 	defer errs.PassE(&err)
+	defer close(r.finishedCh)
 	defer close(r.progressCh)
-	progress, err := newProgress(r.conf.DumpName, r.conf.Loop, r.conf.Limit, r.progressCh)
+	r.progress, err = newProgress(r.conf.DumpName, r.conf.Loop, r.conf.Limit, r.progressCh)
 	errs.CheckE(err)
+	if r.conf.Speed != 0 || r.session {
+		errs.CheckE(r.progress.scanCaptureTime(r.conf.DumpName))
+	}
+	if r.session {
+		r.index, err = loadReplayIndex(r.conf.DumpName)
+		if err == notClassicPcapError {
+			log.Printf("%s: %s, seeking is disabled\n", r.conf.DumpName, err)
+			err = nil
+		}
+		errs.CheckE(err)
+		r.updateStatus(func(s *ReplayStatus) {
+			if r.index != nil {
+				s.Packets = int(r.index.packets)
+			}
+			s.Start = r.progress.firstTimestamp
+		})
+	}
+	var rw *rewriter
+	if len(r.conf.Rewrite) != 0 || len(r.conf.Keep) != 0 {
+		rw = newRewriter(r.conf.Rewrite, r.conf.Keep)
+	}
 
 	loop := r.conf.Loop
 	if loop == 0 {
 		loop = 1
 	}
 	for j := 0; j < loop; j++ {
-		progress.startIteration()
-		in, err := pcap.OpenOffline(r.conf.DumpName)
+		r.progress.startIteration()
+		in, err := r.openInput()
 		errs.CheckE(err)
 		defer in.Close()
 
-		out, err := pcap.OpenLive(r.conf.IfaceName, 65536, false, pcap.BlockForever)
+		out, err := r.openOutput()
 		errs.CheckE(err)
 		defer out.Close()
 
-		start := time.Now()
+		r.tp = timestampPacer{conf: &r.conf, start: time.Now()}
+		r.pos = 0
+		r.updateStatus(func(s *ReplayStatus) { s.Packet = 0 })
 		for i := 0; i < r.conf.Limit || r.conf.Limit == 0; i++ {
 			select {
 			case <-r.stopCh:
@@ -73,22 +194,384 @@ func (r *replay) Run() (err error) {
 				break
 			}
 			errs.CheckE(err)
-			errs.CheckE(out.WritePacketData(data))
-			progress.addPacket(ci)
-			if r.conf.Pps != 0 {
-				now := time.Now()
-				expected := time.Duration(i) * time.Second / time.Duration(r.conf.Pps)
-				actual := now.Sub(start)
-				diff := expected - actual
-				if diff > 0 {
-					time.Sleep(diff)
+			r.progress.addPacket(ci)
+			r.pos++
+			orig := data
+			if rw != nil {
+				data, err = rw.rewrite(data)
+				errs.CheckE(err)
+				if data == nil {
+					r.updateStatus(func(s *ReplayStatus) { s.Packet = r.pos })
+					continue
 				}
 			}
+			send, ok := r.pace(ci.Timestamp)
+			if !ok {
+				return nil
+			}
+			if !send {
+				continue
+			}
+			errs.CheckE(out.write(data))
+			r.sent(orig, ci)
 		}
 	}
 	return
 }
 
+// waits until packet captured at ts is due, applying controls meanwhile;
+// returns ok false on stop, send false if replay was sought away from the packet
+func (r *replay) pace(ts time.Time) (send, ok bool) {
+	r.seeked = false
+	for {
+		if !r.control() {
+			return false, false
+		}
+		if r.seeked {
+			return false, true
+		}
+		if r.paused || r.conf.Speed == 0 && r.conf.Pps == 0 {
+			return true, true
+		}
+		switch r.sleepUntil(r.tp.sendTime(ts)) {
+		case sleepStopped:
+			return false, false
+		case sleepDone:
+			return true, true
+		}
+		r.tp.reset()
+	}
+}
+
+func (r *replay) sent(data []byte, ci gopacket.CaptureInfo) {
+	r.updateStatus(func(s *ReplayStatus) {
+		s.Packet = r.pos
+		s.Timestamp = ci.Timestamp
+	})
+	if !r.paused {
+		return
+	}
+	if r.stepPackets > 0 {
+		r.stepPackets--
+	}
+	if r.stepMessages > 0 {
+		r.stepMessages -= r.conf.CountMessages(data)
+	}
+}
+
+// applies pending controls, blocking while paused and not stepping; returns false on stop
+func (r *replay) control() bool {
+	for {
+		if r.paused && r.stepPackets <= 0 && r.stepMessages <= 0 {
+			select {
+			case <-r.stopCh:
+				return false
+			case c := <-r.controlCh:
+				c.res <- c.f()
+			}
+			continue
+		}
+		select {
+		case <-r.stopCh:
+			return false
+		case c := <-r.controlCh:
+			c.res <- c.f()
+		default:
+			return true
+		}
+	}
+}
+
+const (
+	sleepDone = iota
+	sleepStopped
+	sleepInterrupted // by control
+)
+
+func (r *replay) sleepUntil(t time.Time) int {
+	d := t.Sub(time.Now())
+	if d <= 0 {
+		return sleepDone
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-r.stopCh:
+		return sleepStopped
+	case c := <-r.controlCh:
+		c.res <- c.f()
+		return sleepInterrupted
+	case <-timer.C:
+		return sleepDone
+	}
+}
+
+// runs f in Run goroutine between packets
+func (r *replay) do(f func() error) error {
+	c := replayControl{f, make(chan error, 1)}
+	select {
+	case r.controlCh <- c:
+		return <-c.res
+	case <-r.finishedCh:
+		return ReplayFinishedError
+	}
+}
+
+func (r *replay) updateStatus(f func(*ReplayStatus)) {
+	r.statusMu.Lock()
+	f(&r.status)
+	r.statusMu.Unlock()
+}
+
+func (r *replay) Status() ReplayStatus {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	return r.status
+}
+
+func (r *replay) Pause() error {
+	return r.do(func() error {
+		r.paused, r.stepPackets, r.stepMessages = true, 0, 0
+		r.updateStatus(func(s *ReplayStatus) { s.Paused = true })
+		return nil
+	})
+}
+
+func (r *replay) Resume() error {
+	return r.do(func() error {
+		r.paused = false
+		r.tp.reset()
+		r.updateStatus(func(s *ReplayStatus) { s.Paused = false })
+		return nil
+	})
+}
+
+func (r *replay) Step(n int) error {
+	return r.do(func() error {
+		r.paused, r.stepPackets, r.stepMessages = true, n, 0
+		r.updateStatus(func(s *ReplayStatus) { s.Paused = true })
+		return nil
+	})
+}
+
+func (r *replay) StepMessages(n int) error {
+	return r.do(func() error {
+		if r.conf.CountMessages == nil {
+			return errors.New("message counting is not configured")
+		}
+		r.paused, r.stepPackets, r.stepMessages = true, 0, n
+		r.updateStatus(func(s *ReplayStatus) { s.Paused = true })
+		return nil
+	})
+}
+
+func (r *replay) SeekPacket(index int) error {
+	return r.do(func() error {
+		if r.file == nil {
+			return NotSeekableError
+		}
+		if err := r.index.seekPacket(r.file, int64(index)); err != nil {
+			return err
+		}
+		r.sought(index)
+		return nil
+	})
+}
+
+func (r *replay) SeekTime(t time.Time) error {
+	return r.do(func() error {
+		if r.file == nil {
+			return NotSeekableError
+		}
+		index, err := r.index.seekTime(r.file, t)
+		if err != nil {
+			return err
+		}
+		r.sought(int(index))
+		return nil
+	})
+}
+
+func (r *replay) sought(index int) {
+	r.seeked = true
+	r.pos = index
+	r.tp.reset()
+	r.progress.donePackets = index
+	r.progress.doneSizeApprox = int(r.file.offset)
+	r.updateStatus(func(s *ReplayStatus) { s.Packet = index })
+}
+
+func (r *replay) SetSpeed(speed float64) error {
+	return r.do(func() error {
+		if speed < 0 {
+			return errors.New("negative speed")
+		}
+		r.conf.Speed = speed
+		r.tp.reset()
+		r.updateStatus(func(s *ReplayStatus) { s.Speed = speed })
+		return nil
+	})
+}
+
+// paces by capture timestamps if Speed is set, otherwise by Pps only
+type timestampPacer struct {
+	conf        *ReplayConfig
+	start       time.Time
+	first, prev time.Time
+	started     bool
+	idle        time.Duration // removed from capture time by CompressIdle
+	tat         time.Time     // theoretical arrival time of rate cap
+	packets     int
+}
+
+// restarts pacing from now, e.g. after pause or seek
+func (tp *timestampPacer) reset() {
+	*tp = timestampPacer{conf: tp.conf, start: time.Now()}
+}
+
+func (tp *timestampPacer) sendTime(ts time.Time) (t time.Time) {
+	if tp.conf.Speed == 0 {
+		t = tp.start.Add(time.Duration(tp.packets) * time.Second / time.Duration(tp.conf.Pps))
+		tp.packets++
+		return
+	}
+	if !tp.started {
+		tp.first, tp.prev, tp.started = ts, ts, true
+	}
+	if gap := ts.Sub(tp.prev); tp.conf.CompressIdle != 0 && gap > tp.conf.CompressIdle {
+		tp.idle += gap - tp.conf.CompressIdle
+	}
+	tp.prev = ts
+	t = tp.start.Add(time.Duration(float64(ts.Sub(tp.first)-tp.idle) / tp.conf.Speed))
+	if tp.conf.Pps != 0 {
+		// generic cell rate algorithm
+		interval := time.Second / time.Duration(tp.conf.Pps)
+		burst := tp.conf.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		if tp.tat.Before(t) {
+			tp.tat = t
+		}
+		if earliest := tp.tat.Add(-time.Duration(burst-1) * interval); earliest.After(t) {
+			t = earliest
+		}
+		tp.tat = tp.tat.Add(interval)
+	}
+	return
+}
+
+type replayOutput interface {
+	write(data []byte) error
+	Close()
+}
+
+func (r *replay) openOutput() (out replayOutput, err error) {
+	if r.conf.Socket {
+		return newSocketOutput(r.conf.IfaceName, r.conf.Remap)
+	}
+	handle, err := pcap.OpenLive(r.conf.IfaceName, 65536, false, pcap.BlockForever)
+	if err != nil {
+		return
+	}
+	return &pcapOutput{handle}, nil
+}
+
+type pcapOutput struct {
+	*pcap.Handle
+}
+
+func (o *pcapOutput) write(data []byte) error {
+	return o.WritePacketData(data)
+}
+
+// sends UDP payloads of replayed frames in order through one unconnected socket, other frames are skipped
+type socketOutput struct {
+	conn    *net.UDPConn
+	remap   map[string]string
+	dsts    map[string]*net.UDPAddr
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+	udp     layers.UDP
+	ip      layers.IPv4
+}
+
+func newSocketOutput(ifaceName string, remap map[string]string) (o *socketOutput, err error) {
+	defer errs.PassE(&err)
+	o = &socketOutput{
+		remap: remap,
+		dsts:  make(map[string]*net.UDPAddr),
+	}
+	var laddr *net.UDPAddr
+	if ifaceName != "" {
+		iface, err := net.InterfaceByName(ifaceName)
+		errs.CheckE(err)
+		addrs, err := iface.Addrs()
+		errs.CheckE(err)
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+				laddr = &net.UDPAddr{IP: ipn.IP}
+				break
+			}
+		}
+		errs.Check(laddr != nil, "no IPv4 address", ifaceName)
+	}
+	o.conn, err = net.ListenUDP("udp", laddr)
+	errs.CheckE(err)
+	var eth layers.Ethernet
+	var dot1q layers.Dot1Q
+	var payload gopacket.Payload
+	o.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &dot1q, &o.ip, &o.udp, &payload)
+	return
+}
+
+func (o *socketOutput) write(data []byte) (err error) {
+	// layers following UDP are not supported by parser, but are not needed either
+	o.parser.DecodeLayers(data, &o.decoded)
+	for _, lt := range o.decoded {
+		if lt == layers.LayerTypeUDP {
+			return o.send()
+		}
+	}
+	return nil
+}
+
+func (o *socketOutput) send() (err error) {
+	defer errs.PassE(&err)
+	orig := net.JoinHostPort(o.ip.DstIP.String(), strconv.Itoa(int(o.udp.DstPort)))
+	dst, ok := o.dsts[orig]
+	if !ok {
+		dst, err = net.ResolveUDPAddr("udp", o.destination(orig))
+		errs.CheckE(err)
+		o.dsts[orig] = dst
+	}
+	_, err = o.conn.WriteToUDP(o.udp.Payload, dst)
+	errs.CheckE(err)
+	return
+}
+
+func (o *socketOutput) destination(orig string) string {
+	if d, ok := o.remap[orig]; ok {
+		return d
+	}
+	host, port, _ := net.SplitHostPort(orig)
+	d, ok := o.remap[host]
+	if !ok {
+		d, ok = o.remap["*"]
+	}
+	if !ok {
+		return orig
+	}
+	if _, _, err := net.SplitHostPort(d); err == nil {
+		return d
+	}
+	return net.JoinHostPort(d, port)
+}
+
+func (o *socketOutput) Close() {
+	o.conn.Close()
+}
+
 func (r *replay) Stop() {
 	close(r.stopCh)
 }
@@ -109,6 +592,9 @@ type progress struct {
 	doneSizeApprox   int
 	currentIteration int
 	progressCh       chan<- float64
+	firstTimestamp   time.Time
+	captureTime      time.Duration
+	doneCaptureTime  time.Duration
 }
 
 func newProgress(dumpFileName string, totalIterations int, limit int, progressCh chan<- float64) (p *progress, err error) {
@@ -126,17 +612,41 @@ func newProgress(dumpFileName string, totalIterations int, limit int, progressCh
 	p.totalDumpSize = int(fi.Size())
 	return
 }
+
+// makes progress follow capture time of (limited) dump
+func (p *progress) scanCaptureTime(dumpFileName string) (err error) {
+	defer errs.PassE(&err)
+	in, err := pcap.OpenOffline(dumpFileName)
+	errs.CheckE(err)
+	defer in.Close()
+	var last time.Time
+	for i := 0; i < p.totalPackets || p.totalPackets == 0; i++ {
+		_, ci, err := in.ZeroCopyReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		errs.CheckE(err)
+		if i == 0 {
+			p.firstTimestamp = ci.Timestamp
+		}
+		last = ci.Timestamp
+	}
+	p.captureTime = last.Sub(p.firstTimestamp)
+	return
+}
 func (p *progress) startIteration() {
 	if p.currentIteration == 1 {
 		p.totalPackets = p.donePackets
 	}
 	p.donePackets = 0
 	p.doneSizeApprox = 0
+	p.doneCaptureTime = 0
 	p.currentIteration++
 }
 func (p *progress) addPacket(ci gopacket.CaptureInfo) {
 	p.donePackets++
 	p.doneSizeApprox += 16 + ci.CaptureLength
+	p.doneCaptureTime = ci.Timestamp.Sub(p.firstTimestamp)
 	p.emitProgress()
 }
 func (p *progress) emitProgress() {
@@ -144,7 +654,9 @@ func (p *progress) emitProgress() {
 		return
 	}
 	var done float64
-	if p.totalPackets > 0 {
+	if p.captureTime > 0 {
+		done = float64(p.doneCaptureTime) / float64(p.captureTime)
+	} else if p.totalPackets > 0 {
 		done = float64(p.donePackets) / float64(p.totalPackets)
 	} else if p.totalDumpSize > 0 {
 		done = float64(p.doneSizeApprox) / float64(p.totalDumpSize)
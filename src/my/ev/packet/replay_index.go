@@ -0,0 +1,242 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package packet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/ikravets/errs"
+)
+
+var (
+	NotSeekableError    = errors.New("replay is not seekable")
+	notClassicPcapError = errors.New("not a classic pcap file")
+)
+
+// seekable reader of classic (not pcapng) pcap file
+type PcapFile struct {
+	file       *os.File
+	br         *bufio.Reader
+	order      binary.ByteOrder
+	nanoFactor int64
+	offset     int64 // of the next record
+	hdr        [16]byte
+	buf        []byte
+}
+
+const pcapFileHeaderSize = 24
+
+func OpenPcapFile(name string) (f *PcapFile, err error) {
+	defer errs.PassE(&err)
+	file, err := os.Open(name)
+	errs.CheckE(err)
+	f = &PcapFile{
+		file: file,
+		br:   bufio.NewReaderSize(file, 1<<20),
+	}
+	var hdr [pcapFileHeaderSize]byte
+	_, err = io.ReadFull(f.br, hdr[:])
+	if err != nil {
+		file.Close()
+		errs.CheckE(err)
+	}
+	switch binary.LittleEndian.Uint32(hdr[0:4]) {
+	case 0xa1b2c3d4:
+		f.order, f.nanoFactor = binary.LittleEndian, 1000
+	case 0xd4c3b2a1:
+		f.order, f.nanoFactor = binary.BigEndian, 1000
+	case 0xa1b23c4d:
+		f.order, f.nanoFactor = binary.LittleEndian, 1
+	case 0x4d3cb2a1:
+		f.order, f.nanoFactor = binary.BigEndian, 1
+	default:
+		file.Close()
+		return nil, notClassicPcapError
+	}
+	f.offset = pcapFileHeaderSize
+	return
+}
+
+// returned data is valid until the next call
+func (f *PcapFile) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if _, err = io.ReadFull(f.br, f.hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return
+	}
+	sec := int64(f.order.Uint32(f.hdr[0:4]))
+	frac := int64(f.order.Uint32(f.hdr[4:8])) * f.nanoFactor
+	ci.Timestamp = time.Unix(sec, frac)
+	ci.CaptureLength = int(f.order.Uint32(f.hdr[8:12]))
+	ci.Length = int(f.order.Uint32(f.hdr[12:16]))
+	if cap(f.buf) < ci.CaptureLength {
+		f.buf = make([]byte, ci.CaptureLength)
+	}
+	data = f.buf[:ci.CaptureLength]
+	if _, err = io.ReadFull(f.br, data); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return
+	}
+	f.offset += int64(len(f.hdr) + ci.CaptureLength)
+	return
+}
+
+func (f *PcapFile) SeekTo(offset int64) (err error) {
+	if _, err = f.file.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	f.br.Reset(f.file)
+	f.offset = offset
+	return
+}
+
+// of the next record
+func (f *PcapFile) Offset() int64 {
+	return f.offset
+}
+
+func (f *PcapFile) Close() {
+	f.file.Close()
+}
+
+// offsets and timestamps of every replayIndexStride-th packet, kept in sidecar file
+type replayIndex struct {
+	packets int64
+	entries []replayIndexEntry
+}
+
+type replayIndexHeader struct {
+	Magic   uint32
+	Stride  uint32
+	Packets int64
+}
+
+type replayIndexEntry struct {
+	Offset    int64
+	Timestamp int64 // ns
+}
+
+const (
+	replayIndexStride = 1024
+	replayIndexMagic  = 0x31584449 // "IDX1"
+)
+
+func replayIndexFileName(dumpName string) string {
+	return dumpName + ".idx"
+}
+
+// loads sidecar index, building it on the first pass over the dump
+func loadReplayIndex(dumpName string) (idx *replayIndex, err error) {
+	defer errs.PassE(&err)
+	dfi, err := os.Stat(dumpName)
+	errs.CheckE(err)
+	if ifi, err := os.Stat(replayIndexFileName(dumpName)); err == nil && !ifi.ModTime().Before(dfi.ModTime()) {
+		if idx, err = readReplayIndex(replayIndexFileName(dumpName)); err == nil {
+			return idx, nil
+		}
+		log.Printf("rebuilding bad index: %s\n", err)
+	}
+	log.Printf("building index of %s\n", dumpName)
+	f, err := OpenPcapFile(dumpName)
+	if err == notClassicPcapError {
+		return
+	}
+	errs.CheckE(err)
+	defer f.Close()
+	idx = &replayIndex{}
+	for {
+		offset := f.offset
+		_, ci, err := f.ZeroCopyReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		errs.CheckE(err)
+		if idx.packets%replayIndexStride == 0 {
+			idx.entries = append(idx.entries, replayIndexEntry{offset, ci.Timestamp.UnixNano()})
+		}
+		idx.packets++
+	}
+	if err := idx.write(replayIndexFileName(dumpName)); err != nil {
+		// e.g. read-only dump directory, the index is rebuilt next time
+		log.Printf("using index in memory only: %s\n", err)
+	}
+	return
+}
+
+func readReplayIndex(fileName string) (idx *replayIndex, err error) {
+	defer errs.PassE(&err)
+	file, err := os.Open(fileName)
+	errs.CheckE(err)
+	defer file.Close()
+	r := bufio.NewReader(file)
+	var hdr replayIndexHeader
+	errs.CheckE(binary.Read(r, binary.LittleEndian, &hdr))
+	errs.Check(hdr.Magic == replayIndexMagic && hdr.Stride == replayIndexStride, "bad index header", fileName)
+	idx = &replayIndex{
+		packets: hdr.Packets,
+		entries: make([]replayIndexEntry, (hdr.Packets+replayIndexStride-1)/replayIndexStride),
+	}
+	errs.CheckE(binary.Read(r, binary.LittleEndian, idx.entries))
+	return
+}
+
+func (idx *replayIndex) write(fileName string) (err error) {
+	defer errs.PassE(&err)
+	file, err := os.Create(fileName)
+	errs.CheckE(err)
+	defer func() { errs.CheckE(file.Close()) }()
+	w := bufio.NewWriter(file)
+	errs.CheckE(binary.Write(w, binary.LittleEndian, replayIndexHeader{replayIndexMagic, replayIndexStride, idx.packets}))
+	errs.CheckE(binary.Write(w, binary.LittleEndian, idx.entries))
+	errs.CheckE(w.Flush())
+	return
+}
+
+// positions f at packet index
+func (idx *replayIndex) seekPacket(f *PcapFile, index int64) (err error) {
+	defer errs.PassE(&err)
+	errs.Check(index >= 0 && index < idx.packets, "packet index out of range", index, idx.packets)
+	e := idx.entries[index/replayIndexStride]
+	errs.CheckE(f.SeekTo(e.Offset))
+	for i := int64(0); i < index%replayIndexStride; i++ {
+		_, _, err := f.ZeroCopyReadPacketData()
+		errs.CheckE(err)
+	}
+	return
+}
+
+// positions f at the first packet captured at t or later; returns its index
+func (idx *replayIndex) seekTime(f *PcapFile, t time.Time) (index int64, err error) {
+	defer errs.PassE(&err)
+	ns := t.UnixNano()
+	i := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].Timestamp > ns }) - 1
+	if i < 0 {
+		i = 0
+	}
+	errs.Check(len(idx.entries) > 0, "empty dump")
+	index = int64(i) * replayIndexStride
+	errs.CheckE(f.SeekTo(idx.entries[i].Offset))
+	for ; index < idx.packets; index++ {
+		offset := f.offset
+		_, ci, err := f.ZeroCopyReadPacketData()
+		errs.CheckE(err)
+		if ci.Timestamp.UnixNano() >= ns {
+			errs.CheckE(f.SeekTo(offset))
+			return index, nil
+		}
+	}
+	errs.Check(false, "time is after end of dump", t)
+	return
+}
@@ -0,0 +1,187 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package packet
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/ikravets/errs"
+)
+
+// header rewrite of replayed UDP frames; zero fields are not changed
+type RewriteRule struct {
+	Channel string // original destination "ip:port" or "ip", empty for all channels
+	SrcMAC  net.HardwareAddr
+	DstMAC  net.HardwareAddr
+	SrcIP   net.IP
+	DstIP   net.IP
+	SrcPort int
+	DstPort int
+	Vlan    int // VLAN id to set, pushing a tag if untagged
+	VlanPop bool
+}
+
+// parses comma-separated list of key=value, e.g.
+// "channel=233.54.12.1:18001,dst-mac=01:00:5e:00:00:01,src-mac=00:16:21:2c:37:42,dst-ip=239.1.1.1,src-ip=10.0.0.1,dst-port=18001,src-port=1,vlan=12"
+// vlan=pop removes VLAN tag
+func ParseRewriteRule(s string) (rr RewriteRule, err error) {
+	defer errs.PassE(&err)
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		p := strings.SplitN(kv, "=", 2)
+		errs.Check(len(p) == 2, "bad rewrite spec", kv)
+		k, v := p[0], p[1]
+		mac := func(dst *net.HardwareAddr) {
+			*dst, err = net.ParseMAC(v)
+			errs.CheckE(err)
+		}
+		ip := func(dst *net.IP) {
+			*dst = net.ParseIP(v).To4()
+			errs.Check(*dst != nil, "bad IPv4 address", kv)
+		}
+		port := func(dst *int) {
+			*dst, err = strconv.Atoi(v)
+			errs.CheckE(err)
+			errs.Check(*dst > 0 && *dst < 65536, "port out of range", kv)
+		}
+		switch k {
+		case "channel":
+			rr.Channel = v
+		case "src-mac":
+			mac(&rr.SrcMAC)
+		case "dst-mac":
+			mac(&rr.DstMAC)
+		case "src-ip":
+			ip(&rr.SrcIP)
+		case "dst-ip":
+			ip(&rr.DstIP)
+		case "src-port":
+			port(&rr.SrcPort)
+		case "dst-port":
+			port(&rr.DstPort)
+		case "vlan":
+			if v == "pop" {
+				rr.VlanPop = true
+			} else {
+				rr.Vlan, err = strconv.Atoi(v)
+				errs.CheckE(err)
+				errs.Check(rr.Vlan > 0 && rr.Vlan < 4095, "VLAN id out of range", kv)
+			}
+		default:
+			errs.Check(false, "unknown rewrite", k)
+		}
+	}
+	return
+}
+
+// applies all matching rules in order, recomputing checksums; frames are serialized into a reused buffer
+type rewriter struct {
+	rules   []RewriteRule
+	keep    map[string]bool
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+	eth     layers.Ethernet
+	dot1q   layers.Dot1Q
+	ip      layers.IPv4
+	udp     layers.UDP
+	payload gopacket.Payload
+	sb      gopacket.SerializeBuffer
+}
+
+func newRewriter(rules []RewriteRule, keep []string) *rewriter {
+	rw := &rewriter{
+		rules: rules,
+		sb:    gopacket.NewSerializeBuffer(),
+	}
+	if len(keep) != 0 {
+		rw.keep = make(map[string]bool)
+		for _, ch := range keep {
+			rw.keep[ch] = true
+		}
+	}
+	rw.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &rw.eth, &rw.dot1q, &rw.ip, &rw.udp, &rw.payload)
+	return rw
+}
+
+// returns nil for dropped frame; frames other than IPv4 UDP are passed as is unless there is keep list
+func (rw *rewriter) rewrite(data []byte) (out []byte, err error) {
+	defer errs.PassE(&err)
+	// layers following UDP are not supported by parser, but are not needed either
+	rw.parser.DecodeLayers(data, &rw.decoded)
+	tagged, isUdp := false, false
+	for _, lt := range rw.decoded {
+		switch lt {
+		case layers.LayerTypeDot1Q:
+			tagged = true
+		case layers.LayerTypeUDP:
+			isUdp = true
+		}
+	}
+	if !isUdp {
+		if rw.keep != nil {
+			return nil, nil
+		}
+		return data, nil
+	}
+	dstIP := rw.ip.DstIP.String()
+	channel := net.JoinHostPort(dstIP, strconv.Itoa(int(rw.udp.DstPort)))
+	if rw.keep != nil && !rw.keep[channel] && !rw.keep[dstIP] {
+		return nil, nil
+	}
+	for _, r := range rw.rules {
+		if r.Channel != "" && r.Channel != channel && r.Channel != dstIP {
+			continue
+		}
+		if r.SrcMAC != nil {
+			rw.eth.SrcMAC = r.SrcMAC
+		}
+		if r.DstMAC != nil {
+			rw.eth.DstMAC = r.DstMAC
+		}
+		if r.SrcIP != nil {
+			rw.ip.SrcIP = r.SrcIP
+		}
+		if r.DstIP != nil {
+			rw.ip.DstIP = r.DstIP
+		}
+		if r.SrcPort != 0 {
+			rw.udp.SrcPort = layers.UDPPort(r.SrcPort)
+		}
+		if r.DstPort != 0 {
+			rw.udp.DstPort = layers.UDPPort(r.DstPort)
+		}
+		if r.VlanPop {
+			tagged = false
+		}
+		if r.Vlan != 0 {
+			if !tagged {
+				rw.dot1q = layers.Dot1Q{}
+				tagged = true
+			}
+			rw.dot1q.VLANIdentifier = uint16(r.Vlan)
+		}
+	}
+	ls := []gopacket.SerializableLayer{&rw.eth}
+	if tagged {
+		rw.eth.EthernetType = layers.EthernetTypeDot1Q
+		rw.dot1q.Type = layers.EthernetTypeIPv4
+		ls = append(ls, &rw.dot1q)
+	} else {
+		rw.eth.EthernetType = layers.EthernetTypeIPv4
+	}
+	errs.CheckE(rw.udp.SetNetworkLayerForChecksum(&rw.ip))
+	ls = append(ls, &rw.ip, &rw.udp, gopacket.Payload(rw.udp.Payload))
+	so := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	errs.CheckE(gopacket.SerializeLayers(rw.sb, so, ls...))
+	return rw.sb.Bytes(), nil
+}
@@ -0,0 +1,153 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package packet
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/ikravets/errs"
+)
+
+// joins multicast address on iface (system default if empty); listens on unicast address as is
+func ListenUDP(address string, iface string) (conn *net.UDPConn, err error) {
+	defer errs.PassE(&err)
+	addr, err := net.ResolveUDPAddr("udp", address)
+	errs.CheckE(err)
+	if !addr.IP.IsMulticast() {
+		return net.ListenUDP("udp", addr)
+	}
+	var ifi *net.Interface
+	if iface != "" {
+		ifi, err = net.InterfaceByName(iface)
+		errs.CheckE(err)
+	}
+	return net.ListenMulticastUDP("udp", ifi, addr)
+}
+
+// live obtainer of UDP datagrams received on a set of addresses;
+// datagrams are wrapped in synthetic Ethernet, IPv4 and UDP headers with the listened address as destination
+type UdpObtainer struct {
+	conns     []*net.UDPConn
+	packets   chan udpPacket
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type udpPacket struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+var _ Obtainer = &UdpObtainer{}
+
+func NewUdpObtainer(addrs []string, iface string) (o *UdpObtainer, err error) {
+	o = &UdpObtainer{
+		packets: make(chan udpPacket, 10000),
+		done:    make(chan struct{}),
+	}
+	defer func() {
+		if err != nil {
+			o.Close()
+		}
+	}()
+	defer errs.PassE(&err)
+	for _, a := range addrs {
+		conn, err := ListenUDP(a, iface)
+		errs.CheckE(err)
+		o.conns = append(o.conns, conn)
+		dst, err := net.ResolveUDPAddr("udp", a)
+		errs.CheckE(err)
+		go o.read(conn, dst)
+	}
+	return
+}
+
+func (o *UdpObtainer) read(conn *net.UDPConn, dst *net.UDPAddr) {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 22, 33, 44, 55, 66},
+		DstMAC:       net.HardwareAddr{1, 0, 0x5e, 0, 0, 1},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		DstIP:    dst.IP.To4(),
+		TTL:      1,
+		Protocol: layers.IPProtocolUDP,
+	}
+	if ip.DstIP == nil {
+		ip.DstIP = net.IPv4zero.To4()
+	}
+	udp := &layers.UDP{DstPort: layers.UDPPort(dst.Port)}
+	so := gopacket.SerializeOptions{FixLengths: true}
+	buf := make([]byte, 65536)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-o.done:
+			default:
+				log.Printf("udp %s: %s\n", dst, err)
+			}
+			return
+		}
+		ip.SrcIP = src.IP.To4()
+		if ip.SrcIP == nil {
+			ip.SrcIP = net.IPv4zero.To4()
+		}
+		udp.SrcPort = layers.UDPPort(src.Port)
+		sb := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(sb, so, eth, ip, udp, gopacket.Payload(buf[:n])); err != nil {
+			log.Printf("udp %s: %s\n", dst, err)
+			continue
+		}
+		p := udpPacket{
+			data: sb.Bytes(),
+			ci: gopacket.CaptureInfo{
+				Timestamp:     time.Now(),
+				CaptureLength: len(sb.Bytes()),
+				Length:        len(sb.Bytes()),
+			},
+		}
+		select {
+		case o.packets <- p:
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// blocks until a datagram is received; returns io.EOF after Close
+func (o *UdpObtainer) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	select {
+	case p := <-o.packets:
+		return p.data, p.ci, nil
+	case <-o.done:
+		return nil, ci, io.EOF
+	}
+}
+func (o *UdpObtainer) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	return o.ReadPacketData()
+}
+func (o *UdpObtainer) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// stops receiving; safe to call from any goroutine
+func (o *UdpObtainer) Close() (err error) {
+	o.closeOnce.Do(func() {
+		close(o.done)
+		for _, conn := range o.conns {
+			if e := conn.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return
+}
@@ -6,6 +6,7 @@ package rec
 import (
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	"github.com/ikravets/errs"
@@ -33,6 +34,7 @@ type EfhLoggerConfig struct {
 	Printer         EfhLoggerPrinter
 	Mode            EfhLoggerOutputMode
 	AssumeTobUpdate bool
+	NoStatus        bool
 }
 
 type EfhLogger struct {
@@ -40,6 +42,9 @@ type EfhLogger struct {
 	printer   EfhLoggerPrinter
 	mode      EfhLoggerOutputMode
 	stream    Stream
+	noStatus  bool
+	// MIAX halts are per underlying
+	underlyingOptions map[string][]packet.OptionId
 }
 
 var _ sim.Observer = &EfhLogger{}
@@ -50,6 +55,9 @@ func NewEfhLogger(c EfhLoggerConfig) *EfhLogger {
 		printer:   c.Printer,
 		mode:      c.Mode,
 		stream:    *NewStream(),
+		noStatus:  c.NoStatus,
+
+		underlyingOptions: make(map[string][]packet.OptionId),
 	}
 	if l.printer == nil {
 		errs.Check(c.Writer != nil)
@@ -69,6 +77,10 @@ func NewEfhLogger(c EfhLoggerConfig) *EfhLogger {
 func (l *EfhLogger) MessageArrived(idm *sim.SimMessage) {
 	l.stream.MessageArrived(idm)
 	l.tobLogger.MessageArrived(idm)
+	if l.stream.getGap() {
+		// book is rebuilt after gap recovery
+		l.genUpdateStatus(EFHM_REFRESHED, packet.OptionIdUnknown)
+	}
 	if oid, price, size, err := idm.TradeInfo(); err == nil {
 		l.genUpdateTrades(oid, price, size)
 		return
@@ -80,6 +92,36 @@ func (l *EfhLogger) MessageArrived(idm *sim.SimMessage) {
 		l.genUpdateDefinitionsBats(m)
 	case *miax.TomMessageSeriesUpdate:
 		l.genUpdateDefinitionsMiax(m)
+		if idm.Subscribed(m.OptionId()) {
+			l.addUnderlyingOption(strings.TrimSpace(m.UnderlyingSymbol), m.OptionId())
+		}
+	case *bats.PitchMessageUnitClear:
+		// sim removes all orders of the unit
+		l.genUpdateStatus(EFHM_REFRESHED, packet.OptionIdUnknown)
+	case *nasdaq.IttoMessageSystemEvent:
+		if m.EventCode == 'C' { // End of Messages
+			l.genUpdateStatus(EFHM_STOPPED, packet.OptionIdUnknown)
+		}
+	case *bats.PitchMessageEndOfSession:
+		l.genUpdateStatus(EFHM_STOPPED, packet.OptionIdUnknown)
+	case *miax.TomMessageSystemState:
+		if m.Status == 'C' || m.Status == '2' { // End of System Hours, End of Test Session
+			l.genUpdateStatus(EFHM_STOPPED, packet.OptionIdUnknown)
+		}
+	case *nasdaq.IttoMessageOptionTradingAction:
+		if m.State == 'H' && idm.Subscribed(m.OptionId()) {
+			l.genUpdateStatus(EFHM_STOPPED, m.OptionId())
+		}
+	case *bats.PitchMessageTradingStatus:
+		if m.TradingStatus == 'H' && idm.Subscribed(m.OptionId()) {
+			l.genUpdateStatus(EFHM_STOPPED, m.OptionId())
+		}
+	case *miax.TomMessageUnderlyingTradeStatus:
+		if m.Status == 'H' {
+			for _, oid := range l.underlyingOptions[strings.TrimSpace(m.UnderlyingSymbol)] {
+				l.genUpdateStatus(EFHM_STOPPED, oid)
+			}
+		}
 	}
 }
 func (l *EfhLogger) OperationAppliedToOrders(operation sim.SimOperation) {
@@ -157,6 +199,22 @@ func (l *EfhLogger) genUpdateTrades(oid packet.OptionId, price packet.Price, siz
 	}
 	errs.CheckE(l.printer.PrintMessage(m))
 }
+func (l *EfhLogger) addUnderlyingOption(underlying string, oid packet.OptionId) {
+	for _, o := range l.underlyingOptions[underlying] {
+		if o == oid {
+			return
+		}
+	}
+	l.underlyingOptions[underlying] = append(l.underlyingOptions[underlying], oid)
+}
+
+func (l *EfhLogger) genUpdateStatus(messageType uint8, oid packet.OptionId) {
+	if l.noStatus {
+		return
+	}
+	m := l.genUpdateHeaderForOption(messageType, oid)
+	errs.CheckE(l.printer.PrintMessage(m))
+}
 func (l *EfhLogger) genUpdateDefinitionsNom(msg *nasdaq.IttoMessageOptionDirectory) {
 	m := efhm_definition_nom{
 		efhm_header: l.genUpdateHeaderForOption(EFHM_DEFINITION_NOM, msg.OptionId()),
@@ -218,3 +276,21 @@ func (p *testefhPrinter) PrintMessage(m efhMessage) error {
 	_, err := fmt.Fprintln(p.w, m)
 	return err
 }
+
+type binaryPrinter struct {
+	w io.Writer
+}
+
+var _ EfhLoggerPrinter = &binaryPrinter{}
+
+func NewBinaryPrinter(w io.Writer) EfhLoggerPrinter {
+	return &binaryPrinter{w: w}
+}
+func (p *binaryPrinter) PrintMessage(m efhMessage) (err error) {
+	defer errs.PassE(&err)
+	b, err := efhMessageBytes(m)
+	errs.CheckE(err)
+	_, err = p.w.Write(b)
+	errs.CheckE(err)
+	return
+}
@@ -0,0 +1,302 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package rec
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ikravets/errs"
+)
+
+type EfhDiffConfig struct {
+	IgnoreFields []string
+	MaxReports   int
+	Window       int
+}
+
+type EfhDiffKind byte
+
+const (
+	EfhDiffChanged EfhDiffKind = iota
+	EfhDiffMissing
+	EfhDiffExtra
+)
+
+var efhDiffKindNames = [...]string{
+	EfhDiffChanged: "changed",
+	EfhDiffMissing: "missing",
+	EfhDiffExtra:   "extra",
+}
+
+func (k EfhDiffKind) String() string {
+	return efhDiffKindNames[k]
+}
+
+type EfhDiffEntry struct {
+	Kind   EfhDiffKind
+	ExpPos int
+	ActPos int
+	Exp    *EfhDumpMessage
+	Act    *EfhDumpMessage
+	Fields []string
+}
+
+type efhDiffSummaryKey struct {
+	kind     EfhDiffKind
+	typeName string
+}
+
+type EfhDiff struct {
+	EfhDiffConfig
+	entries      []EfhDiffEntry
+	expNum       int
+	actNum       int
+	matchedNum   int
+	diffNum      int
+	byType       map[efhDiffSummaryKey]int
+	bySecurityId map[uint64]int
+}
+
+func NewEfhDiff(conf EfhDiffConfig) *EfhDiff {
+	d := &EfhDiff{
+		EfhDiffConfig: conf,
+		byType:        make(map[efhDiffSummaryKey]int),
+		bySecurityId:  make(map[uint64]int),
+	}
+	if d.MaxReports == 0 {
+		d.MaxReports = 10
+	}
+	if d.Window == 0 {
+		d.Window = 64
+	}
+	return d
+}
+
+func (d *EfhDiff) Same() bool {
+	return d.diffNum == 0
+}
+
+func (d *EfhDiff) Summary() string {
+	return fmt.Sprintf("messages: exp %d act %d matched %d differ %d", d.expNum, d.actNum, d.matchedNum, d.diffNum)
+}
+
+type efhDiffQueue struct {
+	r    EfhDumpReader
+	msgs []*EfhDumpMessage
+	pos  int
+	eof  bool
+}
+
+func (q *efhDiffQueue) fill(n int) (err error) {
+	for !q.eof && len(q.msgs) < n {
+		var m *EfhDumpMessage
+		if m, err = q.r.ReadMessage(); err == io.EOF {
+			q.eof, err = true, nil
+		} else if err != nil {
+			return
+		} else {
+			q.msgs = append(q.msgs, m)
+		}
+	}
+	return
+}
+func (q *efhDiffQueue) pop(n int) {
+	q.msgs = q.msgs[n:]
+	q.pos += n
+}
+
+// aligns messages using lookahead of Window messages to resync after missing or extra ones
+func (d *EfhDiff) Run(exp, act EfhDumpReader) (err error) {
+	defer errs.PassE(&err)
+	eq := &efhDiffQueue{r: exp}
+	aq := &efhDiffQueue{r: act}
+	for {
+		errs.CheckE(eq.fill(d.Window))
+		errs.CheckE(aq.fill(d.Window))
+		if len(eq.msgs) == 0 && len(aq.msgs) == 0 {
+			break
+		}
+		if len(aq.msgs) == 0 {
+			d.addMissing(eq, 1, aq.pos)
+			continue
+		}
+		if len(eq.msgs) == 0 {
+			d.addExtra(aq, 1, eq.pos)
+			continue
+		}
+		if fields := d.diffFields(eq.msgs[0], aq.msgs[0]); len(fields) == 0 {
+			d.matchedNum++
+			eq.pop(1)
+			aq.pop(1)
+			continue
+		}
+		ai := d.find(eq.msgs[0], aq.msgs[1:])
+		ei := d.find(aq.msgs[0], eq.msgs[1:])
+		if ai >= 0 && (ei < 0 || ai <= ei) {
+			d.addExtra(aq, ai+1, eq.pos)
+		} else if ei >= 0 {
+			d.addMissing(eq, ei+1, aq.pos)
+		} else {
+			d.add(EfhDiffEntry{
+				Kind:   EfhDiffChanged,
+				ExpPos: eq.pos,
+				ActPos: aq.pos,
+				Exp:    eq.msgs[0],
+				Act:    aq.msgs[0],
+				Fields: d.diffFields(eq.msgs[0], aq.msgs[0]),
+			})
+			eq.pop(1)
+			aq.pop(1)
+		}
+	}
+	d.expNum = eq.pos
+	d.actNum = aq.pos
+	return
+}
+
+func (d *EfhDiff) find(m *EfhDumpMessage, msgs []*EfhDumpMessage) int {
+	for i, m2 := range msgs {
+		if len(d.diffFields(m, m2)) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+func (d *EfhDiff) addMissing(eq *efhDiffQueue, n int, actPos int) {
+	for _, m := range eq.msgs[:n] {
+		d.add(EfhDiffEntry{Kind: EfhDiffMissing, ExpPos: eq.pos, ActPos: actPos, Exp: m})
+		eq.pop(1)
+	}
+}
+func (d *EfhDiff) addExtra(aq *efhDiffQueue, n int, expPos int) {
+	for _, m := range aq.msgs[:n] {
+		d.add(EfhDiffEntry{Kind: EfhDiffExtra, ExpPos: expPos, ActPos: aq.pos, Act: m})
+		aq.pop(1)
+	}
+}
+func (d *EfhDiff) add(e EfhDiffEntry) {
+	d.diffNum++
+	m := e.Exp
+	if m == nil {
+		m = e.Act
+	}
+	d.byType[efhDiffSummaryKey{kind: e.Kind, typeName: m.TypeName()}]++
+	d.bySecurityId[m.SecurityId]++
+	if len(d.entries) < d.MaxReports {
+		d.entries = append(d.entries, e)
+	}
+}
+
+func (d *EfhDiff) ignored(name string) bool {
+	for _, ign := range d.IgnoreFields {
+		if name == ign || strings.HasSuffix(name, "."+ign) {
+			return true
+		}
+	}
+	return false
+}
+func (d *EfhDiff) diffFields(exp, act *EfhDumpMessage) (fields []string) {
+	if exp.Type != act.Type {
+		return []string{"HDR.T"}
+	}
+	for i, f := range exp.Fields {
+		if d.ignored(f.Name) {
+			continue
+		}
+		if i >= len(act.Fields) || act.Fields[i].Name != f.Name {
+			return []string{"*"}
+		}
+		if act.Fields[i].Value != f.Value {
+			fields = append(fields, f.Name)
+		}
+	}
+	if len(act.Fields) != len(exp.Fields) {
+		return []string{"*"}
+	}
+	return
+}
+
+func (d *EfhDiff) Report(w io.Writer) (err error) {
+	defer errs.PassE(&err)
+	printf := func(format string, v ...interface{}) {
+		_, err := fmt.Fprintf(w, format, v...)
+		errs.CheckE(err)
+	}
+	printf("%s\n", d.Summary())
+	if d.Same() {
+		return
+	}
+	printf("\nfirst %d differences:\n", len(d.entries))
+	for _, e := range d.entries {
+		printf("%s exp #%d act #%d", e.Kind, e.ExpPos, e.ActPos)
+		if e.Kind == EfhDiffChanged {
+			printf(" fields %v", e.Fields)
+		}
+		printf("\n")
+		if e.Exp != nil {
+			printf("  exp: %s\n", e.Exp.Text)
+		}
+		if e.Act != nil {
+			printf("  act: %s\n", e.Act.Text)
+		}
+		if e.Kind != EfhDiffChanged {
+			continue
+		}
+		for _, name := range e.Fields {
+			ev, _ := e.Exp.Field(name)
+			av, _ := e.Act.Field(name)
+			printf("    %s: %s -> %s\n", name, ev, av)
+		}
+	}
+
+	printf("\ndifferences by type:\n")
+	var keys efhDiffSummaryKeys
+	for k := range d.byType {
+		keys = append(keys, k)
+	}
+	sort.Sort(keys)
+	for _, k := range keys {
+		printf("%-8s %-8s %d\n", k.typeName, k.kind, d.byType[k])
+	}
+
+	printf("\ndifferences by option:\n")
+	var counts efhDiffSecurityIdCounts
+	for sid, n := range d.bySecurityId {
+		counts = append(counts, efhDiffSecurityIdCount{sid: sid, n: n})
+	}
+	sort.Sort(counts)
+	for _, c := range counts {
+		printf("%016x %d\n", c.sid, c.n)
+	}
+	return
+}
+
+type efhDiffSummaryKeys []efhDiffSummaryKey
+
+func (a efhDiffSummaryKeys) Len() int      { return len(a) }
+func (a efhDiffSummaryKeys) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a efhDiffSummaryKeys) Less(i, j int) bool {
+	if a[i].typeName != a[j].typeName {
+		return a[i].typeName < a[j].typeName
+	}
+	return a[i].kind < a[j].kind
+}
+
+type efhDiffSecurityIdCount struct {
+	sid uint64
+	n   int
+}
+type efhDiffSecurityIdCounts []efhDiffSecurityIdCount
+
+func (a efhDiffSecurityIdCounts) Len() int      { return len(a) }
+func (a efhDiffSecurityIdCounts) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a efhDiffSecurityIdCounts) Less(i, j int) bool {
+	if a[i].n != a[j].n {
+		return a[i].n > a[j].n
+	}
+	return a[i].sid < a[j].sid
+}
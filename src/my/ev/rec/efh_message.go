@@ -35,6 +35,8 @@ var efhmOutputNames = [...]string{
 	EFHM_DEFINITION_NOM:  "DEF_NOM",
 	EFHM_DEFINITION_BATS: "DEF_BATS",
 	EFHM_DEFINITION_MIAX: "DEF_MIAX",
+	EFHM_REFRESHED:       "REFRESHED",
+	EFHM_STOPPED:         "STOPPED",
 }
 
 type efhm_header struct {
@@ -107,7 +109,7 @@ type efhm_definition_bats struct {
 
 func (m efhm_header) String() string {
 	switch m.Type {
-	case EFHM_QUOTE, EFHM_ORDER, EFHM_TRADE, EFHM_DEFINITION_NOM, EFHM_DEFINITION_BATS, EFHM_DEFINITION_MIAX:
+	case EFHM_QUOTE, EFHM_ORDER, EFHM_TRADE, EFHM_DEFINITION_NOM, EFHM_DEFINITION_BATS, EFHM_DEFINITION_MIAX, EFHM_REFRESHED, EFHM_STOPPED:
 		return fmt.Sprintf("HDR{T:%d, G:%d, QP:%d, UId:%08x, SId:%016x, SN:%d, TS:%016x} %s",
 			m.Type,
 			m.GroupId,
@@ -201,4 +203,16 @@ type efhMessage interface {
 	efhMessage()
 }
 
+// packed little-endian struct padded to multiple of 8 bytes, as in test_efh dump
+func efhMessageBytes(m efhMessage) (b []byte, err error) {
+	var bb bytes.Buffer
+	if err = binary.Write(&bb, binary.LittleEndian, m); err != nil {
+		return
+	}
+	if r := bb.Len() % 8; r > 0 {
+		bb.Write(make([]byte, 8-r))
+	}
+	return bb.Bytes(), nil
+}
+
 func (h efhm_header) efhMessage() {}
@@ -0,0 +1,246 @@
+// Copyright (c) Ilia Kravets, 2016. All rights reserved. PROVIDED "AS IS"
+// WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
+
+package rec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ikravets/errs"
+)
+
+type EfhDumpField struct {
+	Name  string
+	Value string
+}
+
+type EfhDumpMessage struct {
+	Type       uint8
+	SecurityId uint64
+	Text       string
+	Fields     []EfhDumpField
+}
+
+func (m *EfhDumpMessage) TypeName() string {
+	if int(m.Type) < len(efhmOutputNames) && efhmOutputNames[m.Type] != "" {
+		return efhmOutputNames[m.Type]
+	}
+	return fmt.Sprintf("T%d", m.Type)
+}
+func (m *EfhDumpMessage) Field(name string) (value string, ok bool) {
+	for _, f := range m.Fields {
+		if f.Name == name {
+			return f.Value, true
+		}
+	}
+	return
+}
+
+type EfhDumpReader interface {
+	ReadMessage() (*EfhDumpMessage, error)
+}
+
+var BadEfhDumpError = errors.New("bad efh dump")
+
+// detects binary (test_efh --dump-file) or text (testefhPrinter) format
+func NewEfhDumpReader(r io.Reader) (EfhDumpReader, error) {
+	br := bufio.NewReader(r)
+	b, err := br.Peek(1)
+	if err == io.EOF {
+		return &efhTextDumpReader{s: bufio.NewScanner(br)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if b[0] == 'H' {
+		return &efhTextDumpReader{s: bufio.NewScanner(br)}, nil
+	}
+	return &efhBinaryDumpReader{r: br}, nil
+}
+
+type efhBinaryDumpReader struct {
+	r   io.Reader
+	buf [128]byte
+}
+
+func (r *efhBinaryDumpReader) ReadMessage() (dm *EfhDumpMessage, err error) {
+	defer errs.PassE(&err)
+	const headerSize = 32
+	if _, err = io.ReadFull(r.r, r.buf[:headerSize]); err == io.EOF {
+		return
+	} else if err == io.ErrUnexpectedEOF {
+		errs.CheckE(BadEfhDumpError)
+	}
+	errs.CheckE(err)
+	var h efhm_header
+	errs.CheckE(binary.Read(bytes.NewReader(r.buf[:headerSize]), binary.LittleEndian, &h))
+	var size int
+	switch h.Type {
+	case EFHM_ORDER:
+		size = 64
+	case EFHM_QUOTE:
+		size = 104
+	case EFHM_TRADE:
+		size = 48
+	case EFHM_DEFINITION_NOM, EFHM_DEFINITION_MIAX:
+		size = 72
+	case EFHM_DEFINITION_BATS:
+		size = 56
+	default:
+		size = headerSize
+	}
+	if size > headerSize {
+		_, err = io.ReadFull(r.r, r.buf[headerSize:size])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			errs.CheckE(BadEfhDumpError)
+		}
+		errs.CheckE(err)
+	}
+	// embedded and padding fields are unexported, so decode field by field
+	br := bytes.NewReader(r.buf[headerSize:size])
+	read := func(data ...interface{}) {
+		for _, d := range data {
+			errs.CheckE(binary.Read(br, binary.LittleEndian, d))
+		}
+	}
+	var m efhMessage = h
+	switch h.Type {
+	case EFHM_ORDER:
+		o := efhm_order{efhm_header: h}
+		read(&o.TradeStatus, &o.OrderType, &o.OrderSide, &o._pad, &o.Price, &o.Size, &o.AoNSize,
+			&o.CustomerSize, &o.CustomerAoNSize, &o.BDSize, &o.BDAoNSize)
+		m = o
+	case EFHM_QUOTE:
+		q := efhm_quote{efhm_header: h}
+		read(&q.TradeStatus, &q._pad,
+			&q.BidPrice, &q.BidSize, &q.BidOrderSize, &q.BidAoNSize,
+			&q.BidCustomerSize, &q.BidCustomerAoNSize, &q.BidBDSize, &q.BidBDAoNSize,
+			&q.AskPrice, &q.AskSize, &q.AskOrderSize, &q.AskAoNSize,
+			&q.AskCustomerSize, &q.AskCustomerAoNSize, &q.AskBDSize, &q.AskBDAoNSize)
+		m = q
+	case EFHM_TRADE:
+		t := efhm_trade{efhm_header: h}
+		read(&t.Price, &t.Size, &t.TradeCondition)
+		m = t
+	case EFHM_DEFINITION_NOM, EFHM_DEFINITION_MIAX:
+		d := efhm_definition_nom{efhm_header: h}
+		read(&d.Symbol, &d.MaturityDate, &d.UnderlyingSymbol, &d.StrikePrice, &d.PutOrCall)
+		m = d
+	case EFHM_DEFINITION_BATS:
+		d := efhm_definition_bats{efhm_header: h}
+		read(&d.OsiSymbol)
+		m = d
+	}
+	return parseEfhDumpText(m.String())
+}
+
+type efhTextDumpReader struct {
+	s *bufio.Scanner
+}
+
+func (r *efhTextDumpReader) ReadMessage() (dm *EfhDumpMessage, err error) {
+	for r.s.Scan() {
+		line := strings.TrimSpace(r.s.Text())
+		if line == "" {
+			continue
+		}
+		return parseEfhDumpText(line)
+	}
+	if err = r.s.Err(); err == nil {
+		err = io.EOF
+	}
+	return
+}
+
+// parses output of efhm_*.String(), e.g. "HDR{T:3, ...} ORD{TS:0, ...}"
+// field names are qualified by enclosing groups, e.g. "HDR.SN" or "QUO.Bid.P"
+func parseEfhDumpText(text string) (dm *EfhDumpMessage, err error) {
+	defer errs.PassE(&err)
+	dm = &EfhDumpMessage{Text: text}
+	p := efhDumpTextParser{s: text}
+	errs.CheckE(p.parseGroups("", &dm.Fields))
+	v, ok := dm.Field("HDR.T")
+	errs.Check(ok, BadEfhDumpError, dm.Text)
+	t, err := strconv.ParseUint(v, 10, 8)
+	errs.CheckE(err)
+	dm.Type = uint8(t)
+	if v, ok := dm.Field("HDR.SId"); ok {
+		dm.SecurityId, err = strconv.ParseUint(v, 16, 64)
+		errs.CheckE(err)
+	}
+	return
+}
+
+type efhDumpTextParser struct {
+	s   string
+	pos int
+}
+
+func (p *efhDumpTextParser) skipSeparators() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == ',') {
+		p.pos++
+	}
+}
+func (p *efhDumpTextParser) ident() string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if c == '{' || c == '}' || c == ':' || c == ',' || c == ' ' {
+			break
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+func (p *efhDumpTextParser) value() string {
+	start := p.pos
+	quoted := false
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if c == '"' {
+			quoted = !quoted
+		} else if !quoted && (c == ',' || c == '}') {
+			break
+		}
+		p.pos++
+	}
+	return strings.TrimSpace(p.s[start:p.pos])
+}
+func (p *efhDumpTextParser) parseGroups(prefix string, fields *[]EfhDumpField) (err error) {
+	for {
+		p.skipSeparators()
+		if p.pos >= len(p.s) || p.s[p.pos] == '}' {
+			return
+		}
+		name := p.ident()
+		if name == "" {
+			return fmt.Errorf("%s: `%s` at %d", BadEfhDumpError, p.s, p.pos)
+		}
+		if p.pos >= len(p.s) || p.s[p.pos] == ' ' || p.s[p.pos] == ',' {
+			// message type name without body, e.g. "HDR{...} STOPPED"
+			continue
+		}
+		switch p.s[p.pos] {
+		case '{':
+			p.pos++
+			if err = p.parseGroups(prefix+name+".", fields); err != nil {
+				return
+			}
+			if p.pos >= len(p.s) {
+				return fmt.Errorf("%s: `%s` unterminated", BadEfhDumpError, p.s)
+			}
+			p.pos++
+		case ':':
+			p.pos++
+			*fields = append(*fields, EfhDumpField{Name: prefix + name, Value: p.value()})
+		default:
+			return fmt.Errorf("%s: `%s` at %d", BadEfhDumpError, p.s, p.pos)
+		}
+	}
+}
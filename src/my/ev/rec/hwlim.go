@@ -1,28 +1,230 @@
-// Copyright (c) Ilia Kravets, 2015. All rights reserved. PROVIDED "AS IS"
+// Copyright (c) Ilia Kravets, 2015-2016. All rights reserved. PROVIDED "AS IS"
 // WITHOUT ANY WARRANTY, EXPRESS OR IMPLIED. See LICENSE file for details.
 
 package rec
 
 import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"log"
+	"time"
+
+	"github.com/go-yaml/yaml"
+	"github.com/ikravets/errs"
+
+	"my/ev/packet"
 	"my/ev/sim"
 )
 
+// zero limit means unlimited
+type HwLimProfile struct {
+	Subscriptions        int `yaml:"subscriptions"`
+	BookLevels           int `yaml:"book_levels"`
+	Books                int `yaml:"books"`
+	OrderTableSize       int `yaml:"order_table_size"`
+	OrderTableBuckets    int `yaml:"order_table_buckets"`
+	OrderTableBucketSize int `yaml:"order_table_bucket_size"`
+	ChannelMsgRate       int `yaml:"channel_msg_rate"` // messages per second
+}
+
+const supernodeLevels = 256
+const supernodes = 256 * 1024
+
+var HwLimProfileDefault = HwLimProfile{
+	Subscriptions: supernodeLevels,
+	BookLevels:    supernodeLevels,
+	Books:         supernodes,
+}
+
+func LoadHwLimProfile(r io.Reader) (p HwLimProfile, err error) {
+	defer errs.PassE(&err)
+	buf, err := ioutil.ReadAll(r)
+	errs.CheckE(err)
+	p = HwLimProfileDefault
+	errs.CheckE(yaml.Unmarshal(buf, &p))
+	if p.OrderTableBuckets != 0 || p.OrderTableBucketSize != 0 {
+		errs.Check(p.OrderTableBuckets > 0, "order_table_buckets must be set with order_table_bucket_size")
+	}
+	return
+}
+
+type HwLimResource int
+
+const (
+	HwLimBookLevels HwLimResource = iota
+	HwLimBooks
+	HwLimOrderTable
+	HwLimOrderTableBucket
+	HwLimChannelMsgRate
+	HwLimResources
+)
+
+var hwLimResourceNames = [...]string{
+	HwLimBookLevels:       "book levels",
+	HwLimBooks:            "books",
+	HwLimOrderTable:       "order table",
+	HwLimOrderTableBucket: "order table bucket",
+	HwLimChannelMsgRate:   "channel msg rate",
+}
+
+func (r HwLimResource) String() string {
+	return hwLimResourceNames[r]
+}
+
+// hw has no room for a new book once the limit is reached
+func (r HwLimResource) failsAtLimit() bool {
+	return r == HwLimBooks
+}
+
+type HwLimViolation struct {
+	Time     time.Time
+	Resource HwLimResource
+	OptionId packet.OptionId
+	Channel  int
+	Value    int
+	Limit    int
+}
+
+func (v HwLimViolation) String() string {
+	op := ">"
+	if v.Resource.failsAtLimit() {
+		op = ">="
+	}
+	return fmt.Sprintf("%s %s: %d %s %d (oid %d, channel %d)",
+		v.Time.Format("15:04:05.000000"), v.Resource, v.Value, op, v.Limit, v.OptionId, v.Channel)
+}
+
+type HwLimMode byte
+
+const (
+	HwLimModeFailFast HwLimMode = iota
+	HwLimModeReportOnly
+)
+
+type hwLimOrderKey struct {
+	orderId      packet.OrderId
+	sessionIndex int
+}
+
+type hwLimChannelRate struct {
+	second   int64
+	messages int
+}
+
+// report-only mode keeps details of the first violations, the rest are only counted
+const hwLimViolationsKept = 1000
+
 type HwLimChecker struct {
+	profile    HwLimProfile
+	mode       HwLimMode
+	violations []HwLimViolation // first hwLimViolationsKept only
+	violNum    [HwLimResources]int
+	peak       [HwLimResources]int
+	limit      [HwLimResources]int
+	lastTime   time.Time
+	channel    int
+	orders     map[hwLimOrderKey]uint64
+	buckets    map[uint64]int
+	rates      []hwLimChannelRate
 }
 
 var _ sim.Observer = &HwLimChecker{}
 
-const supernodeLevels = 256
-const supernodes = 256 * 1024
+func NewHwLimChecker(profile HwLimProfile, mode HwLimMode) *HwLimChecker {
+	hlc := &HwLimChecker{
+		profile: profile,
+		mode:    mode,
+		orders:  make(map[hwLimOrderKey]uint64),
+		buckets: make(map[uint64]int),
+	}
+	hlc.limit = [HwLimResources]int{
+		HwLimBookLevels:       profile.BookLevels,
+		HwLimBooks:            profile.Books,
+		HwLimOrderTable:       profile.OrderTableSize,
+		HwLimOrderTableBucket: profile.OrderTableBucketSize,
+		HwLimChannelMsgRate:   profile.ChannelMsgRate,
+	}
+	return hlc
+}
 
-var HwMaxSubscriptions int = supernodeLevels
+func (hlc *HwLimChecker) check(res HwLimResource, value int, oid packet.OptionId) {
+	if value > hlc.peak[res] {
+		hlc.peak[res] = value
+	}
+	limit := hlc.limit[res]
+	if limit == 0 || value < limit || value == limit && !res.failsAtLimit() {
+		return
+	}
+	v := HwLimViolation{
+		Time:     hlc.lastTime,
+		Resource: res,
+		OptionId: oid,
+		Channel:  hlc.channel,
+		Value:    value,
+		Limit:    limit,
+	}
+	if hlc.mode == HwLimModeFailFast {
+		log.Fatalf("reached hw limit: %s\n", v)
+	}
+	hlc.violNum[res]++
+	if len(hlc.violations) < hwLimViolationsKept {
+		hlc.violations = append(hlc.violations, v)
+	}
+}
 
-func NewHwLimChecker() *HwLimChecker {
-	return &HwLimChecker{}
+func (hlc *HwLimChecker) MessageArrived(idm *sim.SimMessage) {
+	hlc.lastTime = idm.Pam.Timestamp()
+	hlc.channel = idm.Session.Index()
+	for len(hlc.rates) <= hlc.channel {
+		hlc.rates = append(hlc.rates, hwLimChannelRate{})
+	}
+	r := &hlc.rates[hlc.channel]
+	if sec := hlc.lastTime.Unix(); sec != r.second {
+		r.second, r.messages = sec, 0
+	}
+	r.messages++
+	hlc.check(HwLimChannelMsgRate, r.messages, packet.OptionIdUnknown)
+}
+func (hlc *HwLimChecker) OperationAppliedToOrders(operation sim.SimOperation) {
+	if operation.GetOptionId().Invalid() {
+		return
+	}
+	session := operation.GetMessage().Session
+	switch op := operation.(type) {
+	case *sim.OperationAdd:
+		key := hwLimOrderKey{orderId: op.OrderId, sessionIndex: session.Index()}
+		if _, ok := hlc.orders[key]; ok {
+			return
+		}
+		bucket := hlc.bucket(op.OrderId)
+		hlc.orders[key] = bucket
+		hlc.buckets[bucket]++
+		hlc.check(HwLimOrderTable, len(hlc.orders), op.GetOptionId())
+		if hlc.profile.OrderTableBuckets != 0 {
+			hlc.check(HwLimOrderTableBucket, hlc.buckets[bucket], op.GetOptionId())
+		}
+	case *sim.OperationRemove, *sim.OperationUpdate:
+		if operation.GetNewSize(sim.SizeKindDefault) != 0 {
+			return
+		}
+		key := hwLimOrderKey{orderId: operation.GetOrigOrderId(), sessionIndex: session.Index()}
+		if bucket, ok := hlc.orders[key]; ok {
+			delete(hlc.orders, key)
+			hlc.buckets[bucket]--
+		}
+	}
+}
+func (hlc *HwLimChecker) bucket(orderId packet.OrderId) uint64 {
+	if hlc.profile.OrderTableBuckets == 0 {
+		return 0
+	}
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, orderId.ToUint64())
+	return uint64(crc32.ChecksumIEEE(data)) % uint64(hlc.profile.OrderTableBuckets)
 }
-func (hlc *HwLimChecker) MessageArrived(*sim.SimMessage)              {}
-func (hlc *HwLimChecker) OperationAppliedToOrders(sim.SimOperation)   {}
 func (hlc *HwLimChecker) BeforeBookUpdate(sim.Book, sim.SimOperation) {}
 func (hlc *HwLimChecker) AfterBookUpdate(book sim.Book, operation sim.SimOperation) {
 	opa, ok := operation.(*sim.OperationAdd)
@@ -30,14 +232,46 @@ func (hlc *HwLimChecker) AfterBookUpdate(book sim.Book, operation sim.SimOperati
 		return
 	}
 	if opa.Independent() {
-		if book.NumOptions() == supernodes {
-			log.Fatalf("reached hw supernodes limit (%d)\n", supernodes)
-		}
+		hlc.check(HwLimBooks, book.NumOptions(), operation.GetOptionId())
 	}
 	tob := book.GetTop(operation.GetOptionId(), operation.GetSide(), 0)
-	if len(tob) > supernodeLevels {
-		log.Fatalf("book (oid %d, side %s) has %d levels (>%d)",
-			operation.GetOptionId(), operation.GetSide(),
-			len(tob), supernodeLevels)
+	hlc.check(HwLimBookLevels, len(tob), operation.GetOptionId())
+}
+
+// first violations, see ViolationsNum for the total
+func (hlc *HwLimChecker) Violations() []HwLimViolation {
+	return hlc.violations
+}
+func (hlc *HwLimChecker) ViolationsNum() (n int) {
+	for _, v := range hlc.violNum {
+		n += v
+	}
+	return
+}
+func (hlc *HwLimChecker) Report(w io.Writer) (err error) {
+	defer errs.PassE(&err)
+	printf := func(format string, v ...interface{}) {
+		_, err := fmt.Fprintf(w, format, v...)
+		errs.CheckE(err)
+	}
+	printf("resource\tlimit\tpeak\tutilization\tviolations\n")
+	for res := HwLimResource(0); res < HwLimResources; res++ {
+		limit := hlc.limit[res]
+		utilization := "-"
+		if limit != 0 {
+			utilization = fmt.Sprintf("%.1f%%", float64(hlc.peak[res])*100/float64(limit))
+		}
+		printf("%s\t%d\t%d\t%s\t%d\n", res, limit, hlc.peak[res], utilization, hlc.violNum[res])
+	}
+	if len(hlc.violations) != 0 {
+		if n := hlc.ViolationsNum(); n > len(hlc.violations) {
+			printf("\nfirst %d of %d violations:\n", len(hlc.violations), n)
+		} else {
+			printf("\nviolations:\n")
+		}
+		for _, v := range hlc.violations {
+			printf("%s\n", v)
+		}
 	}
+	return
 }
@@ -17,6 +17,7 @@ type Stream struct {
 	message *sim.SimMessage
 	seconds []int
 	seqNum  []uint64
+	gap     bool
 }
 
 func NewStream() *Stream {
@@ -34,10 +35,12 @@ func (l *Stream) MessageArrived(idm *sim.SimMessage) {
 		l.seqNum = make([]uint64, idx+1)
 		copy(l.seqNum, seqNumOld)
 	}
+	l.gap = false
 	seq := l.message.Pam.SequenceNumber()
 	if seq != 0 {
-		if prevSeq := l.seqNum[idx]; prevSeq != 0 && prevSeq+1 != seq {
+		if prevSeq := l.seqNum[idx]; prevSeq != 0 && seq > prevSeq+1 {
 			log.Printf("seqNum gap; expected %d actual %d\n", prevSeq+1, seq)
+			l.gap = true
 		}
 		l.seqNum[idx] = seq
 	}
@@ -55,6 +58,9 @@ func (l *Stream) getSeqNum() uint64 {
 	idx := l.message.Session.Index()
 	return l.seqNum[idx]
 }
+func (l *Stream) getGap() bool {
+	return l.gap
+}
 func (l *Stream) getTimestamp() uint64 {
 	idx := l.message.Session.Index()
 	return uint64(l.seconds[idx])*1e9 + uint64(l.message.Pam.Layer().(packet.ExchangeMessage).Nanoseconds())
@@ -4,7 +4,6 @@
 package rec
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -44,6 +43,8 @@ func NewSimLogger(c SimLoggerConfig) *SimLogger {
 	elc := c.EfhLoggerConfig
 	elc.Printer = s
 	elc.Writer = nil
+	// status messages are generated by software, not by hw
+	elc.NoStatus = true
 	s.efhLogger = *NewEfhLogger(elc)
 	return s
 }
@@ -255,25 +256,10 @@ func (s *SimLogger) accessedLevels(operation sim.SimOperation) (levels int) {
 
 func (s *SimLogger) PrintMessage(m efhMessage) (err error) {
 	defer errs.PassE(&err)
-	var bb bytes.Buffer
-	errs.CheckE(binary.Write(&bb, binary.LittleEndian, m))
-	if r := bb.Len() % 8; r > 0 {
-		// pad to  multiple of 8 bytes
-		z := make([]byte, 8)
-		_, err = bb.Write(z[0 : 8-r])
-		errs.CheckE(err)
-	}
-
-	for {
-		var qw uint64
-		if err := binary.Read(&bb, binary.LittleEndian, &qw); err != nil {
-			if err == io.EOF {
-				break
-			}
-			errs.CheckE(err)
-		} else {
-			s.printfln("DMATOHOST_DATA %016x", qw)
-		}
+	b, err := efhMessageBytes(m)
+	errs.CheckE(err)
+	for i := 0; i < len(b); i += 8 {
+		s.printfln("DMATOHOST_DATA %016x", binary.LittleEndian.Uint64(b[i:]))
 	}
 	s.printfln("DMATOHOST_TRAILER 00656e696c616b45")
 	return
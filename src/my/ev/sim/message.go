@@ -125,6 +125,12 @@ func (m *SimMessage) populateOps() {
 			Size:     int(im.Size),
 		}
 		addOperation(packet.OrderIdUnknown, &OperationAdd{order: ord})
+	case *bats.PitchMessageUnitClear:
+		// all orders of the unit are removed, one book update per order
+		m.opsPerBook = 1
+		for _, r := range m.sim.OrderDb().sessionOrderIds(m.Session) {
+			addOperation(r, &OperationRemove{})
+		}
 	case *bats.PitchMessageDeleteOrder:
 		addOperation(im.OrderId, &OperationRemove{})
 	case *bats.PitchMessageOrderExecuted:
@@ -154,15 +160,18 @@ func (m *SimMessage) populateOps() {
 		*nasdaq.IttoMessageOptionOpen,
 		*nasdaq.IttoMessageOptionTradingAction,
 		*nasdaq.IttoMessageSeconds,
+		*nasdaq.IttoMessageSystemEvent,
 		*bats.PitchMessageTime,
 		*bats.PitchMessageSymbolMapping,
 		*bats.PitchMessageTrade,
 		*bats.PitchMessageTradingStatus,
+		*bats.PitchMessageEndOfSession,
 		*miax.TomMessageLiquiditySeeking,
 		*miax.TomMessageTrade,
 		*miax.TomMessageSeriesUpdate,
 		*miax.TomMessageUnderlyingTradeStatus,
 		*miax.TomMessageSystemTime,
+		*miax.TomMessageSystemState,
 		*miax.TomMessageUnknown: // FIXME
 		// silently ignore
 	default:
@@ -175,9 +184,12 @@ func (m *SimMessage) populateOps() {
 		m.sides = 1
 	}
 }
+func (m *SimMessage) Subscribed(oid packet.OptionId) bool {
+	return m.sim.Subscr() == nil || m.sim.Subscr().Subscribed(oid)
+}
 func (m *SimMessage) subscribedOptionId() packet.OptionId {
 	em := m.Pam.Layer().(packet.ExchangeMessage)
-	if m.sim.Subscr() == nil || m.sim.Subscr().Subscribed(em.OptionId()) {
+	if m.Subscribed(em.OptionId()) {
 		return em.OptionId()
 	}
 	return packet.OptionIdUnknown
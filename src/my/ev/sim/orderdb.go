@@ -6,6 +6,7 @@ package sim
 import (
 	"errors"
 	"log"
+	"sort"
 
 	"github.com/ikravets/errs"
 
@@ -15,7 +16,9 @@ import (
 type OrderDb interface {
 	Stats() OrderDbStats
 	ApplyOperation(operation SimOperation)
+	Orders() []Order
 	findOrder(session *Session, orderId packet.OrderId) (order order, err error)
+	sessionOrderIds(session *Session) []packet.OrderId
 }
 type OrderDbStats struct {
 	Orders     int
@@ -55,6 +58,8 @@ type order struct {
 	Size     int
 }
 
+type Order order
+
 var orderNotFoundError = errors.New("order not found")
 
 func (d *orderDb) findOrder(session *Session, orderId packet.OrderId) (order order, err error) {
@@ -109,3 +114,37 @@ func (d *orderDb) Stats() OrderDbStats {
 	}
 	return s
 }
+
+// orders of all sessions sorted by order id
+func (d *orderDb) Orders() []Order {
+	orders := make(orderList, 0, len(d.orders))
+	for _, o := range d.orders {
+		orders = append(orders, Order(o))
+	}
+	sort.Sort(orders)
+	return orders
+}
+
+// sorted to keep operations order deterministic
+func (d *orderDb) sessionOrderIds(session *Session) []packet.OrderId {
+	var orders orderList
+	for idx, o := range d.orders {
+		if idx.sessionIndex == session.index {
+			orders = append(orders, Order(o))
+		}
+	}
+	sort.Sort(orders)
+	ids := make([]packet.OrderId, len(orders))
+	for i, o := range orders {
+		ids[i] = o.OrderId
+	}
+	return ids
+}
+
+type orderList []Order
+
+func (a orderList) Len() int      { return len(a) }
+func (a orderList) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a orderList) Less(i, j int) bool {
+	return a[i].OrderId.ToUint64() < a[j].OrderId.ToUint64()
+}